@@ -1,70 +1,368 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pliliya111/go_final_sprint/internal/agent"
 	"github.com/pliliya111/go_final_sprint/internal/calculator"
+	"github.com/pliliya111/go_final_sprint/internal/model"
 )
 
-func getComputingPower() int {
-	powerStr := os.Getenv("COMPUTING_POWER")
-	if powerStr == "" {
-		return 1
+// register регистрирует агента, повторяя попытки, пока оркестратор недоступен.
+// Если ctx отменён раньше, возвращает 0.
+func register(ctx context.Context, client agent.Transport, policy agent.RetryPolicy, metrics *agent.Metrics, info model.Agent) time.Duration {
+	for attempt := 1; ; attempt++ {
+		interval, err := client.Register(ctx, info)
+		if err == nil {
+			log.Printf("Registered as agent %s", info.ID)
+			metrics.SetRegistered()
+			if interval <= 0 {
+				interval = 5 * time.Second
+			}
+			return interval
+		}
+		if ctx.Err() != nil {
+			return 0
+		}
+		log.Printf("Error registering agent: %v", err)
+		metrics.Error("register", err)
+		if !sleep(ctx, policy.Backoff(attempt)) {
+			return 0
+		}
 	}
+}
 
-	power, err := strconv.Atoi(powerStr)
-	if err != nil {
-		log.Printf("Invalid COMPUTING_POWER value: %v. Using default value: 1", err)
-		return 1
+func heartbeat(ctx context.Context, client agent.Transport, policy agent.RetryPolicy, metrics *agent.Metrics, info model.Agent, interval time.Duration) {
+	for sleep(ctx, interval) {
+		err := client.Heartbeat(ctx, info.ID)
+		if errors.Is(err, agent.ErrAgentNotRegistered) {
+			log.Printf("Orchestrator does not know this agent, registering again")
+			if interval = register(ctx, client, policy, metrics, info); interval == 0 {
+				return
+			}
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error sending heartbeat: %v", err)
+			metrics.Error("heartbeat", err)
+			metrics.SetOrchestratorUp(false)
+		} else if err == nil {
+			metrics.SetOrchestratorUp(true)
+		}
 	}
+}
 
-	if power < 1 {
-		log.Printf("COMPUTING_POWER must be at least 1. Using default value: 1")
-		return 1
+// sleep ждёт d и возвращает false, если ctx отменён раньше.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-
-	return power
 }
 
-func worker(id int) {
-	for {
-		task, err := agent.FetchTask()
+// worker запрашивает и вычисляет задачи, пока не отменён ctx. Полученные
+// задачи доделываются, пока не отменён drain; остальные возвращаются оркестратору.
+func worker(ctx, drain context.Context, id int, client agent.Transport, outbox *agent.Outbox, cache *calculator.ResultCache, metrics *agent.Metrics, agentID string, cfg *agent.Config) {
+	policy := cfg.RetryPolicy()
+	failures := 0
+	for ctx.Err() == nil {
+		lease, err := client.FetchTasks(ctx, agentID, cfg.BatchSize, cfg.PollWait)
+		if ctx.Err() != nil {
+			break
+		}
 		if err != nil {
-			log.Printf("Worker %d: Error fetching task: %v", id, err)
-			time.Sleep(1 * time.Second)
+			failures++
+			log.Printf("Worker %d: Error fetching tasks: %v", id, err)
+			metrics.Error("fetch", err)
+			metrics.SetOrchestratorUp(false)
+			sleep(ctx, policy.Backoff(failures))
 			continue
 		}
+		failures = 0
+		metrics.SetOrchestratorUp(true)
 
-		if task == nil {
+		if lease == nil {
 			log.Printf("Worker %d: No tasks available, waiting...", id)
-			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		processLease(drain, id, client, policy, outbox, cache, metrics, agentID, lease)
+	}
+	log.Printf("Worker %d: Stopped", id)
+}
+
+// processLease вычисляет задачи аренды и отправляет результаты.
+func processLease(drain context.Context, id int, client agent.Transport, policy agent.RetryPolicy, outbox *agent.Outbox, cache *calculator.ResultCache, metrics *agent.Metrics, agentID string, lease *model.Lease) {
+	results := make([]model.TaskResult, 0, len(lease.Tasks))
+	var unfinished []string
+	for _, task := range lease.Tasks {
+		if drain.Err() != nil {
+			unfinished = append(unfinished, task.ID)
+			continue
+		}
+		if client.Cancelled(task.ID) {
+			log.Printf("Worker %d: Task %s was cancelled, skipping", id, task.ID)
+			continue
+		}
+		if task.Deadline > 0 && time.Now().UnixMilli() >= task.Deadline {
+			log.Printf("Worker %d: Task %s deadline already passed, skipping", id, task.ID)
 			continue
 		}
 
 		log.Printf("Worker %d: Processing task %s: %v %s %v", id, task.ID, task.Arg1, task.Operation, task.Arg2)
 
-		result := calculator.PerformOperation(task)
+		metrics.StartTask(id, task)
+		started := time.Now()
+		result := cache.Perform(drain, task)
+		if err, ok := result.(error); ok && errors.Is(err, calculator.ErrDeadlineExceeded) {
+			log.Printf("Worker %d: Task %s abandoned: %v", id, task.ID, err)
+			metrics.StopTask(id)
+			continue
+		}
+		if err, ok := result.(error); ok && drain.Err() != nil && errors.Is(err, drain.Err()) {
+			unfinished = append(unfinished, task.ID)
+			metrics.StopTask(id)
+			continue
+		}
+		reason, _ := result.(error)
+		metrics.FinishTask(id, task.Operation, time.Since(started), reason)
 		log.Printf("Worker %d: Task %s result: %v", id, task.ID, result)
 
-		if err := agent.SubmitTaskResult(task.ID, result); err != nil {
-			log.Printf("Worker %d: Error submitting result for task %s: %v", id, task.ID, err)
+		value, ok := result.(float64)
+		if !ok {
+			log.Printf("Worker %d: Task %s failed: %v", id, task.ID, result)
+			if reason, ok := result.(error); ok {
+				err := policy.Do(drain, func() error {
+					return client.FailTask(context.Background(), agentID, task.ID, lease.Token, reason)
+				})
+				if err != nil {
+					log.Printf("Worker %d: Error reporting task %s failure: %v", id, task.ID, err)
+					metrics.Error("fail_task", err)
+				}
+			}
+			continue
+		}
+		results = append(results, model.TaskResult{
+			ID:         task.ID,
+			Result:     value,
+			LeaseToken: lease.Token,
+			AgentID:    agentID,
+		})
+	}
+
+	// Результаты и освобождение задач отправляются и во время остановки
+	if len(results) > 0 {
+		submitResults(drain, id, client, policy, outbox, metrics, results)
+	}
+	if len(unfinished) > 0 {
+		log.Printf("Worker %d: Releasing %d unfinished tasks", id, len(unfinished))
+		err := policy.Do(drain, func() error {
+			return client.ReleaseTasks(context.Background(), lease.Token, unfinished)
+		})
+		if err != nil {
+			log.Printf("Worker %d: Error releasing tasks: %v", id, err)
+			metrics.Error("release", err)
+		}
+	}
+}
+
+// Сколько попыток отправить результаты делается до записи их в журнал.
+const submitAttempts = 3
+
+// Как часто агент пробует отправить результаты из журнала.
+const outboxReplayInterval = 5 * time.Second
+
+// submitResults отправляет результаты оркестратору. Результаты сначала
+// дописываются в журнал, а отправляет их только Flush журнала, поэтому
+// результаты воркеров и повтор из журнала не обгоняют друг друга и уходят
+// в порядке вычисления. Повтор безопасен, потому что оркестратор
+// подтверждает уже принятый результат. Что не удалось отправить за
+// несколько попыток, остаётся в журнале и отправляется позже.
+func submitResults(drain context.Context, id int, client agent.Transport, policy agent.RetryPolicy, outbox *agent.Outbox, metrics *agent.Metrics, results []model.TaskResult) {
+	policy.MaxAttempts = submitAttempts
+
+	if err := outbox.Append(results); err != nil {
+		log.Printf("Worker %d: Error saving results to outbox: %v", id, err)
+		metrics.Error("outbox", err)
+		// Без журнала результаты отправляются напрямую, иначе они потеряются
+		err := policy.Do(drain, func() error {
+			return client.SubmitTaskResults(context.Background(), results)
+		})
+		if err != nil {
+			for _, r := range results {
+				log.Printf("Worker %d: Result of task %s was not delivered: %v (lease %s, %v)", id, r.ID, r.Result, r.LeaseToken, err)
+			}
 		}
+		return
+	}
 
-		time.Sleep(3 * time.Second)
+	err := policy.Do(drain, func() error {
+		_, err := outbox.Flush(drain, client.SubmitTaskResults)
+		return err
+	})
+	if err != nil {
+		log.Printf("Worker %d: Error submitting results, %d left in outbox: %v", id, outbox.Len(), err)
+		metrics.Error("submit", err)
+	}
+}
+
+// replayOutbox отправляет результаты из журнала, пока не отменён ctx.
+func replayOutbox(ctx context.Context, client agent.Transport, outbox *agent.Outbox) {
+	for sleep(ctx, outboxReplayInterval) {
+		flushOutbox(ctx, client, outbox)
+	}
+}
+
+func flushOutbox(ctx context.Context, client agent.Transport, outbox *agent.Outbox) {
+	if outbox.Len() == 0 {
+		return
+	}
+	sent, err := outbox.Flush(ctx, client.SubmitTaskResults)
+	if sent > 0 {
+		log.Printf("Delivered %d results from outbox", sent)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Error delivering results from outbox, %d left: %v", outbox.Len(), err)
 	}
 }
 
 func main() {
-	computingPower := getComputingPower()
-	log.Printf("Starting agent with %d workers", computingPower)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "selftest":
+			os.Exit(runSelfTest(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		}
+	}
+
+	cfg, err := agent.LoadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid agent configuration: %v", err)
+	}
+
+	client, err := agent.NewTransport(cfg)
+	if err != nil {
+		log.Fatalf("Invalid agent configuration: %v", err)
+	}
+	defer client.Close()
+
+	outbox, err := agent.OpenOutbox(cfg.OutboxPath)
+	if err != nil {
+		log.Fatalf("Failed to open outbox %s: %v", cfg.OutboxPath, err)
+	}
+	defer outbox.Close()
+	if pending := outbox.Len(); pending > 0 {
+		log.Printf("Outbox %s has %d undelivered results from a previous run", cfg.OutboxPath, pending)
+	}
+
+	// Агент с неверно работающим вычислителем не должен получать задачи
+	if err := calculator.SelfTest(); err != nil {
+		log.Fatalf("Self-test failed, refusing to start:\n%v", err)
+	}
+	bench := calculator.Bench(startupBenchDuration)
+	log.Printf("Self-test passed, bench score %.0f ops/s", bench.Score)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("Failed to get hostname: %v", err)
+	}
+
+	agentID := cfg.AgentID
+	if agentID == "" {
+		agentID = uuid.New().String()
+	}
+
+	info := model.Agent{
+		ID:         agentID,
+		Hostname:   hostname,
+		Workers:    cfg.Workers,
+		Version:    agent.Version,
+		Operations: cfg.Operations,
+		Throughput: cfg.Throughput,
+		BenchScore: bench.Score,
+	}
+	log.Printf("Starting agent %s with %d workers, batch size %d, orchestrator %v",
+		agentID, cfg.Workers, cfg.BatchSize, cfg.OrchestratorURLs)
+	if cfg.GRPCAddr != "" {
+		log.Printf("Receiving tasks over gRPC stream %s", cfg.GRPCAddr)
+	}
+
+	// ctx отменяется по SIGINT или SIGTERM: агент перестаёт запрашивать задачи.
+	// drain отменяется по истечении ShutdownGrace: недоделанные задачи освобождаются.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	drain, stopDrain := context.WithCancel(context.Background())
+	defer stopDrain()
+
+	cache := calculator.NewResultCache(cfg.CacheSize)
+	metrics := agent.NewMetrics(cfg.Workers)
+	registerCacheMetrics(metrics, outbox, cache)
+
+	if cfg.StatusAddr != "" {
+		server := newStatusServer(cfg, info, metrics, outbox, cache)
+		go func() {
+			log.Printf("Serving health and metrics on %s", cfg.StatusAddr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Status server stopped: %v", err)
+			}
+		}()
+		defer server.Close()
+	}
 
-	for i := 0; i < computingPower; i++ {
-		go worker(i)
+	policy := cfg.RetryPolicy()
+	interval := register(ctx, client, policy, metrics, info)
+	if interval == 0 {
+		log.Printf("Agent stopped before registration")
+		return
 	}
+	go heartbeat(ctx, client, policy, metrics, info, interval)
+	flushOutbox(ctx, client, outbox)
+	go replayOutbox(ctx, client, outbox)
 
-	select {}
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			worker(ctx, drain, id, client, outbox, cache, metrics, agentID, cfg)
+		}(i)
+	}
+
+	<-ctx.Done()
+	// Повторный сигнал завершит агент сразу
+	stop()
+	log.Printf("Shutting down, finishing in-flight tasks for up to %s", cfg.ShutdownGrace)
+	grace := time.AfterFunc(cfg.ShutdownGrace, stopDrain)
+	defer grace.Stop()
+
+	wg.Wait()
+
+	// Последняя попытка; неотправленное останется в журнале до следующего запуска
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+	flushOutbox(flushCtx, client, outbox)
+	if pending := outbox.Len(); pending > 0 {
+		log.Printf("%d undelivered results are kept in outbox %s", pending, cfg.OutboxPath)
+	}
+	stats := cache.Stats()
+	log.Printf("Result cache: %d hits, %d misses, %d evictions", stats.Hits, stats.Misses, stats.Evictions)
+	log.Printf("Agent stopped")
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/calculator"
+)
+
+// Сколько длится замер производительности при запуске агента.
+const startupBenchDuration = 400 * time.Millisecond
+
+// runSelfTest выполняет команду `agent selftest` и возвращает код завершения.
+func runSelfTest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := calculator.SelfTest(); err != nil {
+		fmt.Fprintf(os.Stderr, "Self-test failed:\n%v\n", err)
+		return 1
+	}
+	fmt.Printf("Self-test passed: %d cases\n", calculator.SelfTestCases())
+	return 0
+}
+
+// runBench выполняет команду `agent bench` и возвращает код завершения.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	duration := fs.Duration("duration", 2*time.Second, "how long to measure")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "duration must be positive")
+		return 2
+	}
+
+	result := calculator.Bench(*duration)
+	for _, op := range []string{"+", "-", "*", "/"} {
+		fmt.Printf("%s\t%.0f ops/s\n", op, result.PerOperation[op])
+	}
+	fmt.Printf("score\t%.0f ops/s\n", result.Score)
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/agent"
+	"github.com/pliliya111/go_final_sprint/internal/calculator"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// newStatusServer создаёт HTTP-сервер агента: /healthz отвечает, пока процесс
+// жив, /readyz — пока агент зарегистрирован и оркестратор доступен, /metrics
+// отдаёт показатели в формате Prometheus, а /status — состояние воркеров.
+func newStatusServer(cfg *agent.Config, info model.Agent, metrics *agent.Metrics, outbox *agent.Outbox, cache *calculator.ResultCache) *http.Server {
+	startedAt := time.Now().UnixMilli()
+	transport := "http"
+	if cfg.GRPCAddr != "" {
+		transport = "grpc"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready, reason := metrics.Ready(); !ready {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not ready", "reason": reason})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready"})
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := metrics.WritePrometheus(w); err != nil {
+			log.Printf("Error writing metrics: %v", err)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := metrics.Ready()
+		stats := cache.Stats()
+		status := map[string]interface{}{
+			"agent_id":       info.ID,
+			"version":        info.Version,
+			"bench_score":    info.BenchScore,
+			"transport":      transport,
+			"started_at":     startedAt,
+			"ready":          ready,
+			"outbox_results": outbox.Len(),
+			"cache_hits":     stats.Hits,
+			"cache_misses":   stats.Misses,
+			"cache_results":  stats.Size,
+			"workers":        metrics.Workers(),
+		}
+		if !ready {
+			status["reason"] = reason
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	return &http.Server{Addr: cfg.StatusAddr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// registerCacheMetrics добавляет в /metrics показатели кэша результатов и журнала.
+func registerCacheMetrics(metrics *agent.Metrics, outbox *agent.Outbox, cache *calculator.ResultCache) {
+	metrics.CounterFunc("agent_cache_hits_total", "Operation results served from the cache.", func() float64 {
+		return float64(cache.Stats().Hits)
+	})
+	metrics.CounterFunc("agent_cache_misses_total", "Operations computed because the cache had no result.", func() float64 {
+		return float64(cache.Stats().Misses)
+	})
+	metrics.CounterFunc("agent_cache_evictions_total", "Results evicted from the cache.", func() float64 {
+		return float64(cache.Stats().Evictions)
+	})
+	metrics.GaugeFunc("agent_cache_results", "Results stored in the cache.", func() float64 {
+		return float64(cache.Stats().Size)
+	})
+	metrics.GaugeFunc("agent_outbox_results", "Results waiting in the outbox for delivery.", func() float64 {
+		return float64(outbox.Len())
+	})
+}
@@ -2,15 +2,169 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/dispatchpb"
 	"github.com/pliliya111/go_final_sprint/internal/handler"
 	"github.com/pliliya111/go_final_sprint/internal/middleware"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+func getEnvMS(key string, defaultValue int) time.Duration {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 1 {
+		value = defaultValue
+	}
+	return time.Duration(value) * time.Millisecond
+}
+
+// expireExpressions периодически переводит просроченные выражения в статус timed_out.
+func expireExpressions(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := database.ExpireExpressions(ctx, db)
+		if err != nil {
+			log.Printf("Failed to expire expressions: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("%d expressions timed out", expired)
+		}
+	}
+}
+
+// markDeadAgents периодически помечает мёртвыми агентов без heartbeat
+// и освобождает их аренды.
+func markDeadAgents(ctx context.Context, deadAfter time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		dead, err := handler.MarkDeadAgents(ctx, deadAfter)
+		if err != nil {
+			log.Printf("Failed to mark dead agents: %v", err)
+			continue
+		}
+		if dead > 0 {
+			log.Printf("%d agents marked as dead, their leases released", dead)
+		}
+	}
+}
+
+// runSchedules периодически создаёт выражения по расписаниям пользователей.
+func runSchedules(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		created, err := handler.RunDueSchedules(ctx)
+		if err != nil {
+			log.Printf("Failed to run schedules: %v", err)
+		}
+		if created > 0 {
+			log.Printf("%d scheduled expressions created", created)
+		}
+	}
+}
+
+// admitExpressions периодически допускает к вычислению выражения,
+// ожидающие места в очереди задач.
+func admitExpressions(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		admitted, err := handler.AdmitWaitingExpressions(ctx)
+		if err != nil {
+			log.Printf("Failed to admit expressions: %v", err)
+		}
+		if admitted > 0 {
+			log.Printf("%d waiting expressions admitted", admitted)
+		}
+	}
+}
+
+// grpcTLSConfig собирает настройки TLS для gRPC из GRPC_TLS_CERT и
+// GRPC_TLS_KEY. Если задан GRPC_TLS_CLIENT_CA, агенты должны предъявить
+// сертификат, подписанный этим центром. Без сертификата возвращается nil,
+// и gRPC работает без TLS.
+func grpcTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY")
+	clientCA := os.Getenv("GRPC_TLS_CLIENT_CA")
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, fmt.Errorf("GRPC_TLS_CLIENT_CA requires GRPC_TLS_CERT and GRPC_TLS_KEY")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("GRPC_TLS_CERT and GRPC_TLS_KEY must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS client CA file %s contains no PEM certificates", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serveGRPC принимает потоки агентов по gRPC. Раздача задач общая с HTTP.
+func serveGRPC(addr string) {
+	tlsConfig, err := grpcTLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid gRPC TLS configuration: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC on %s: %v", addr, err)
+	}
+
+	var options []grpc.ServerOption
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	dispatchpb.RegisterDispatchServer(server, handler.NewDispatchService())
+	if tlsConfig != nil {
+		log.Printf("Serving gRPC agent streams with TLS on %s", addr)
+	} else {
+		log.Printf("Serving gRPC agent streams on %s", addr)
+	}
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("Failed to serve gRPC: %v", err)
+	}
+}
+
 func main() {
 	ctx := context.TODO()
 
@@ -20,7 +174,16 @@ func main() {
 	}
 	defer db.Close()
 
-	handler.SetDB(db)
+	handler.SetStore(handler.NewSQLStore(db))
+
+	// Очередь в памяти быстрее, но теряет задачи при перезапуске
+	// и подходит только для оркестратора из одного узла
+	if os.Getenv("TASK_QUEUE") == "memory" {
+		handler.SetTaskQueue(queue.NewMemoryQueue(queue.NewSQLStore(db)))
+		log.Printf("Using in-memory task queue")
+	} else {
+		handler.SetTaskQueue(queue.NewSQLiteQueue(db))
+	}
 
 	err = db.PingContext(ctx)
 	if err != nil {
@@ -30,6 +193,34 @@ func main() {
 	if err = database.CreateTables(ctx, db); err != nil {
 		log.Fatalf("Failed to create tables: %v", err)
 	}
+
+	admins, err := database.SetAdmins(ctx, db, middleware.AdminNames())
+	if err != nil {
+		log.Fatalf("Failed to set admins: %v", err)
+	}
+	log.Printf("%d admin users", admins)
+
+	if err = handler.LoadOperationTimings(ctx); err != nil {
+		log.Fatalf("Failed to load operation timings: %v", err)
+	}
+
+	// Исправляем состояние, оставшееся после аварийной остановки
+	summary, err := handler.Reconcile(ctx)
+	if err != nil {
+		log.Fatalf("Failed to reconcile state: %v", err)
+	}
+	log.Printf("Reconciliation finished: %s", summary)
+
+	go expireExpressions(ctx, db)
+	go markDeadAgents(ctx, getEnvMS("AGENT_DEAD_AFTER_MS", 15000))
+	go runSchedules(ctx)
+	go admitExpressions(ctx)
+
+	// Пустой GRPC_ADDR отключает gRPC, агенты работают только по HTTP
+	if addr := os.Getenv("GRPC_ADDR"); addr != "" {
+		go serveGRPC(addr)
+	}
+
 	r := gin.Default()
 
 	r.POST("/api/v1/register", handler.RegisterUser)
@@ -42,10 +233,35 @@ func main() {
 	auth.POST("/calculate", handler.AddExpression)
 	auth.GET("/expressions", handler.GetExpressions)
 	auth.GET("/expressions/:id", handler.GetExpressionByID)
+	auth.DELETE("/expressions/:id", handler.CancelExpression)
+	auth.GET("/queue", handler.GetQueue)
+
+	auth.POST("/schedules", handler.AddSchedule)
+	auth.GET("/schedules", handler.GetSchedules)
+	auth.GET("/schedules/:id", handler.GetSchedule)
+	auth.POST("/schedules/:id/pause", handler.PauseSchedule)
+	auth.POST("/schedules/:id/resume", handler.ResumeSchedule)
+	auth.DELETE("/schedules/:id", handler.DeleteSchedule)
+
+	auth.GET("/agents", middleware.AdminMiddleware(handler.IsAdmin), handler.GetAgents)
+
+	admin := auth.Group("/admin")
+	admin.Use(middleware.AdminMiddleware(handler.IsAdmin))
+	admin.PUT("/users/:id/weight", handler.SetUserWeight)
+	admin.GET("/users/:id/limits", handler.GetUserLimits)
+	admin.PUT("/users/:id/limits", handler.SetUserLimits)
+	admin.GET("/timings", handler.GetOperationTimings)
+	admin.PUT("/timings", handler.SetOperationTimings)
 
 	// Остальные маршруты
 	r.GET("/internal/task", handler.GetTask)
 	r.POST("/internal/task", handler.SubmitTaskResult)
+	r.POST("/internal/tasks/results", handler.SubmitTaskResults)
+	r.POST("/internal/task/fail", handler.FailTask)
+	r.POST("/internal/leases/:token/extend", handler.ExtendLease)
+	r.POST("/internal/leases/:token/release", handler.ReleaseLease)
+	r.POST("/internal/agents", handler.RegisterAgent)
+	r.POST("/internal/agents/:id/heartbeat", handler.AgentHeartbeat)
 
 	if err := r.Run(":8080"); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
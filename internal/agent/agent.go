@@ -2,69 +2,391 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pliliya111/go_final_sprint/internal/model"
 )
 
-var (
-	serverURL = "http://localhost:8080"
-)
+// Version — версия агента, сообщаемая оркестратору при регистрации.
+const Version = "1.1.0"
+
+var ErrAgentNotRegistered = errors.New("agent is not registered")
+
+// Transport — способ связи агента с оркестратором: опрос по HTTP (Client)
+// или поток gRPC (StreamClient).
+type Transport interface {
+	Register(ctx context.Context, info model.Agent) (time.Duration, error)
+	Heartbeat(ctx context.Context, agentID string) error
+	FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) (*model.Lease, error)
+	SubmitTaskResults(ctx context.Context, results []model.TaskResult) error
+	FailTask(ctx context.Context, agentID, taskID, leaseToken string, reason error) error
+	ReleaseTasks(ctx context.Context, leaseToken string, taskIDs []string) error
+	// Cancelled сообщает, что оркестратор отменил задачу и вычислять её не нужно.
+	Cancelled(taskID string) bool
+	Close() error
+}
+
+// NewTransport выбирает транспорт по настройкам: gRPC, если задан адрес
+// GRPCAddr, иначе HTTP.
+func NewTransport(cfg *Config) (Transport, error) {
+	if cfg.GRPCAddr != "" {
+		return NewStreamClient(cfg)
+	}
+	return NewClient(cfg)
+}
+
+// Client — HTTP-клиент оркестратора. Если текущий адрес оркестратора
+// недоступен, запрос повторяется по следующим адресам из настроек.
+type Client struct {
+	urls    []string
+	http    *http.Client
+	timeout time.Duration
+	breaker *CircuitBreaker
+
+	mu      sync.Mutex
+	current int // индекс адреса, который ответил последним
+}
+
+// NewClient создаёт клиент оркестратора по проверенным настройкам агента.
+func NewClient(cfg *Config) (*Client, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	urls := make([]string, len(cfg.OrchestratorURLs))
+	for i, u := range cfg.OrchestratorURLs {
+		urls[i] = strings.TrimRight(u, "/")
+	}
+
+	return &Client{
+		urls:    urls,
+		http:    &http.Client{Transport: transport},
+		timeout: cfg.RequestTimeout,
+		breaker: NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}, nil
+}
+
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS CA file %s contains no PEM certificates", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// do отправляет запрос оркестратору через CircuitBreaker: пока оркестратор
+// недоступен, запросы всех воркеров ждут окончания паузы. Неудачей считаются
+// только ошибки соединения и ответы 502, 503 и 504 — остальные ошибки сервера
+// относятся к конкретному запросу, а не к доступности оркестратора.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, extra time.Duration) (int, []byte, error) {
+	if err := c.breaker.Wait(ctx); err != nil {
+		return 0, nil, err
+	}
+
+	status, respBody, err := c.roundTrip(ctx, method, path, body, extra)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.breaker.Failure()
+		}
+		return 0, nil, err
+	}
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		c.breaker.Failure()
+	default:
+		c.breaker.Success()
+	}
+	return status, respBody, nil
+}
+
+// roundTrip отправляет запрос оркестратору и возвращает статус и тело ответа.
+// extra добавляется к таймауту запроса (для долгого опроса). Если адрес
+// недоступен, запрос повторяется по остальным адресам по кругу.
+func (c *Client) roundTrip(ctx context.Context, method, path string, body []byte, extra time.Duration) (int, []byte, error) {
+	c.mu.Lock()
+	start := c.current
+	c.mu.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(c.urls); i++ {
+		index := (start + i) % len(c.urls)
+		status, respBody, err := c.send(ctx, c.urls[index]+path, method, body, extra)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return 0, nil, err
+			}
+			if len(c.urls) > 1 {
+				log.Printf("Orchestrator %s is unavailable: %v", c.urls[index], err)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		c.current = index
+		c.mu.Unlock()
+		return status, respBody, nil
+	}
+	return 0, nil, lastErr
+}
+
+func (c *Client) send(ctx context.Context, url, method string, body []byte, extra time.Duration) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout+extra)
+	defer cancel()
 
-func FetchTask() (*model.Task, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/internal/task", serverURL))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("error fetching task: %v", err)
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// FetchTasks запрашивает до max задач под одну аренду, ожидая их появления
+// на стороне оркестратора не дольше wait. Если задач нет, возвращается nil.
+func (c *Client) FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) (*model.Lease, error) {
+	query := url.Values{}
+	query.Set("agent_id", agentID)
+	query.Set("max", strconv.Itoa(max))
+	query.Set("wait", wait.String())
+
+	status, body, err := c.do(ctx, http.MethodGet, "/internal/task?"+query.Encode(), nil, wait)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching tasks: %v", err)
+	}
+
+	if status == http.StatusNotFound {
 		return nil, nil
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch task: %s", resp.Status)
+	if status != http.StatusOK {
+		return nil, &StatusError{Op: "fetch tasks", Status: status}
+	}
+
+	var response struct {
+		Lease struct {
+			Token     string `json:"token"`
+			ExpiresAt int64  `json:"expires_at"`
+		} `json:"lease"`
+		Tasks []*model.Task `json:"tasks"`
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("error decoding tasks: %v", err)
+	}
+
+	return &model.Lease{
+		Token:     response.Lease.Token,
+		ExpiresAt: response.Lease.ExpiresAt,
+		Tasks:     response.Tasks,
+	}, nil
+}
+
+// SubmitTaskResults отправляет результаты нескольких задач одним запросом.
+func (c *Client) SubmitTaskResults(ctx context.Context, results []model.TaskResult) error {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"results": results,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return fmt.Errorf("error marshaling results: %v", err)
 	}
-	log.Printf("Response body: %s", string(body))
 
-	var response struct {
-		Task model.Task `json:"task"`
+	status, body, err := c.do(ctx, http.MethodPost, "/internal/tasks/results", requestBody, 0)
+	if err != nil {
+		return fmt.Errorf("error submitting results: %v", err)
+	}
+
+	if status != http.StatusOK {
+		return &StatusError{Op: "submit results", Status: status}
 	}
 
+	var response struct {
+		Rejected []struct {
+			ID    string `json:"id"`
+			Error string `json:"error"`
+		} `json:"rejected"`
+	}
 	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("error decoding task: %v", err)
+		return fmt.Errorf("error decoding submit response: %v", err)
+	}
+
+	// Отклонённые результаты повторять бессмысленно, только сообщаем о них
+	for _, rejected := range response.Rejected {
+		log.Printf("Result for task %s rejected by orchestrator: %s", rejected.ID, rejected.Error)
 	}
 
-	return &response.Task, nil
+	return nil
 }
 
-func SubmitTaskResult(taskID string, result interface{}) error {
+// FailTask сообщает оркестратору, что задачу невозможно вычислить
+// (например, из-за деления на ноль).
+func (c *Client) FailTask(ctx context.Context, agentID, taskID, leaseToken string, reason error) error {
 	requestBody, err := json.Marshal(map[string]interface{}{
-		"id":     taskID,
-		"result": result,
+		"id":          taskID,
+		"lease_token": leaseToken,
+		"agent_id":    agentID,
+		"error":       reason.Error(),
 	})
 	if err != nil {
-		return fmt.Errorf("error marshaling result: %v", err)
+		return fmt.Errorf("error marshaling task failure: %v", err)
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/internal/task", serverURL), "application/json", bytes.NewBuffer(requestBody))
+	status, _, err := c.do(ctx, http.MethodPost, "/internal/task/fail", requestBody, 0)
 	if err != nil {
-		return fmt.Errorf("error submitting result: %v", err)
+		return fmt.Errorf("error reporting task failure: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to submit result: %s", resp.Status)
+	if status != http.StatusOK {
+		return &StatusError{Op: "report task failure", Status: status}
+	}
+
+	return nil
+}
+
+// ReleaseTasks возвращает в очередь задачи аренды, которые агент не будет
+// вычислять, чтобы оркестратор сразу выдал их другим агентам.
+func (c *Client) ReleaseTasks(ctx context.Context, leaseToken string, taskIDs []string) error {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"task_ids": taskIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling released tasks: %v", err)
+	}
+
+	status, _, err := c.do(ctx, http.MethodPost, "/internal/leases/"+url.PathEscape(leaseToken)+"/release", requestBody, 0)
+	if err != nil {
+		return fmt.Errorf("error releasing tasks: %v", err)
+	}
+
+	// Аренда уже истекла или освобождена — задачи и так вернулись в очередь
+	if status == http.StatusNotFound {
+		return nil
+	}
+
+	if status != http.StatusOK {
+		return &StatusError{Op: "release tasks", Status: status}
 	}
 
 	return nil
 }
+
+// Register регистрирует агента у оркестратора и возвращает интервал,
+// с которым нужно присылать heartbeat.
+func (c *Client) Register(ctx context.Context, info model.Agent) (time.Duration, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"id":          info.ID,
+		"hostname":    info.Hostname,
+		"workers":     info.Workers,
+		"version":     info.Version,
+		"operations":  info.Operations,
+		"throughput":  info.Throughput,
+		"bench_score": info.BenchScore,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling agent info: %v", err)
+	}
+
+	status, body, err := c.do(ctx, http.MethodPost, "/internal/agents", requestBody, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error registering agent: %v", err)
+	}
+
+	if status != http.StatusOK {
+		return 0, &StatusError{Op: "register agent", Status: status}
+	}
+
+	var response struct {
+		HeartbeatIntervalMS int `json:"heartbeat_interval_ms"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, fmt.Errorf("error decoding registration response: %v", err)
+	}
+
+	return time.Duration(response.HeartbeatIntervalMS) * time.Millisecond, nil
+}
+
+// Heartbeat сообщает оркестратору, что агент жив. Если оркестратор не знает
+// агента (например, после перезапуска), возвращается ErrAgentNotRegistered.
+// Heartbeat идёт в обход CircuitBreaker: иначе во время паузы агент
+// перестал бы подавать признаки жизни и оркестратор забрал бы его задачи.
+func (c *Client) Heartbeat(ctx context.Context, agentID string) error {
+	status, _, err := c.roundTrip(ctx, http.MethodPost, "/internal/agents/"+url.PathEscape(agentID)+"/heartbeat", nil, 0)
+	if err != nil {
+		return fmt.Errorf("error sending heartbeat: %v", err)
+	}
+
+	if status == http.StatusNotFound {
+		return ErrAgentNotRegistered
+	}
+
+	if status != http.StatusOK {
+		return &StatusError{Op: "send heartbeat", Status: status}
+	}
+
+	return nil
+}
+
+// Cancelled всегда возвращает false: по HTTP оркестратор не сообщает агенту
+// об отменённых задачах, их результаты просто отклоняются.
+func (c *Client) Cancelled(taskID string) bool {
+	return false
+}
+
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// statusText форматирует код ответа так же, как http.Response.Status.
+func statusText(status int) string {
+	return fmt.Sprintf("%d %s", status, http.StatusText(status))
+}
@@ -0,0 +1,562 @@
+package agent
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// TLSConfig — настройки TLS для соединения с оркестратором по https.
+type TLSConfig struct {
+	CAFile             string // сертификат центра, которым подписан сертификат оркестратора
+	CertFile           string // клиентский сертификат, если оркестратор проверяет агентов
+	KeyFile            string
+	InsecureSkipVerify bool // не проверять сертификат оркестратора (только для отладки)
+}
+
+// Config — настройки агента. Значения берутся по возрастанию приоритета:
+// значения по умолчанию, конфигурационный файл, переменные окружения, флаги.
+type Config struct {
+	// Адреса оркестратора; если первый недоступен, агент переключается на следующий.
+	OrchestratorURLs []string
+	// Адрес gRPC оркестратора (grpc://host:port или grpcs://host:port). Если
+	// задан, агент получает задачи по одному потоку gRPC вместо опроса по HTTP.
+	GRPCAddr   string
+	AgentID    string // пустой — агент сгенерирует случайный ID
+	Workers    int
+	BatchSize  int
+	Operations []string           // пустой список — все операции
+	Throughput map[string]float64 // операций в секунду
+	// Сколько оркестратор держит запрос задач открытым, если готовых задач нет.
+	PollWait time.Duration
+	// Сколько ждать ответа оркестратора (без учёта PollWait).
+	RequestTimeout time.Duration
+	// Сколько после сигнала остановки агент доделывает полученные задачи;
+	// не доделанные за это время задачи возвращаются оркестратору.
+	ShutdownGrace time.Duration
+	// Первая и наибольшая пауза перед повтором неудачного запроса.
+	RetryInitial time.Duration
+	RetryMax     time.Duration
+	// После стольких неудачных запросов подряд все воркеры ждут BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Файл журнала неотправленных результатов; у каждого агента должен быть свой.
+	OutboxPath string
+	// Сколько результатов операций хранит кэш агента; 0 — кэш отключён.
+	CacheSize int
+	// Адрес HTTP-сервера с /healthz, /readyz, /metrics и /status; пустой
+	// (в настройках — "off") — сервер выключен.
+	StatusAddr string
+	TLS        TLSConfig
+}
+
+// Максимальный размер пачки задач, который принимает оркестратор.
+const maxBatchSize = 100
+
+func DefaultConfig() *Config {
+	return &Config{
+		OrchestratorURLs: []string{"http://localhost:8080"},
+		Workers:          1,
+		BatchSize:        1,
+		Throughput:       map[string]float64{},
+		PollWait:         30 * time.Second,
+		RequestTimeout:   10 * time.Second,
+		ShutdownGrace:    30 * time.Second,
+		RetryInitial:     500 * time.Millisecond,
+		RetryMax:         30 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  10 * time.Second,
+		OutboxPath:       "agent-outbox.jsonl",
+		CacheSize:        1024,
+		StatusAddr:       ":8888",
+	}
+}
+
+// fileConfig — конфигурационный файл агента в формате YAML или TOML.
+type fileConfig struct {
+	OrchestratorURLs []string           `yaml:"orchestrator_urls" toml:"orchestrator_urls"`
+	GRPC             string             `yaml:"grpc" toml:"grpc"`
+	AgentID          string             `yaml:"agent_id" toml:"agent_id"`
+	Workers          *int               `yaml:"workers" toml:"workers"`
+	BatchSize        *int               `yaml:"batch_size" toml:"batch_size"`
+	Operations       []string           `yaml:"operations" toml:"operations"`
+	Throughput       map[string]float64 `yaml:"throughput" toml:"throughput"`
+	PollWait         string             `yaml:"poll_wait" toml:"poll_wait"`
+	RequestTimeout   string             `yaml:"request_timeout" toml:"request_timeout"`
+	ShutdownGrace    string             `yaml:"shutdown_grace" toml:"shutdown_grace"`
+	RetryInitial     string             `yaml:"retry_initial" toml:"retry_initial"`
+	RetryMax         string             `yaml:"retry_max" toml:"retry_max"`
+	BreakerThreshold *int               `yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldown  string             `yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+	Outbox           string             `yaml:"outbox" toml:"outbox"`
+	CacheSize        *int               `yaml:"cache_size" toml:"cache_size"`
+	StatusAddr       string             `yaml:"status_addr" toml:"status_addr"`
+	TLS              struct {
+		CAFile             string `yaml:"ca_file" toml:"ca_file"`
+		CertFile           string `yaml:"cert_file" toml:"cert_file"`
+		KeyFile            string `yaml:"key_file" toml:"key_file"`
+		InsecureSkipVerify *bool  `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	} `yaml:"tls" toml:"tls"`
+}
+
+// Источник одного значения настроек: флаг, переменная окружения или поле файла.
+// Пустая строка означает, что значение в источнике не задано.
+type settings struct {
+	urls, grpc, agentID, workers, batchSize, operations, throughput string
+	pollWait, requestTimeout, shutdownGrace                         string
+	retryInitial, retryMax, breakerThreshold, breakerCooldown       string
+	outbox, cacheSize, statusAddr                                   string
+	tlsCA, tlsCert, tlsKey, tlsInsecure                             string
+}
+
+// LoadConfig собирает настройки агента из конфигурационного файла
+// (флаг -config или переменная AGENT_CONFIG), переменных окружения
+// и флагов args и проверяет их.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	var configPath string
+	var flags settings
+	fs.StringVar(&configPath, "config", "", "path to a YAML or TOML config file")
+	fs.StringVar(&flags.urls, "orchestrator", "", "comma-separated orchestrator URLs")
+	fs.StringVar(&flags.grpc, "grpc", "", "orchestrator gRPC address, e.g. grpc://localhost:9090")
+	fs.StringVar(&flags.agentID, "id", "", "agent ID")
+	fs.StringVar(&flags.workers, "workers", "", "number of workers")
+	fs.StringVar(&flags.batchSize, "batch-size", "", "tasks requested per lease")
+	fs.StringVar(&flags.operations, "operations", "", "comma-separated supported operations, e.g. +,-")
+	fs.StringVar(&flags.throughput, "throughput", "", "operations per second, e.g. /:10.5,*:20")
+	fs.StringVar(&flags.pollWait, "poll-wait", "", "long polling wait, e.g. 30s")
+	fs.StringVar(&flags.requestTimeout, "request-timeout", "", "orchestrator response timeout, e.g. 10s")
+	fs.StringVar(&flags.shutdownGrace, "shutdown-grace", "", "time to finish in-flight tasks after SIGTERM, e.g. 30s")
+	fs.StringVar(&flags.retryInitial, "retry-initial", "", "first pause before retrying a failed request, e.g. 500ms")
+	fs.StringVar(&flags.retryMax, "retry-max", "", "longest pause before retrying a failed request, e.g. 30s")
+	fs.StringVar(&flags.breakerThreshold, "breaker-threshold", "", "failed requests in a row that pause all workers")
+	fs.StringVar(&flags.breakerCooldown, "breaker-cooldown", "", "how long workers pause when the orchestrator is unavailable, e.g. 10s")
+	fs.StringVar(&flags.outbox, "outbox", "", "file for results not yet delivered to the orchestrator")
+	fs.StringVar(&flags.cacheSize, "cache-size", "", "number of operation results cached by the agent, 0 disables the cache")
+	fs.StringVar(&flags.statusAddr, "status-addr", "", "address of the health and metrics server, e.g. :8888, or off")
+	fs.StringVar(&flags.tlsCA, "tls-ca", "", "CA certificate file")
+	fs.StringVar(&flags.tlsCert, "tls-cert", "", "client certificate file")
+	fs.StringVar(&flags.tlsKey, "tls-key", "", "client key file")
+	fs.StringVar(&flags.tlsInsecure, "tls-insecure", "", "skip orchestrator certificate verification (true/false)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg := DefaultConfig()
+
+	if configPath == "" {
+		configPath = getenv("AGENT_CONFIG")
+	}
+	if configPath != "" {
+		if err := cfg.loadFile(configPath); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", configPath, err)
+		}
+	}
+
+	env := settings{
+		urls:             getenv("ORCHESTRATOR_URL"),
+		grpc:             getenv("ORCHESTRATOR_GRPC"),
+		agentID:          getenv("AGENT_ID"),
+		workers:          getenv("COMPUTING_POWER"),
+		batchSize:        getenv("TASK_BATCH_SIZE"),
+		operations:       getenv("AGENT_OPERATIONS"),
+		throughput:       getenv("AGENT_THROUGHPUT"),
+		pollWait:         getenv("AGENT_POLL_WAIT"),
+		requestTimeout:   getenv("AGENT_REQUEST_TIMEOUT"),
+		shutdownGrace:    getenv("AGENT_SHUTDOWN_GRACE"),
+		retryInitial:     getenv("AGENT_RETRY_INITIAL"),
+		retryMax:         getenv("AGENT_RETRY_MAX"),
+		breakerThreshold: getenv("AGENT_BREAKER_THRESHOLD"),
+		breakerCooldown:  getenv("AGENT_BREAKER_COOLDOWN"),
+		outbox:           getenv("AGENT_OUTBOX"),
+		cacheSize:        getenv("AGENT_CACHE_SIZE"),
+		statusAddr:       getenv("AGENT_STATUS_ADDR"),
+		tlsCA:            getenv("AGENT_TLS_CA"),
+		tlsCert:          getenv("AGENT_TLS_CERT"),
+		tlsKey:           getenv("AGENT_TLS_KEY"),
+		tlsInsecure:      getenv("AGENT_TLS_INSECURE"),
+	}
+	if err := cfg.apply(env, envNames); err != nil {
+		return nil, err
+	}
+	if err := cfg.apply(flags, flagNames); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Имена настроек в сообщениях об ошибках.
+var (
+	envNames = settings{
+		urls:             "ORCHESTRATOR_URL",
+		grpc:             "ORCHESTRATOR_GRPC",
+		agentID:          "AGENT_ID",
+		workers:          "COMPUTING_POWER",
+		batchSize:        "TASK_BATCH_SIZE",
+		operations:       "AGENT_OPERATIONS",
+		throughput:       "AGENT_THROUGHPUT",
+		pollWait:         "AGENT_POLL_WAIT",
+		requestTimeout:   "AGENT_REQUEST_TIMEOUT",
+		shutdownGrace:    "AGENT_SHUTDOWN_GRACE",
+		retryInitial:     "AGENT_RETRY_INITIAL",
+		retryMax:         "AGENT_RETRY_MAX",
+		breakerThreshold: "AGENT_BREAKER_THRESHOLD",
+		breakerCooldown:  "AGENT_BREAKER_COOLDOWN",
+		outbox:           "AGENT_OUTBOX",
+		cacheSize:        "AGENT_CACHE_SIZE",
+		statusAddr:       "AGENT_STATUS_ADDR",
+		tlsCA:            "AGENT_TLS_CA",
+		tlsCert:          "AGENT_TLS_CERT",
+		tlsKey:           "AGENT_TLS_KEY",
+		tlsInsecure:      "AGENT_TLS_INSECURE",
+	}
+	flagNames = settings{
+		urls:             "-orchestrator",
+		grpc:             "-grpc",
+		agentID:          "-id",
+		workers:          "-workers",
+		batchSize:        "-batch-size",
+		operations:       "-operations",
+		throughput:       "-throughput",
+		pollWait:         "-poll-wait",
+		requestTimeout:   "-request-timeout",
+		shutdownGrace:    "-shutdown-grace",
+		retryInitial:     "-retry-initial",
+		retryMax:         "-retry-max",
+		breakerThreshold: "-breaker-threshold",
+		breakerCooldown:  "-breaker-cooldown",
+		outbox:           "-outbox",
+		cacheSize:        "-cache-size",
+		statusAddr:       "-status-addr",
+		tlsCA:            "-tls-ca",
+		tlsCert:          "-tls-cert",
+		tlsKey:           "-tls-key",
+		tlsInsecure:      "-tls-insecure",
+	}
+)
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file fileConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	default:
+		return errors.New("unknown format, use .yaml, .yml or .toml")
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(file.OrchestratorURLs) > 0 {
+		c.OrchestratorURLs = file.OrchestratorURLs
+	}
+	if file.GRPC != "" {
+		c.GRPCAddr = file.GRPC
+	}
+	if file.AgentID != "" {
+		c.AgentID = file.AgentID
+	}
+	if file.Workers != nil {
+		c.Workers = *file.Workers
+	}
+	if file.BatchSize != nil {
+		c.BatchSize = *file.BatchSize
+	}
+	if file.Operations != nil {
+		c.Operations = file.Operations
+	}
+	if file.Throughput != nil {
+		c.Throughput = file.Throughput
+	}
+	if file.Outbox != "" {
+		c.OutboxPath = file.Outbox
+	}
+	if file.CacheSize != nil {
+		c.CacheSize = *file.CacheSize
+	}
+	if file.StatusAddr != "" {
+		c.StatusAddr = file.StatusAddr
+	}
+	if file.BreakerThreshold != nil {
+		c.BreakerThreshold = *file.BreakerThreshold
+	}
+	if file.TLS.InsecureSkipVerify != nil {
+		c.TLS.InsecureSkipVerify = *file.TLS.InsecureSkipVerify
+	}
+
+	return c.apply(settings{
+		pollWait:        file.PollWait,
+		requestTimeout:  file.RequestTimeout,
+		shutdownGrace:   file.ShutdownGrace,
+		retryInitial:    file.RetryInitial,
+		retryMax:        file.RetryMax,
+		breakerCooldown: file.BreakerCooldown,
+		tlsCA:           file.TLS.CAFile,
+		tlsCert:         file.TLS.CertFile,
+		tlsKey:          file.TLS.KeyFile,
+	}, settings{
+		pollWait: "poll_wait", requestTimeout: "request_timeout", shutdownGrace: "shutdown_grace",
+		retryInitial: "retry_initial", retryMax: "retry_max", breakerCooldown: "breaker_cooldown",
+		tlsCA: "tls.ca_file", tlsCert: "tls.cert_file", tlsKey: "tls.key_file",
+	})
+}
+
+// apply переносит в настройки заданные значения s; names — их имена для ошибок.
+func (c *Config) apply(s, names settings) error {
+	if s.urls != "" {
+		c.OrchestratorURLs = splitList(s.urls)
+	}
+	if s.grpc != "" {
+		c.GRPCAddr = s.grpc
+	}
+	if s.agentID != "" {
+		c.AgentID = s.agentID
+	}
+	if s.workers != "" {
+		value, err := strconv.Atoi(s.workers)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", names.workers, s.workers)
+		}
+		c.Workers = value
+	}
+	if s.batchSize != "" {
+		value, err := strconv.Atoi(s.batchSize)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", names.batchSize, s.batchSize)
+		}
+		c.BatchSize = value
+	}
+	if s.operations != "" {
+		c.Operations = splitList(s.operations)
+	}
+	if s.throughput != "" {
+		throughput, err := parseThroughput(s.throughput)
+		if err != nil {
+			return fmt.Errorf("%s: %w", names.throughput, err)
+		}
+		c.Throughput = throughput
+	}
+	if s.pollWait != "" {
+		value, err := time.ParseDuration(s.pollWait)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s, got %q", names.pollWait, s.pollWait)
+		}
+		c.PollWait = value
+	}
+	if s.requestTimeout != "" {
+		value, err := time.ParseDuration(s.requestTimeout)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 10s, got %q", names.requestTimeout, s.requestTimeout)
+		}
+		c.RequestTimeout = value
+	}
+	if s.shutdownGrace != "" {
+		value, err := time.ParseDuration(s.shutdownGrace)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s, got %q", names.shutdownGrace, s.shutdownGrace)
+		}
+		c.ShutdownGrace = value
+	}
+	if s.retryInitial != "" {
+		value, err := time.ParseDuration(s.retryInitial)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 500ms, got %q", names.retryInitial, s.retryInitial)
+		}
+		c.RetryInitial = value
+	}
+	if s.retryMax != "" {
+		value, err := time.ParseDuration(s.retryMax)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s, got %q", names.retryMax, s.retryMax)
+		}
+		c.RetryMax = value
+	}
+	if s.breakerThreshold != "" {
+		value, err := strconv.Atoi(s.breakerThreshold)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", names.breakerThreshold, s.breakerThreshold)
+		}
+		c.BreakerThreshold = value
+	}
+	if s.breakerCooldown != "" {
+		value, err := time.ParseDuration(s.breakerCooldown)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 10s, got %q", names.breakerCooldown, s.breakerCooldown)
+		}
+		c.BreakerCooldown = value
+	}
+	if s.outbox != "" {
+		c.OutboxPath = s.outbox
+	}
+	if s.cacheSize != "" {
+		value, err := strconv.Atoi(s.cacheSize)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", names.cacheSize, s.cacheSize)
+		}
+		c.CacheSize = value
+	}
+	if s.statusAddr == "off" {
+		c.StatusAddr = ""
+	} else if s.statusAddr != "" {
+		c.StatusAddr = s.statusAddr
+	}
+	if s.tlsCA != "" {
+		c.TLS.CAFile = s.tlsCA
+	}
+	if s.tlsCert != "" {
+		c.TLS.CertFile = s.tlsCert
+	}
+	if s.tlsKey != "" {
+		c.TLS.KeyFile = s.tlsKey
+	}
+	if s.tlsInsecure != "" {
+		value, err := strconv.ParseBool(s.tlsInsecure)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", names.tlsInsecure, s.tlsInsecure)
+		}
+		c.TLS.InsecureSkipVerify = value
+	}
+	return nil
+}
+
+// Validate проверяет настройки и возвращает все найденные ошибки сразу.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if len(c.OrchestratorURLs) == 0 {
+		errs = append(errs, errors.New("at least one orchestrator URL is required"))
+	}
+	for _, raw := range c.OrchestratorURLs {
+		u, err := url.Parse(raw)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("orchestrator URL %q is invalid: %v", raw, err))
+		case u.Scheme != "http" && u.Scheme != "https":
+			errs = append(errs, fmt.Errorf("orchestrator URL %q must start with http:// or https://", raw))
+		case u.Host == "":
+			errs = append(errs, fmt.Errorf("orchestrator URL %q has no host", raw))
+		}
+	}
+
+	if c.GRPCAddr != "" {
+		u, err := url.Parse(c.GRPCAddr)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("orchestrator gRPC address %q is invalid: %v", c.GRPCAddr, err))
+		case u.Scheme != "grpc" && u.Scheme != "grpcs":
+			errs = append(errs, fmt.Errorf("orchestrator gRPC address %q must start with grpc:// or grpcs://", c.GRPCAddr))
+		case u.Host == "":
+			errs = append(errs, fmt.Errorf("orchestrator gRPC address %q has no host", c.GRPCAddr))
+		}
+	}
+
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be at least 1, got %d", c.Workers))
+	}
+	if c.BatchSize < 1 || c.BatchSize > maxBatchSize {
+		errs = append(errs, fmt.Errorf("batch size must be from 1 to %d, got %d", maxBatchSize, c.BatchSize))
+	}
+	for _, op := range c.Operations {
+		if op != "+" && op != "-" && op != "*" && op != "/" {
+			errs = append(errs, fmt.Errorf("unknown operation %q, supported: + - * /", op))
+		}
+	}
+	for op, value := range c.Throughput {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("throughput of operation %q must be positive", op))
+		}
+	}
+	// Без ожидания воркеры без задач опрашивали бы оркестратор без пауз
+	if c.PollWait <= 0 || c.PollWait > time.Minute {
+		errs = append(errs, fmt.Errorf("poll wait must be positive and at most 1m, got %s", c.PollWait))
+	}
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("request timeout must be positive, got %s", c.RequestTimeout))
+	}
+	if c.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("shutdown grace period must not be negative, got %s", c.ShutdownGrace))
+	}
+	if c.RetryInitial <= 0 || c.RetryMax < c.RetryInitial {
+		errs = append(errs, fmt.Errorf("retry intervals must be positive with initial not above max, got %s and %s",
+			c.RetryInitial, c.RetryMax))
+	}
+	if c.BreakerThreshold < 1 {
+		errs = append(errs, fmt.Errorf("breaker threshold must be at least 1, got %d", c.BreakerThreshold))
+	}
+	if c.BreakerCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("breaker cooldown must be positive, got %s", c.BreakerCooldown))
+	}
+	if c.OutboxPath == "" {
+		errs = append(errs, errors.New("outbox path must not be empty"))
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("cache size must not be negative, got %d", c.CacheSize))
+	}
+	if c.StatusAddr != "" {
+		if _, _, err := net.SplitHostPort(c.StatusAddr); err != nil {
+			errs = append(errs, fmt.Errorf("status server address %q must be host:port: %v", c.StatusAddr, err))
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("TLS client certificate and key must be set together"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// RetryPolicy возвращает политику повторов запросов к оркестратору.
+func (c *Config) RetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.InitialInterval = c.RetryInitial
+	policy.MaxInterval = c.RetryMax
+	return policy
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseThroughput разбирает производительность агента по операциям
+// в формате "/:10.5,*:20" (операций в секунду).
+func parseThroughput(value string) (map[string]float64, error) {
+	throughput := make(map[string]float64)
+	for _, item := range splitList(value) {
+		op, valueStr, found := strings.Cut(item, ":")
+		opsPerSecond, err := strconv.ParseFloat(strings.TrimSpace(valueStr), 64)
+		if !found || err != nil {
+			return nil, fmt.Errorf("invalid item %q, expected operation:ops_per_second", item)
+		}
+		throughput[strings.TrimSpace(op)] = opsPerSecond
+	}
+	return throughput, nil
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envFunc(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "agent.yaml")
+	err := os.WriteFile(yamlPath, []byte(`
+orchestrator_urls: ["http://file:8080"]
+agent_id: from-file
+workers: 2
+batch_size: 5
+operations: ["*", "/"]
+poll_wait: 20s
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"AGENT_CONFIG":     yamlPath,
+		"ORCHESTRATOR_URL": "http://env-1:8080, http://env-2:8080",
+		"COMPUTING_POWER":  "3",
+	}
+	cfg, err := LoadConfig([]string{"-workers", "4"}, envFunc(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cfg.OrchestratorURLs) != 2 || cfg.OrchestratorURLs[1] != "http://env-2:8080" {
+		t.Errorf("expected URLs from env, got %v", cfg.OrchestratorURLs)
+	}
+	if cfg.AgentID != "from-file" || cfg.BatchSize != 5 || cfg.PollWait != 20*time.Second {
+		t.Errorf("expected values from file, got %+v", cfg)
+	}
+	if cfg.Workers != 4 {
+		t.Errorf("expected workers from flag, got %d", cfg.Workers)
+	}
+	if cfg.RequestTimeout != 10*time.Second {
+		t.Errorf("expected default request timeout, got %s", cfg.RequestTimeout)
+	}
+
+	tomlPath := filepath.Join(dir, "agent.toml")
+	err = os.WriteFile(tomlPath, []byte(`
+orchestrator_urls = ["https://file:8443"]
+request_timeout = "5s"
+
+[throughput]
+"+" = 12.5
+
+[tls]
+insecure_skip_verify = true
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadConfig([]string{"-config", tomlPath}, envFunc(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.OrchestratorURLs[0] != "https://file:8443" || cfg.RequestTimeout != 5*time.Second ||
+		cfg.Throughput["+"] != 12.5 || !cfg.TLS.InsecureSkipVerify {
+		t.Errorf("expected values from TOML file, got %+v", cfg)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{"not a number", nil, map[string]string{"COMPUTING_POWER": "four"}, []string{"COMPUTING_POWER must be a number"}},
+		{"bad duration", []string{"-poll-wait", "30"}, nil, []string{"-poll-wait must be a duration"}},
+		{"zero poll wait", nil, map[string]string{"AGENT_POLL_WAIT": "0s"}, []string{"poll wait must be positive"}},
+		{"negative grace", nil, map[string]string{"AGENT_SHUTDOWN_GRACE": "-1s"}, []string{"shutdown grace period must not be negative"}},
+		{"bad throughput", nil, map[string]string{"AGENT_THROUGHPUT": "+10"}, []string{"AGENT_THROUGHPUT: invalid item"}},
+		{"bad grpc address", nil, map[string]string{"ORCHESTRATOR_GRPC": "http://localhost:9090"}, []string{"must start with grpc:// or grpcs://"}},
+		{"missing config file", []string{"-config", "missing.yaml"}, nil, []string{"config file missing.yaml"}},
+		{
+			"all errors at once",
+			[]string{"-orchestrator", "localhost:8080,http://", "-workers", "0", "-batch-size", "500", "-operations", "^", "-tls-cert", "cert.pem"},
+			nil,
+			[]string{
+				`"localhost:8080" must start with http:// or https://`,
+				`"http://" has no host`,
+				"workers must be at least 1",
+				"batch size must be from 1 to 100",
+				`unknown operation "^"`,
+				"certificate and key must be set together",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(tt.args, envFunc(tt.env))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to contain %q, got %q", want, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Границы корзин гистограммы времени вычисления задачи, в секундах.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics собирает показатели агента для /metrics и /status: сколько задач
+// вычислено по операциям, ошибки, время вычисления и что делает каждый воркер.
+type Metrics struct {
+	mu         sync.Mutex
+	processed  map[string]uint64 // по операции
+	failed     map[string]uint64 // задачи, которые невозможно вычислить, по операции
+	errors     map[string]uint64 // ошибки связи с оркестратором по виду запроса
+	durations  map[string]*histogram
+	workers    []WorkerStatus
+	registered bool
+	up         bool
+	lastError  string
+
+	funcs []funcMetric
+}
+
+// WorkerStatus — состояние воркера для /status.
+type WorkerStatus struct {
+	ID   int         `json:"id"`
+	Busy bool        `json:"busy"`
+	Task *TaskStatus `json:"task,omitempty"`
+}
+
+// TaskStatus — задача, которую сейчас вычисляет воркер. Токена аренды здесь
+// нет: /status открыт без авторизации, а по токену можно сдать результат.
+type TaskStatus struct {
+	ID           string      `json:"id"`
+	ExpressionID string      `json:"expression_id"`
+	Operation    string      `json:"operation"`
+	Arg1         interface{} `json:"arg1"`
+	Arg2         interface{} `json:"arg2"`
+	StartedAt    int64       `json:"started_at"` // unix ms
+}
+
+type histogram struct {
+	counts []uint64 // по корзинам durationBuckets, без накопления
+	count  uint64
+	sum    float64
+}
+
+// funcMetric — показатель, значение которого берётся при каждом запросе /metrics.
+type funcMetric struct {
+	name, help, kind string
+	value            func() float64
+}
+
+func NewMetrics(workers int) *Metrics {
+	m := &Metrics{
+		processed: make(map[string]uint64),
+		failed:    make(map[string]uint64),
+		errors:    make(map[string]uint64),
+		durations: make(map[string]*histogram),
+		workers:   make([]WorkerStatus, workers),
+	}
+	for i := range m.workers {
+		m.workers[i].ID = i
+	}
+	return m
+}
+
+// GaugeFunc добавляет показатель типа gauge, значение которого возвращает fn.
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.funcs = append(m.funcs, funcMetric{name: name, help: help, kind: "gauge", value: fn})
+}
+
+// CounterFunc добавляет показатель типа counter, значение которого возвращает fn.
+func (m *Metrics) CounterFunc(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.funcs = append(m.funcs, funcMetric{name: name, help: help, kind: "counter", value: fn})
+}
+
+// StartTask отмечает, что воркер начал вычислять задачу.
+func (m *Metrics) StartTask(worker int, task *model.Task) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers[worker].Busy = true
+	m.workers[worker].Task = &TaskStatus{
+		ID:           task.ID,
+		ExpressionID: task.ExpressionId,
+		Operation:    task.Operation,
+		Arg1:         task.Arg1,
+		Arg2:         task.Arg2,
+		StartedAt:    time.Now().UnixMilli(),
+	}
+}
+
+// StopTask отмечает, что воркер бросил задачу, не вычислив её.
+func (m *Metrics) StopTask(worker int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers[worker] = WorkerStatus{ID: worker}
+}
+
+// FinishTask отмечает, что воркер вычислил задачу за d; err — ошибка
+// вычисления (например, деление на ноль).
+func (m *Metrics) FinishTask(worker int, operation string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers[worker] = WorkerStatus{ID: worker}
+
+	if err != nil {
+		m.failed[operation]++
+	} else {
+		m.processed[operation]++
+	}
+
+	h := m.durations[operation]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[operation] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Error учитывает неудачный запрос к оркестратору вида kind.
+func (m *Metrics) Error(kind string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[kind]++
+	m.lastError = fmt.Sprintf("%s: %v", kind, err)
+}
+
+// SetRegistered отмечает, что агент зарегистрирован у оркестратора.
+func (m *Metrics) SetRegistered() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.registered = true
+	m.up = true
+}
+
+// SetOrchestratorUp запоминает, ответил ли оркестратор на последний запрос.
+func (m *Metrics) SetOrchestratorUp(up bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.up = up
+}
+
+// Ready сообщает, готов ли агент получать задачи: он зарегистрирован и
+// оркестратор отвечает. Если не готов, возвращает причину.
+func (m *Metrics) Ready() (bool, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !m.registered:
+		return false, "agent is not registered"
+	case !m.up:
+		return false, "orchestrator is unreachable: " + m.lastError
+	}
+	return true, ""
+}
+
+// Workers возвращает состояние воркеров.
+func (m *Metrics) Workers() []WorkerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	workers := make([]WorkerStatus, len(m.workers))
+	for i, w := range m.workers {
+		workers[i] = w
+		if w.Task != nil {
+			task := *w.Task
+			workers[i].Task = &task
+		}
+	}
+	return workers
+}
+
+// WritePrometheus записывает показатели в текстовом формате Prometheus.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	var b strings.Builder
+
+	writeHeader(&b, "agent_tasks_processed_total", "Tasks computed successfully, by operation.", "counter")
+	for _, op := range sortedKeys(m.processed) {
+		fmt.Fprintf(&b, "agent_tasks_processed_total{operation=%q} %d\n", op, m.processed[op])
+	}
+	writeHeader(&b, "agent_tasks_failed_total", "Tasks that could not be computed, by operation.", "counter")
+	for _, op := range sortedKeys(m.failed) {
+		fmt.Fprintf(&b, "agent_tasks_failed_total{operation=%q} %d\n", op, m.failed[op])
+	}
+	writeHeader(&b, "agent_errors_total", "Failed requests to the orchestrator, by request.", "counter")
+	for _, kind := range sortedKeys(m.errors) {
+		fmt.Fprintf(&b, "agent_errors_total{request=%q} %d\n", kind, m.errors[kind])
+	}
+
+	writeHeader(&b, "agent_task_duration_seconds", "Time spent computing a task, by operation.", "histogram")
+	for _, op := range sortedKeys(m.durations) {
+		h := m.durations[op]
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "agent_task_duration_seconds_bucket{operation=%q,le=%q} %d\n",
+				op, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "agent_task_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(&b, "agent_task_duration_seconds_sum{operation=%q} %s\n", op, formatValue(h.sum))
+		fmt.Fprintf(&b, "agent_task_duration_seconds_count{operation=%q} %d\n", op, h.count)
+	}
+
+	busy := 0
+	for _, worker := range m.workers {
+		if worker.Busy {
+			busy++
+		}
+	}
+	writeHeader(&b, "agent_workers", "Number of workers.", "gauge")
+	fmt.Fprintf(&b, "agent_workers %d\n", len(m.workers))
+	writeHeader(&b, "agent_workers_busy", "Workers computing a task right now.", "gauge")
+	fmt.Fprintf(&b, "agent_workers_busy %d\n", busy)
+
+	up := 0
+	if m.registered && m.up {
+		up = 1
+	}
+	writeHeader(&b, "agent_orchestrator_up", "Whether the last request to the orchestrator succeeded.", "gauge")
+	fmt.Fprintf(&b, "agent_orchestrator_up %d\n", up)
+
+	funcs := m.funcs
+	m.mu.Unlock()
+
+	// Значения функций берутся без блокировки: они читают чужие структуры
+	for _, f := range funcs {
+		writeHeader(&b, f.name, f.help, f.kind)
+		fmt.Fprintf(&b, "%s %s\n", f.name, formatValue(f.value()))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHeader(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
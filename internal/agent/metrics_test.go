@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics(2)
+	m.GaugeFunc("agent_outbox_results", "Results waiting in the outbox.", func() float64 { return 3 })
+
+	if ready, _ := m.Ready(); ready {
+		t.Error("agent must not be ready before registration")
+	}
+	m.SetRegistered()
+	if ready, reason := m.Ready(); !ready {
+		t.Errorf("registered agent is not ready: %s", reason)
+	}
+	m.Error("fetch", errors.New("connection refused"))
+	m.SetOrchestratorUp(false)
+	if ready, reason := m.Ready(); ready || !strings.Contains(reason, "connection refused") {
+		t.Errorf("got ready=%v reason=%q, want not ready with the last error", ready, reason)
+	}
+
+	m.StartTask(1, &model.Task{ID: "t1", Operation: "+", Arg1: 2.0, Arg2: 3.0, LeaseToken: "secret-lease"})
+	workers := m.Workers()
+	if workers[0].Busy || !workers[1].Busy || workers[1].Task.ID != "t1" {
+		t.Errorf("unexpected workers %+v", workers)
+	}
+	// /status открыт без авторизации, токен аренды в нём не показывается
+	status, err := json.Marshal(workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(status), "secret-lease") {
+		t.Errorf("worker status exposes the lease token: %s", status)
+	}
+	m.FinishTask(1, "+", 30*time.Millisecond, nil)
+	m.StartTask(0, &model.Task{ID: "t2", Operation: "/"})
+	m.FinishTask(0, "/", 2*time.Second, errors.New("division by zero"))
+	if workers := m.Workers(); workers[0].Busy || workers[1].Busy {
+		t.Errorf("workers must be idle, got %+v", workers)
+	}
+
+	var b strings.Builder
+	if err := m.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE agent_task_duration_seconds histogram",
+		`agent_tasks_processed_total{operation="+"} 1`,
+		`agent_tasks_failed_total{operation="/"} 1`,
+		`agent_errors_total{request="fetch"} 1`,
+		`agent_task_duration_seconds_bucket{operation="+",le="0.025"} 0`,
+		`agent_task_duration_seconds_bucket{operation="+",le="0.05"} 1`,
+		`agent_task_duration_seconds_bucket{operation="/",le="+Inf"} 1`,
+		`agent_task_duration_seconds_sum{operation="/"} 2`,
+		"agent_workers 2",
+		"agent_workers_busy 0",
+		"agent_orchestrator_up 0",
+		"agent_outbox_results 3",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Outbox — журнал на диске для результатов, которые не удалось отправить
+// оркестратору. Результаты дописываются в файл по одному JSON на строку
+// и отправляются в порядке записи, когда оркестратор снова доступен,
+// в том числе после перезапуска агента. Оркестратор подтверждает повторно
+// присланный результат по ID задачи и токену аренды, поэтому результат,
+// отправленный дважды (например, если агент остановился до очистки журнала),
+// не засчитывается второй раз.
+type Outbox struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []model.TaskResult
+
+	// Одновременно журнал отправляет только один Flush
+	flushMu sync.Mutex
+}
+
+// OpenOutbox открывает журнал path, создавая его при необходимости.
+// Повреждённые записи (например, недописанная при аварии последняя строка)
+// пропускаются.
+func OpenOutbox(path string) (*Outbox, error) {
+	pending, err := readOutbox(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox: %v", err)
+	}
+
+	o := &Outbox{path: path, pending: pending}
+	// Перезапись убирает повреждённые строки, чтобы новые записи
+	// не склеились с недописанной строкой
+	if err := o.rewrite(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func readOutbox(path string) ([]model.TaskResult, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var pending []model.TaskResult
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r model.TaskResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.ID == "" {
+			log.Printf("Skipping damaged outbox record at %s:%d", path, line)
+			continue
+		}
+		pending = append(pending, r)
+	}
+	return pending, scanner.Err()
+}
+
+// Append дописывает результаты в журнал и сбрасывает их на диск.
+func (o *Outbox) Append(results []model.TaskResult) error {
+	var data []byte
+	for _, r := range results {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("error marshaling result: %v", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.file.Write(data); err != nil {
+		return fmt.Errorf("error writing outbox: %v", err)
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing outbox: %v", err)
+	}
+	o.pending = append(o.pending, results...)
+	return nil
+}
+
+// Len возвращает число неотправленных результатов.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Flush отправляет результаты из журнала пачками в порядке записи
+// и удаляет отправленные. Останавливается на первой ошибке, которую
+// имеет смысл повторить; пачка, которую оркестратор отказался принять,
+// записывается в лог и удаляется. Возвращает число отправленных результатов.
+func (o *Outbox) Flush(ctx context.Context, send func(context.Context, []model.TaskResult) error) (int, error) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	sent := 0
+	for ctx.Err() == nil {
+		o.mu.Lock()
+		batch := append([]model.TaskResult(nil), o.pending[:min(len(o.pending), maxBatchSize)]...)
+		o.mu.Unlock()
+		if len(batch) == 0 {
+			return sent, nil
+		}
+
+		err := send(ctx, batch)
+		if err != nil && IsRetryable(err) {
+			return sent, err
+		}
+		if err != nil {
+			for _, r := range batch {
+				log.Printf("Orchestrator refused outbox result of task %s: %v (%v)", r.ID, r.Result, err)
+			}
+		} else {
+			sent += len(batch)
+		}
+
+		o.mu.Lock()
+		o.pending = o.pending[len(batch):]
+		err = o.rewrite()
+		o.mu.Unlock()
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, ctx.Err()
+}
+
+// rewrite заменяет файл журнала неотправленными результатами.
+// Вызывается под o.mu или до начала работы с журналом.
+func (o *Outbox) rewrite() error {
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating outbox: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, r := range o.pending {
+		if err := encoder.Encode(r); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error writing outbox: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing outbox: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing outbox: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing outbox: %v", err)
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return fmt.Errorf("error replacing outbox: %v", err)
+	}
+
+	file, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening outbox: %v", err)
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = file
+	return nil
+}
+
+// Close закрывает файл журнала; неотправленные результаты остаются в нём.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+
+	outbox, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	err = outbox.Append([]model.TaskResult{
+		{ID: "t1", Result: 1, LeaseToken: "l1"},
+		{ID: "t2", Result: 2, LeaseToken: "l1"},
+	})
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	outbox.Close()
+
+	// Недописанная при аварии строка пропускается
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id": "t3", "res`)
+	file.Close()
+
+	outbox, err = OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer outbox.Close()
+	if outbox.Len() != 2 {
+		t.Fatalf("expected 2 results after restart, got %d", outbox.Len())
+	}
+	if err := outbox.Append([]model.TaskResult{{ID: "t4", Result: 4, LeaseToken: "l2"}}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	var sent []string
+	n, err := outbox.Flush(context.Background(), func(ctx context.Context, batch []model.TaskResult) error {
+		for _, r := range batch {
+			sent = append(sent, r.ID)
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 results flushed, got %d (%v)", n, err)
+	}
+	if len(sent) != 3 || sent[0] != "t1" || sent[1] != "t2" || sent[2] != "t4" {
+		t.Errorf("expected results in append order, got %v", sent)
+	}
+
+	pending, err := readOutbox(path)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("expected empty outbox file, got %v (%v)", pending, err)
+	}
+}
+
+func TestOutboxFlushErrors(t *testing.T) {
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.jsonl"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer outbox.Close()
+
+	results := make([]model.TaskResult, maxBatchSize+1)
+	for i := range results {
+		results[i] = model.TaskResult{ID: "t", Result: float64(i), LeaseToken: "l"}
+	}
+	if err := outbox.Append(results); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	// Недоступный оркестратор: результаты остаются в журнале
+	unavailable := errors.New("connection refused")
+	n, err := outbox.Flush(context.Background(), func(ctx context.Context, batch []model.TaskResult) error {
+		return unavailable
+	})
+	if n != 0 || err != unavailable || outbox.Len() != len(results) {
+		t.Fatalf("expected results to stay in outbox, got %d sent, %d left (%v)", n, outbox.Len(), err)
+	}
+
+	// Отказ принять пачку не повторяется, следующая пачка отправляется
+	var batches []int
+	n, err = outbox.Flush(context.Background(), func(ctx context.Context, batch []model.TaskResult) error {
+		batches = append(batches, len(batch))
+		if len(batches) == 1 {
+			return &StatusError{Op: "submit results", Status: http.StatusBadRequest}
+		}
+		return nil
+	})
+	if err != nil || n != 1 || outbox.Len() != 0 {
+		t.Errorf("expected refused batch to be dropped, got %d sent, %d left (%v)", n, outbox.Len(), err)
+	}
+	if len(batches) != 2 || batches[0] != maxBatchSize || batches[1] != 1 {
+		t.Errorf("expected batches of %d and 1, got %v", maxBatchSize, batches)
+	}
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy — повтор запросов к оркестратору с экспоненциально растущей
+// паузой. Пауза случайно уменьшается на долю Jitter, чтобы агенты
+// не повторяли запросы одновременно.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64 // от 0 до 1
+	// Число попыток; 0 — повторять, пока не отменён контекст.
+	MaxAttempts int
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.5,
+	}
+}
+
+// Backoff возвращает паузу перед повтором после attempt неудачных попыток (attempt >= 1).
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	interval := float64(p.InitialInterval)
+	for i := 1; i < attempt && interval < float64(p.MaxInterval); i++ {
+		interval *= p.Multiplier
+	}
+	if interval > float64(p.MaxInterval) {
+		interval = float64(p.MaxInterval)
+	}
+	interval -= interval * p.Jitter * rand.Float64()
+	return time.Duration(interval)
+}
+
+// Do вызывает fn, пока она не завершится успешно, не вернёт ошибку, которую
+// бессмысленно повторять, или не закончатся попытки. Первая попытка делается
+// всегда; отмена ctx прерывает только ожидание перед повтором.
+// Возвращается последняя ошибка fn.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// StatusError — оркестратор ответил на запрос неуспешным кодом.
+type StatusError struct {
+	Op     string
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return "failed to " + e.Op + ": " + statusText(e.Status)
+}
+
+// IsRetryable сообщает, имеет ли смысл повторить запрос: повторяются ошибки
+// соединения и ответы 5xx и 429, но не отказы оркестратора принять запрос.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrAgentNotRegistered) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status >= http.StatusInternalServerError || statusErr.Status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// CircuitBreaker приостанавливает все запросы агента к оркестратору после
+// threshold неудач подряд на время cooldown. После паузы запросы снова
+// пропускаются: первый успешный возобновляет работу, первая неудача
+// начинает паузу заново.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Wait ждёт окончания паузы или отмены ctx.
+func (b *CircuitBreaker) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	wait := time.Until(b.openUntil)
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Success отмечает успешный запрос к оркестратору.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures >= b.threshold {
+		log.Printf("Orchestrator is available again, resuming requests")
+	}
+	b.failures = 0
+}
+
+// Failure отмечает неудачный запрос к оркестратору.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	// Запросы, начатые до паузы, не продлевают её
+	if b.failures >= b.threshold && !time.Now().Before(b.openUntil) {
+		log.Printf("Orchestrator is unavailable, pausing all requests for %s", b.cooldown)
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		Multiplier:      2,
+		Jitter:          0.5,
+	}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{10, time.Second},
+		{1000, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			d := policy.Backoff(tt.attempt)
+			if d > tt.max || d < tt.max/2 {
+				t.Errorf("attempt %d: expected backoff from %s to %s, got %s", tt.attempt, tt.max/2, tt.max, d)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 2}
+
+	calls := 0
+	err := policy.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &StatusError{Op: "submit results", Status: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success on the third call, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	rejected := &StatusError{Op: "submit results", Status: http.StatusBadRequest}
+	err = policy.Do(context.Background(), func() error {
+		calls++
+		return rejected
+	})
+	if err != rejected || calls != 1 {
+		t.Errorf("expected a rejected request not to be retried, got %v after %d calls", err, calls)
+	}
+
+	// Отмена контекста прерывает повторы, но не первую попытку
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	unavailable := errors.New("connection refused")
+	err = policy.Do(ctx, func() error {
+		calls++
+		return unavailable
+	})
+	if err != unavailable || calls != 1 {
+		t.Errorf("expected one attempt after cancellation, got %v after %d calls", err, calls)
+	}
+
+	policy.MaxAttempts = 4
+	calls = 0
+	policy.Do(context.Background(), func() error {
+		calls++
+		return unavailable
+	})
+	if calls != 4 {
+		t.Errorf("expected 4 attempts, got %d", calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, 50*time.Millisecond)
+
+	breaker.Failure()
+	if err := breaker.Wait(context.Background()); err != nil {
+		t.Fatalf("expected breaker to stay closed below threshold, got %v", err)
+	}
+
+	breaker.Failure()
+	start := time.Now()
+	if err := breaker.Wait(context.Background()); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("expected requests to pause while the breaker is open, waited %s", waited)
+	}
+
+	// После паузы первая же неудача снова останавливает запросы
+	breaker.Failure()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := breaker.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected breaker to reopen, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	breaker.Success()
+	breaker.Failure()
+	if err := breaker.Wait(ctx); err != nil {
+		t.Errorf("expected breaker to close after a success, got %v", err)
+	}
+}
+
+func TestClientBreakerStatuses(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	cfg := DefaultConfig()
+	cfg.OrchestratorURLs = []string{server.URL}
+	cfg.BreakerThreshold = 1
+	cfg.BreakerCooldown = time.Hour
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Ошибка сервера в ответ на конкретный запрос не останавливает воркеров
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := client.ReleaseTasks(ctx, "token", nil); err == nil {
+			t.Fatal("expected release to fail with status 500")
+		}
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if err := client.ReleaseTasks(ctx, "token", nil); err == nil {
+		t.Fatal("expected release to fail with status 503")
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	if err := client.ReleaseTasks(short, "token", nil); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("expected breaker to open after 503, got %v", err)
+	}
+
+	// Heartbeat доходит до оркестратора и при открытом CircuitBreaker
+	status.Store(http.StatusOK)
+	if err := client.Heartbeat(ctx, "a1"); err != nil {
+		t.Errorf("expected heartbeat to bypass the breaker, got %v", err)
+	}
+}
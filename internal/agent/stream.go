@@ -0,0 +1,504 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/dispatchpb"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// StreamClient связывается с оркестратором по одному двунаправленному потоку
+// gRPC: запросы задач, результаты и heartbeat идут по нему, а оркестратор
+// присылает аренды и отмены задач. Если поток разорвался, клиент открывает
+// новый при следующем запросе.
+type StreamClient struct {
+	conn    *grpc.ClientConn
+	client  dispatchpb.DispatchClient
+	timeout time.Duration
+	breaker *CircuitBreaker
+
+	// Полученные, но ещё не взятые воркерами аренды. После разрыва потока
+	// оркестратор освобождает его аренды, и результаты по ним отклоняются.
+	assignments chan *model.Lease
+
+	connectMu sync.Mutex // одно подключение за раз
+
+	mu        sync.Mutex
+	hello     *dispatchpb.Hello
+	session   *streamSession
+	nextID    uint64
+	waiting   int // воркеры, ждущие аренду в FetchTasks
+	requested int // запросы задач текущего потока без ответа
+	// Задачи полученных аренд, которые воркеры ещё не проверили через
+	// Cancelled; значение — отменил ли их оркестратор. Отмены других задач
+	// не запоминаются, поэтому карта не растёт.
+	received map[string]bool
+}
+
+// streamSession — один открытый поток к оркестратору.
+type streamSession struct {
+	stream dispatchpb.Dispatch_ConnectClient
+	cancel context.CancelFunc
+
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint64]chan *dispatchpb.Ack
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // причина разрыва, читается после закрытия done
+}
+
+// NewStreamClient создаёт gRPC-клиент оркестратора по проверенным настройкам
+// агента. Соединение устанавливается при регистрации.
+func NewStreamClient(cfg *Config) (*StreamClient, error) {
+	u, err := url.Parse(cfg.GRPCAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	return newStreamClient(cfg, u.Host, grpc.WithTransportCredentials(creds))
+}
+
+func newStreamClient(cfg *Config, target string, opts ...grpc.DialOption) (*StreamClient, error) {
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating gRPC client: %v", err)
+	}
+
+	return &StreamClient{
+		conn:        conn,
+		client:      dispatchpb.NewDispatchClient(conn),
+		timeout:     cfg.RequestTimeout,
+		breaker:     NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		assignments: make(chan *model.Lease, cfg.Workers),
+		received:    make(map[string]bool),
+	}, nil
+}
+
+// Register открывает поток и представляется оркестратору. Возвращает
+// интервал heartbeat, согласованный оркестратором.
+func (c *StreamClient) Register(ctx context.Context, info model.Agent) (time.Duration, error) {
+	hello := &dispatchpb.Hello{
+		AgentId:    info.ID,
+		Hostname:   info.Hostname,
+		Workers:    int32(info.Workers),
+		Version:    info.Version,
+		Operations: info.Operations,
+		Throughput: info.Throughput,
+		BenchScore: info.BenchScore,
+	}
+
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	c.mu.Lock()
+	c.hello = hello
+	old := c.session
+	c.mu.Unlock()
+	if old != nil {
+		old.close(errors.New("agent registered again"))
+	}
+
+	_, welcome, err := c.open(ctx, hello)
+	if err != nil {
+		return 0, fmt.Errorf("error registering agent: %v", err)
+	}
+	log.Printf("Orchestrator will send tasks with operations %v, up to %d per lease", welcome.Operations, welcome.MaxBatch)
+
+	return time.Duration(welcome.HeartbeatIntervalMs) * time.Millisecond, nil
+}
+
+// connect возвращает открытый поток, при необходимости открывая новый.
+func (c *StreamClient) connect(ctx context.Context) (*streamSession, error) {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	c.mu.Lock()
+	s, hello := c.session, c.hello
+	c.mu.Unlock()
+	if s != nil && !s.closed() {
+		return s, nil
+	}
+	if hello == nil {
+		return nil, ErrAgentNotRegistered
+	}
+
+	s, _, err := c.open(ctx, hello)
+	if err != nil {
+		return nil, fmt.Errorf("error reconnecting to orchestrator: %v", err)
+	}
+	log.Printf("Reconnected to orchestrator over gRPC")
+	return s, nil
+}
+
+// open открывает поток, отправляет Hello и ждёт Welcome. Вызывается под connectMu.
+func (c *StreamClient) open(ctx context.Context, hello *dispatchpb.Hello) (*streamSession, *dispatchpb.Welcome, error) {
+	if err := c.breaker.Wait(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	s, welcome, err := c.handshake(ctx, hello)
+	if err != nil {
+		c.breaker.Failure()
+		return nil, nil, err
+	}
+	c.breaker.Success()
+
+	c.mu.Lock()
+	c.session = s
+	// Запросы задач старого потока оркестратор забыл вместе с ним
+	c.requested = 0
+	c.mu.Unlock()
+
+	go c.receive(s)
+	return s, welcome, nil
+}
+
+func (c *StreamClient) handshake(ctx context.Context, hello *dispatchpb.Hello) (*streamSession, *dispatchpb.Welcome, error) {
+	// Поток живёт дольше ctx запроса, поэтому ctx ограничивает только ожидание Welcome
+	streamCtx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(c.timeout, cancel)
+	defer timer.Stop()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	stream, err := c.client.Connect(streamCtx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	err = stream.Send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Hello{Hello: hello}})
+	var msg *dispatchpb.OrchestratorMessage
+	if err == nil {
+		msg, err = stream.Recv()
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	welcome := msg.GetWelcome()
+	if welcome == nil {
+		cancel()
+		return nil, nil, fmt.Errorf("expected welcome, got %T", msg.Body)
+	}
+
+	return &streamSession{
+		stream:  stream,
+		cancel:  cancel,
+		pending: make(map[uint64]chan *dispatchpb.Ack),
+		done:    make(chan struct{}),
+	}, welcome, nil
+}
+
+// receive читает сообщения оркестратора, пока поток не разорвётся.
+func (c *StreamClient) receive(s *streamSession) {
+	for {
+		msg, err := s.stream.Recv()
+		if err != nil {
+			s.close(err)
+			return
+		}
+
+		switch body := msg.Body.(type) {
+		case *dispatchpb.OrchestratorMessage_Assignment:
+			c.mu.Lock()
+			if c.session == s && c.requested > 0 {
+				c.requested--
+			}
+			for _, t := range body.Assignment.Tasks {
+				c.received[t.Id] = false
+			}
+			c.mu.Unlock()
+			// Аренд приходит не больше, чем воркеров ждали задачи, поэтому
+			// канал не переполняется
+			c.assignments <- leaseFromAssignment(body.Assignment)
+
+		case *dispatchpb.OrchestratorMessage_Ack:
+			s.mu.Lock()
+			reply, ok := s.pending[body.Ack.Id]
+			delete(s.pending, body.Ack.Id)
+			s.mu.Unlock()
+			if ok {
+				reply <- body.Ack
+			}
+
+		case *dispatchpb.OrchestratorMessage_Cancel:
+			log.Printf("Orchestrator cancelled expression %s, skipping %d tasks",
+				body.Cancel.ExpressionId, len(body.Cancel.TaskIds))
+			c.mu.Lock()
+			for _, id := range body.Cancel.TaskIds {
+				if _, ok := c.received[id]; ok {
+					c.received[id] = true
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func leaseFromAssignment(a *dispatchpb.Assignment) *model.Lease {
+	tasks := make([]*model.Task, 0, len(a.Tasks))
+	for _, t := range a.Tasks {
+		tasks = append(tasks, &model.Task{
+			ID:            t.Id,
+			Arg1:          t.Arg1,
+			Arg2:          t.Arg2,
+			Operation:     t.Operation,
+			OperationTime: int(t.OperationTime),
+			ExpressionId:  t.ExpressionId,
+			Deadline:      t.Deadline,
+			LeaseToken:    a.LeaseToken,
+		})
+	}
+	return &model.Lease{Token: a.LeaseToken, ExpiresAt: a.ExpiresAt, Tasks: tasks}
+}
+
+func (s *streamSession) send(msg *dispatchpb.AgentMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.stream.Send(msg)
+}
+
+func (s *streamSession) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.cancel()
+	})
+}
+
+func (s *streamSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// call отправляет запрос и ждёт Ack с тем же ID. Неуспешный статус
+// возвращается как StatusError.
+func (c *StreamClient) call(ctx context.Context, op string, msg *dispatchpb.AgentMessage) (*dispatchpb.Ack, error) {
+	s, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.nextID++
+	msg.Id = c.nextID
+	c.mu.Unlock()
+
+	reply := make(chan *dispatchpb.Ack, 1)
+	s.mu.Lock()
+	s.pending[msg.Id] = reply
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, msg.Id)
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(msg); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case ack := <-reply:
+		if ack.Status != http.StatusOK {
+			return ack, &StatusError{Op: op, Status: int(ack.Status)}
+		}
+		return ack, nil
+	case <-s.done:
+		return nil, fmt.Errorf("stream closed: %v", s.err)
+	case <-timer.C:
+		return nil, fmt.Errorf("no reply from orchestrator in %s", c.timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Heartbeat сообщает оркестратору, что агент жив. Если поток разорвался,
+// он открывается заново, и агент регистрируется повторно.
+func (c *StreamClient) Heartbeat(ctx context.Context, agentID string) error {
+	s, err := c.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("error sending heartbeat: %w", err)
+	}
+	if err := s.send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Heartbeat{Heartbeat: &dispatchpb.Heartbeat{}}}); err != nil {
+		return fmt.Errorf("error sending heartbeat: %v", err)
+	}
+	return nil
+}
+
+// FetchTasks ждёт аренду до max задач не дольше wait. Новый запрос
+// отправляется, только если ждущих воркеров больше, чем запросов без
+// ответа, поэтому после таймаутов запросы не копятся.
+func (c *StreamClient) FetchTasks(ctx context.Context, agentID string, max int, wait time.Duration) (*model.Lease, error) {
+	s, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.waiting++
+	request := c.waiting > c.requested+len(c.assignments)
+	if request {
+		c.requested++
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.waiting--
+		c.mu.Unlock()
+	}()
+
+	if request {
+		err := s.send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Request{
+			Request: &dispatchpb.TaskRequest{Max: int32(max)},
+		}})
+		if err != nil {
+			c.mu.Lock()
+			if c.session == s && c.requested > 0 {
+				c.requested--
+			}
+			c.mu.Unlock()
+			return nil, fmt.Errorf("error requesting tasks: %v", err)
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case lease := <-c.assignments:
+		return lease, nil
+	case <-timer.C:
+		return nil, nil
+	case <-s.done:
+		return nil, fmt.Errorf("stream closed: %v", s.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SubmitTaskResults отправляет результаты нескольких задач одним сообщением.
+func (c *StreamClient) SubmitTaskResults(ctx context.Context, results []model.TaskResult) error {
+	in := make([]*dispatchpb.TaskResult, 0, len(results))
+	for _, r := range results {
+		in = append(in, &dispatchpb.TaskResult{Id: r.ID, Result: r.Result, LeaseToken: r.LeaseToken})
+	}
+
+	ack, err := c.call(ctx, "submit results", &dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Results{
+		Results: &dispatchpb.Results{Results: in},
+	}})
+	if err != nil {
+		return fmt.Errorf("error submitting results: %w", err)
+	}
+
+	// Отклонённые результаты повторять бессмысленно, только сообщаем о них
+	for _, rejected := range ack.Rejected {
+		log.Printf("Result for task %s rejected by orchestrator: %s", rejected.Id, rejected.Error)
+	}
+
+	return nil
+}
+
+// forget удаляет задачи, которые воркеры вернули, не проверив через Cancelled.
+func (c *StreamClient) forget(taskIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range taskIDs {
+		delete(c.received, id)
+	}
+}
+
+// FailTask сообщает оркестратору, что задачу невозможно вычислить.
+func (c *StreamClient) FailTask(ctx context.Context, agentID, taskID, leaseToken string, reason error) error {
+	_, err := c.call(ctx, "report task failure", &dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Failure{
+		Failure: &dispatchpb.TaskFailure{Id: taskID, LeaseToken: leaseToken, Error: reason.Error()},
+	}})
+	if err != nil {
+		return fmt.Errorf("error reporting task failure: %w", err)
+	}
+	return nil
+}
+
+// ReleaseTasks возвращает в очередь задачи аренды, которые агент не будет вычислять.
+func (c *StreamClient) ReleaseTasks(ctx context.Context, leaseToken string, taskIDs []string) error {
+	c.forget(taskIDs)
+	_, err := c.call(ctx, "release tasks", &dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Release{
+		Release: &dispatchpb.Release{LeaseToken: leaseToken, TaskIds: taskIDs},
+	}})
+
+	// Аренда уже истекла или освобождена — задачи и так вернулись в очередь
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error releasing tasks: %w", err)
+	}
+	return nil
+}
+
+// Cancelled сообщает, что оркестратор отменил задачу. Задача проверяется
+// один раз, перед вычислением; отмена, пришедшая позже, уже не учитывается.
+func (c *StreamClient) Cancelled(taskID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancelled := c.received[taskID]
+	delete(c.received, taskID)
+	return cancelled
+}
+
+// Close возвращает оркестратору аренды, не взятые воркерами, и закрывает
+// соединение.
+func (c *StreamClient) Close() error {
+	for {
+		var lease *model.Lease
+		select {
+		case lease = <-c.assignments:
+		default:
+		}
+		if lease == nil {
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		if err := c.ReleaseTasks(ctx, lease.Token, nil); err != nil {
+			log.Printf("Error releasing lease %s: %v", lease.Token, err)
+		}
+		cancel()
+	}
+
+	c.mu.Lock()
+	s := c.session
+	c.hello = nil
+	c.mu.Unlock()
+	if s != nil {
+		s.close(errors.New("client closed"))
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/dispatchpb"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeDispatch — оркестратор, которым управляет тест: запросы задач
+// попадают в requests, сообщения из outgoing отправляются агенту.
+type fakeDispatch struct {
+	dispatchpb.UnimplementedDispatchServer
+	requests chan int32
+	outgoing chan *dispatchpb.OrchestratorMessage
+}
+
+func (f *fakeDispatch) Connect(stream dispatchpb.Dispatch_ConnectServer) error {
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	err := stream.Send(&dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Welcome{
+		Welcome: &dispatchpb.Welcome{HeartbeatIntervalMs: 1500, MaxBatch: 100},
+	}})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case msg := <-f.outgoing:
+				stream.Send(msg)
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		ack := &dispatchpb.Ack{Id: msg.Id, Status: http.StatusOK}
+		switch body := msg.Body.(type) {
+		case *dispatchpb.AgentMessage_Request:
+			f.requests <- body.Request.Max
+			continue
+		case *dispatchpb.AgentMessage_Heartbeat:
+			continue
+		case *dispatchpb.AgentMessage_Results:
+			ack.Accepted = int32(len(body.Results.Results))
+		case *dispatchpb.AgentMessage_Failure:
+			ack.Status = http.StatusConflict
+		case *dispatchpb.AgentMessage_Release:
+			ack.Status = http.StatusNotFound
+		}
+		f.outgoing <- &dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Ack{Ack: ack}}
+	}
+}
+
+func TestStreamClient(t *testing.T) {
+	fake := &fakeDispatch{
+		requests: make(chan int32, 10),
+		outgoing: make(chan *dispatchpb.OrchestratorMessage, 10),
+	}
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	dispatchpb.RegisterDispatchServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	cfg := DefaultConfig()
+	cfg.Workers = 2
+	client, err := newStreamClient(cfg, "passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := client.FetchTasks(ctx, "a1", 1, 0); !errors.Is(err, ErrAgentNotRegistered) {
+		t.Fatalf("fetch before register: got %v, want ErrAgentNotRegistered", err)
+	}
+
+	interval, err := client.Register(ctx, model.Agent{ID: "a1", Workers: 2})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if interval != 1500*time.Millisecond {
+		t.Errorf("heartbeat interval = %s, want 1.5s", interval)
+	}
+	if err := client.Heartbeat(ctx, "a1"); err != nil {
+		t.Errorf("heartbeat: %v", err)
+	}
+
+	// После таймаута ожидания новый запрос не отправляется: старый ещё в силе
+	for i := 0; i < 2; i++ {
+		lease, err := client.FetchTasks(ctx, "a1", 10, 50*time.Millisecond)
+		if lease != nil || err != nil {
+			t.Fatalf("fetch without tasks: got %v, %v", lease, err)
+		}
+	}
+	if max := <-fake.requests; max != 10 {
+		t.Errorf("requested %d tasks, want 10", max)
+	}
+	select {
+	case <-fake.requests:
+		t.Error("second task request sent while the first is pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fake.outgoing <- &dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Assignment{
+		Assignment: &dispatchpb.Assignment{LeaseToken: "l1", Tasks: []*dispatchpb.Task{
+			{Id: "t1", Arg1: "2", Arg2: "3", Operation: "+", ExpressionId: "e1"},
+		}},
+	}}
+	lease, err := client.FetchTasks(ctx, "a1", 10, time.Second)
+	if err != nil || lease == nil {
+		t.Fatalf("fetch: got %v, %v", lease, err)
+	}
+	if lease.Token != "l1" || len(lease.Tasks) != 1 || lease.Tasks[0].Arg1 != "2" || lease.Tasks[0].LeaseToken != "l1" {
+		t.Errorf("unexpected lease %+v", lease)
+	}
+
+	// Отмена задачи, которую агент не получал, не запоминается
+	fake.outgoing <- &dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Cancel{
+		Cancel: &dispatchpb.Cancel{ExpressionId: "e1", TaskIds: []string{"t1", "unknown"}},
+	}}
+	// Подтверждение приходит после отмены, значит отмена уже обработана
+	if err := client.ReleaseTasks(ctx, "l0", []string{"t0"}); err != nil {
+		t.Errorf("release of unknown lease: %v", err)
+	}
+	client.mu.Lock()
+	received := len(client.received)
+	client.mu.Unlock()
+	if received != 1 {
+		t.Errorf("client remembers %d tasks, want 1", received)
+	}
+	if !client.Cancelled("t1") {
+		t.Fatal("task was not cancelled")
+	}
+	if client.Cancelled("t1") {
+		t.Error("cancellation must be reported once")
+	}
+
+	if err := client.SubmitTaskResults(ctx, []model.TaskResult{{ID: "t1", Result: 5, LeaseToken: "l1"}}); err != nil {
+		t.Errorf("submit: %v", err)
+	}
+	err = client.FailTask(ctx, "a1", "t1", "l1", errors.New("division by zero"))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != http.StatusConflict || IsRetryable(err) {
+		t.Errorf("fail task: got %v, want non-retryable 409", err)
+	}
+	if err := client.ReleaseTasks(ctx, "l1", nil); err != nil {
+		t.Errorf("release of unknown lease: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package calculator
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// ResultCache — общий для воркеров агента LRU-кэш результатов операций
+// по операции и аргументам. Если оркестратор снова выдаёт задачу после
+// истечения аренды или в выражениях встречается та же операция с теми же
+// аргументами, результат берётся из кэша без повторного вычисления.
+type ResultCache struct {
+	capacity int
+
+	mu    sync.Mutex
+	order *list.List // от недавно использованных к давно использованным
+	items map[string]*list.Element
+
+	hits, misses, evictions atomic.Uint64
+}
+
+type cacheEntry struct {
+	key    string
+	result float64
+}
+
+// CacheStats — счётчики кэша результатов.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+	Capacity  int
+}
+
+// NewResultCache создаёт кэш на capacity результатов; при capacity <= 0
+// кэш ничего не хранит.
+func NewResultCache(capacity int) *ResultCache {
+	return &ResultCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// CacheKey возвращает ключ результата операции с аргументами arg1 и arg2.
+func CacheKey(operation string, arg1, arg2 float64) string {
+	return operation + "|" + strconv.FormatFloat(arg1, 'g', -1, 64) + "|" + strconv.FormatFloat(arg2, 'g', -1, 64)
+}
+
+func (c *ResultCache) Get(key string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return 0, false
+	}
+	c.order.MoveToFront(elem)
+	c.hits.Add(1)
+	return elem.Value.(*cacheEntry).result, true
+}
+
+func (c *ResultCache) Put(key string, result float64) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*cacheEntry).result = result
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, result: result})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *ResultCache) Stats() CacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+		Capacity:  c.capacity,
+	}
+}
+
+// Perform выполняет операцию задачи так же, как PerformOperationContext,
+// но сначала ищет её результат в кэше. Найденный результат возвращается
+// сразу, без имитации длительности операции. Ошибки не кэшируются.
+func (c *ResultCache) Perform(ctx context.Context, task *model.Task) interface{} {
+	arg1, arg2, err := parseArgs(task)
+	if err != nil {
+		return err
+	}
+
+	key := CacheKey(task.Operation, arg1, arg2)
+	if result, ok := c.Get(key); ok {
+		return result
+	}
+
+	result := checkRange(perform(ctx, task, arg1, arg2))
+	if value, ok := result.(float64); ok {
+		c.Put(key, value)
+	}
+	return result
+}
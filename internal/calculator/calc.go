@@ -1,58 +1,86 @@
 package calculator
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"math"
 	"strconv"
 	"time"
 
 	"github.com/pliliya111/go_final_sprint/internal/model"
 )
 
-var (
-	timeAdditionMS       = getEnvInt("TIME_ADDITION_MS", 1000)
-	timeSubtractionMS    = getEnvInt("TIME_SUBTRACTION_MS", 1000)
-	timeMultiplicationMS = getEnvInt("TIME_MULTIPLICATIONS_MS", 1000)
-	timeDivisionMS       = getEnvInt("TIME_DIVISIONS_MS", 1000)
-	Results              = make(map[string]interface{})
-)
+var ErrDeadlineExceeded = errors.New("task deadline exceeded")
+
+// ErrOutOfRange — результат операции не помещается в float64
+// (переполнение до бесконечности или NaN).
+var ErrOutOfRange = errors.New("result is out of range")
 
-func getEnvInt(key string, defaultValue int) int {
-	value, exists := os.LookupEnv(key)
-	if !exists {
-		return defaultValue
+// sleep имитирует длительность операции, присланную оркестратором.
+// Если у задачи есть срок выполнения и он истекает раньше, ожидание
+// прерывается с ErrDeadlineExceeded; при отмене ctx — с ошибкой ctx.
+func sleep(ctx context.Context, task *model.Task) error {
+	delay := time.Duration(task.OperationTime) * time.Millisecond
+	var err error
+	if task.Deadline > 0 {
+		if left := time.Until(time.UnixMilli(task.Deadline)); left < delay {
+			delay = max(left, 0)
+			err = ErrDeadlineExceeded
+		}
 	}
-	intValue, err := strconv.Atoi(value)
-	if err != nil {
-		return defaultValue
+
+	// Без имитации длительности (например, в замере производительности) таймер не нужен
+	if delay <= 0 && err == nil {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return intValue
 }
 
 func PerformOperation(task *model.Task) interface{} {
+	return PerformOperationContext(context.Background(), task)
+}
 
-	if arg1ID, ok := task.Arg1.(string); ok {
-		if result, exists := Results[arg1ID]; exists {
-			task.Arg1 = result
-		}
+// PerformOperationContext выполняет операцию задачи, прерывая имитацию её
+// длительности при отмене ctx. В этом случае возвращается ошибка ctx.
+func PerformOperationContext(ctx context.Context, task *model.Task) interface{} {
+	arg1, arg2, err := parseArgs(task)
+	if err != nil {
+		return err
 	}
-	if arg2ID, ok := task.Arg2.(string); ok {
-		if result, exists := Results[arg2ID]; exists {
-			task.Arg2 = result
-		}
+	return checkRange(perform(ctx, task, arg1, arg2))
+}
+
+// checkRange заменяет бесконечный результат или NaN ошибкой ErrOutOfRange:
+// такой результат нельзя передать оркестратору.
+func checkRange(result interface{}) interface{} {
+	if value, ok := result.(float64); ok && (math.IsInf(value, 0) || math.IsNaN(value)) {
+		return ErrOutOfRange
 	}
+	return result
+}
 
+// parseArgs приводит аргументы задачи к числам.
+func parseArgs(task *model.Task) (float64, float64, error) {
 	if arg1Str, ok := task.Arg1.(string); ok {
 		arg1, err := strconv.ParseFloat(arg1Str, 64)
 		if err != nil {
-			return fmt.Errorf("invalid argument: arg1=%v (cannot convert to float64)", task.Arg1)
+			return 0, 0, fmt.Errorf("invalid argument: arg1=%v (cannot convert to float64)", task.Arg1)
 		}
 		task.Arg1 = arg1
 	}
 	if arg2Str, ok := task.Arg2.(string); ok {
 		arg2, err := strconv.ParseFloat(arg2Str, 64)
 		if err != nil {
-			return fmt.Errorf("invalid argument: arg2=%v (cannot convert to float64)", task.Arg2)
+			return 0, 0, fmt.Errorf("invalid argument: arg2=%v (cannot convert to float64)", task.Arg2)
 		}
 		task.Arg2 = arg2
 	}
@@ -61,21 +89,32 @@ func PerformOperation(task *model.Task) interface{} {
 	arg2, ok2 := task.Arg2.(float64)
 
 	if !ok1 || !ok2 {
-		return fmt.Errorf("invalid arguments for operation: arg1=%v, arg2=%v", task.Arg1, task.Arg2)
+		return 0, 0, fmt.Errorf("invalid arguments for operation: arg1=%v, arg2=%v", task.Arg1, task.Arg2)
 	}
+	return arg1, arg2, nil
+}
 
+func perform(ctx context.Context, task *model.Task, arg1, arg2 float64) interface{} {
 	switch task.Operation {
 	case "+":
-		time.Sleep(time.Duration(timeAdditionMS) * time.Millisecond)
+		if err := sleep(ctx, task); err != nil {
+			return err
+		}
 		return arg1 + arg2
 	case "-":
-		time.Sleep(time.Duration(timeSubtractionMS) * time.Millisecond)
+		if err := sleep(ctx, task); err != nil {
+			return err
+		}
 		return arg1 - arg2
 	case "*":
-		time.Sleep(time.Duration(timeMultiplicationMS) * time.Millisecond)
+		if err := sleep(ctx, task); err != nil {
+			return err
+		}
 		return arg1 * arg2
 	case "/":
-		time.Sleep(time.Duration(timeDivisionMS) * time.Millisecond)
+		if err := sleep(ctx, task); err != nil {
+			return err
+		}
 		if arg2 == 0 {
 			return fmt.Errorf("division by zero")
 		}
@@ -1,7 +1,10 @@
 package calculator_test
 
 import (
+	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pliliya111/go_final_sprint/internal/calculator"
 	"github.com/pliliya111/go_final_sprint/internal/model"
@@ -94,6 +97,17 @@ func TestPerformOperation(t *testing.T) {
 			expected:    "invalid argument: arg2=not_a_number (cannot convert to float64)",
 			expectError: true,
 		},
+		{
+			name: "Deadline exceeded",
+			task: &model.Task{
+				Arg1:      float64(2),
+				Arg2:      float64(3),
+				Operation: "+",
+				Deadline:  time.Now().Add(-time.Second).UnixMilli(),
+			},
+			expected:    "task deadline exceeded",
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -114,3 +128,81 @@ func TestPerformOperation(t *testing.T) {
 		})
 	}
 }
+
+func TestResultCache(t *testing.T) {
+	cache := calculator.NewResultCache(2)
+
+	task := &model.Task{Arg1: "6", Arg2: "7", Operation: "*", OperationTime: 50}
+	if result := cache.Perform(context.Background(), task); result != float64(42) {
+		t.Fatalf("expected 42, got %v", result)
+	}
+
+	// Повторно выданная задача берётся из кэша без ожидания
+	start := time.Now()
+	again := &model.Task{Arg1: float64(6), Arg2: "7.0", Operation: "*", OperationTime: 50}
+	if result := cache.Perform(context.Background(), again); result != float64(42) {
+		t.Fatalf("expected cached 42, got %v", result)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("expected cached result without delay, took %s", elapsed)
+	}
+
+	// Ошибки не кэшируются
+	cache.Perform(context.Background(), &model.Task{Arg1: "1", Arg2: "0", Operation: "/"})
+	cache.Perform(context.Background(), &model.Task{Arg1: "1", Arg2: "0", Operation: "/"})
+
+	cache.Put(calculator.CacheKey("+", 1, 2), 3)
+	cache.Put(calculator.CacheKey("-", 1, 2), -1)
+	if _, ok := cache.Get(calculator.CacheKey("*", 6, 7)); ok {
+		t.Error("expected the least recently used result to be evicted")
+	}
+
+	stats := cache.Stats()
+	want := calculator.CacheStats{Hits: 1, Misses: 4, Evictions: 1, Size: 2, Capacity: 2}
+	if stats != want {
+		t.Errorf("expected stats %+v, got %+v", want, stats)
+	}
+}
+
+func TestResultCacheConcurrent(t *testing.T) {
+	cache := calculator.NewResultCache(16)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				task := &model.Task{Arg1: float64(i % 32), Arg2: float64(w % 2), Operation: "+"}
+				if result := cache.Perform(context.Background(), task); result != float64(i%32+w%2) {
+					t.Errorf("unexpected result %v", result)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Hits+stats.Misses != 8*200 || stats.Size > 16 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := calculator.SelfTest(); err != nil {
+		t.Fatalf("self-test failed: %v", err)
+	}
+}
+
+func TestBench(t *testing.T) {
+	result := calculator.Bench(40 * time.Millisecond)
+	if result.Score <= 0 {
+		t.Fatalf("bench score = %v, want positive", result.Score)
+	}
+	for _, op := range []string{"+", "-", "*", "/"} {
+		if result.PerOperation[op] <= 0 {
+			t.Errorf("bench of %s = %v, want positive", op, result.PerOperation[op])
+		}
+	}
+}
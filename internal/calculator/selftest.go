@@ -0,0 +1,119 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// selfTestCase — операция с заранее известным результатом. Если wantErr
+// задан, операция должна вернуть ошибку, иначе — результат want.
+type selfTestCase struct {
+	operation  string
+	arg1, arg2 interface{}
+	want       float64
+	wantErr    bool
+}
+
+var selfTestCases = []selfTestCase{
+	{operation: "+", arg1: 2.0, arg2: 3.0, want: 5},
+	{operation: "-", arg1: 7.0, arg2: 10.0, want: -3},
+	{operation: "*", arg1: -6.0, arg2: -7.0, want: 42},
+	{operation: "/", arg1: 1.0, arg2: 4.0, want: 0.25},
+	{operation: "+", arg1: 0.1, arg2: 0.2, want: 0.30000000000000004},
+	{operation: "/", arg1: -9.0, arg2: 3.0, want: -3},
+	{operation: "*", arg1: 0.0, arg2: -5.0, want: 0},
+	// Аргументы приходят от оркестратора и строками
+	{operation: "+", arg1: "2.5", arg2: "0.5", want: 3},
+	{operation: "*", arg1: "1e3", arg2: "-2", want: -2000},
+	// Деление на ноль
+	{operation: "/", arg1: 1.0, arg2: 0.0, wantErr: true},
+	{operation: "/", arg1: 0.0, arg2: 0.0, wantErr: true},
+	// Большие и маленькие значения
+	{operation: "*", arg1: 1e154, arg2: 1e154, want: 1e308},
+	{operation: "+", arg1: math.MaxFloat64, arg2: 1.0, want: math.MaxFloat64},
+	{operation: "*", arg1: 1e-300, arg2: 1e-300, want: 0},
+	{operation: "/", arg1: 1e300, arg2: 0.5, want: 2e300},
+	{operation: "*", arg1: 1e308, arg2: 10.0, wantErr: true},
+	{operation: "+", arg1: math.MaxFloat64, arg2: math.MaxFloat64, wantErr: true},
+	{operation: "-", arg1: -math.MaxFloat64, arg2: math.MaxFloat64, wantErr: true},
+	{operation: "/", arg1: 1e308, arg2: 1e-10, wantErr: true},
+	// Неверные задачи
+	{operation: "+", arg1: "abc", arg2: 1.0, wantErr: true},
+	{operation: "+", arg1: "NaN", arg2: 1.0, wantErr: true},
+	{operation: "^", arg1: 2.0, arg2: 3.0, wantErr: true},
+}
+
+// SelfTest выполняет PerformOperation на наборе задач с известными
+// результатами, включая деление на ноль и переполнение, и возвращает
+// ошибку со всеми несовпадениями.
+func SelfTest() error {
+	var errs []error
+	for _, tc := range selfTestCases {
+		task := &model.Task{Operation: tc.operation, Arg1: tc.arg1, Arg2: tc.arg2}
+		result := PerformOperation(task)
+		value, ok := result.(float64)
+		switch {
+		case tc.wantErr && ok:
+			errs = append(errs, fmt.Errorf("%v %s %v = %v, want an error", tc.arg1, tc.operation, tc.arg2, value))
+		case !tc.wantErr && !ok:
+			errs = append(errs, fmt.Errorf("%v %s %v failed: %v, want %v", tc.arg1, tc.operation, tc.arg2, result, tc.want))
+		case !tc.wantErr && value != tc.want:
+			errs = append(errs, fmt.Errorf("%v %s %v = %v, want %v", tc.arg1, tc.operation, tc.arg2, value, tc.want))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SelfTestCases возвращает число задач, которые проверяет SelfTest.
+func SelfTestCases() int {
+	return len(selfTestCases)
+}
+
+// BenchResult — производительность вычислений без имитации длительности
+// операций, в операциях в секунду.
+type BenchResult struct {
+	Score        float64 // по всем операциям вместе
+	PerOperation map[string]float64
+}
+
+// Bench измеряет, сколько операций в секунду выполняет PerformOperation
+// в одной горутине, когда длительность операций не имитируется. Каждая
+// операция замеряется d/4.
+func Bench(d time.Duration) BenchResult {
+	operations := []string{"+", "-", "*", "/"}
+	result := BenchResult{PerOperation: make(map[string]float64, len(operations))}
+
+	total := 0
+	var elapsed time.Duration
+	for _, op := range operations {
+		n, took := benchOperation(op, d/time.Duration(len(operations)))
+		result.PerOperation[op] = float64(n) / took.Seconds()
+		total += n
+		elapsed += took
+	}
+	result.Score = float64(total) / elapsed.Seconds()
+	return result
+}
+
+// benchOperation выполняет операцию, пока не пройдёт d, и возвращает
+// число выполненных операций и затраченное время.
+func benchOperation(operation string, d time.Duration) (int, time.Duration) {
+	// Время проверяется раз в пачку, чтобы не замерять сам time.Now
+	const batch = 1000
+
+	start := time.Now()
+	n := 0
+	for {
+		for i := 0; i < batch; i++ {
+			PerformOperation(&model.Task{Operation: operation, Arg1: float64(n + i + 1), Arg2: 3.0})
+		}
+		n += batch
+		if took := time.Since(start); took >= d {
+			return n, took
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// CountQueuedTasks возвращает число нерешённых задач выражений,
+// допущенных к вычислению.
+func CountQueuedTasks(ctx context.Context, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM tasks t
+		JOIN expressions e ON e.id = t.expression_id
+		WHERE e.status = 'in_progress' AND t.result IS NULL`).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queued tasks: %w", err)
+	}
+	return count, nil
+}
+
+func CountWaitingExpressions(ctx context.Context, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM expressions WHERE status = 'waiting_admission'").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count waiting expressions: %w", err)
+	}
+	return count, nil
+}
+
+// CountAliveWorkers возвращает суммарное число воркеров живых агентов.
+func CountAliveWorkers(ctx context.Context, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(workers), 0) FROM agents WHERE status = 'alive'").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count agent workers: %w", err)
+	}
+	return count, nil
+}
+
+// GetWaitingExpressions возвращает выражения, ожидающие допуска к вычислению,
+// в порядке допуска: сначала с большим приоритетом, затем более старые.
+func GetWaitingExpressions(ctx context.Context, db *sql.DB, limit int) ([]*model.Expression, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, expression, status, user_id, priority, created_at, deadline, replicas, schedule_id
+		FROM expressions
+		WHERE status = 'waiting_admission'
+		ORDER BY priority DESC, created_at ASC
+		LIMIT $1`,
+		limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch waiting expressions: %w", err)
+	}
+	defer rows.Close()
+
+	var expressions []*model.Expression
+	for rows.Next() {
+		var expr model.Expression
+		var deadline sql.NullInt64
+		var scheduleID sql.NullString
+		err := rows.Scan(&expr.ID, &expr.Expression, &expr.Status, &expr.UserId, &expr.Priority,
+			&expr.CreatedAt, &deadline, &expr.Replicas, &scheduleID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan expression: %w", err)
+		}
+		expr.Deadline = deadline.Int64
+		expr.ScheduleID = scheduleID.String
+		expressions = append(expressions, &expr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return expressions, nil
+}
+
+// FailExpression помечает выражение неудавшимся вместе со ссылающимися на него.
+func FailExpression(ctx context.Context, db *sql.DB, id string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE expressions SET status = 'failed' WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("failed to fail expression: %w", err)
+	}
+	if err := failDependentExpressions(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// RegisterAgent добавляет агента в реестр или обновляет данные
+// повторно зарегистрировавшегося агента.
+func RegisterAgent(ctx context.Context, db *sql.DB, agent *model.Agent) error {
+	var operations, throughput sql.NullString
+	if len(agent.Operations) > 0 {
+		data, err := json.Marshal(agent.Operations)
+		if err != nil {
+			return fmt.Errorf("failed to encode agent operations: %w", err)
+		}
+		operations = sql.NullString{String: string(data), Valid: true}
+	}
+	if len(agent.Throughput) > 0 {
+		data, err := json.Marshal(agent.Throughput)
+		if err != nil {
+			return fmt.Errorf("failed to encode agent throughput: %w", err)
+		}
+		throughput = sql.NullString{String: string(data), Valid: true}
+	}
+
+	now := time.Now().UnixMilli()
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO agents (id, hostname, workers, version, operations, throughput, registered_at, last_seen, bench_score, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, 'alive')
+		ON CONFLICT (id) DO UPDATE SET
+			hostname = excluded.hostname,
+			workers = excluded.workers,
+			version = excluded.version,
+			operations = excluded.operations,
+			throughput = excluded.throughput,
+			bench_score = excluded.bench_score,
+			last_seen = excluded.last_seen,
+			status = 'alive'`,
+		agent.ID, agent.Hostname, agent.Workers, agent.Version, operations, throughput, now, agent.BenchScore)
+	if err != nil {
+		return fmt.Errorf("failed to register agent: %w", err)
+	}
+	return nil
+}
+
+func AgentHeartbeat(ctx context.Context, db *sql.DB, agentID string) error {
+	result, err := db.ExecContext(ctx,
+		"UPDATE agents SET last_seen = $1, status = 'alive' WHERE id = $2",
+		time.Now().UnixMilli(), agentID)
+	if err != nil {
+		return fmt.Errorf("failed to update agent heartbeat: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update agent heartbeat: %w", err)
+	}
+	if affected == 0 {
+		return ErrAgentNotFound
+	}
+	return nil
+}
+
+func GetAgents(ctx context.Context, db *sql.DB) ([]*model.Agent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.id, a.hostname, a.workers, a.version, a.operations, a.throughput, a.bench_score,
+			a.registered_at, a.last_seen, a.tasks_completed, a.results_disputed, a.status,
+			(SELECT COUNT(*) FROM task_leases l
+				WHERE l.agent_id = a.id AND l.status = 'active' AND l.expires_at > $1)
+		FROM agents a
+		ORDER BY a.registered_at`,
+		time.Now().UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch agents: %w", err)
+	}
+	defer rows.Close()
+
+	var agents []*model.Agent
+	for rows.Next() {
+		var agent model.Agent
+		var operations, throughput sql.NullString
+		err := rows.Scan(&agent.ID, &agent.Hostname, &agent.Workers, &agent.Version,
+			&operations, &throughput, &agent.BenchScore, &agent.RegisteredAt, &agent.LastSeen,
+			&agent.TasksCompleted, &agent.ResultsDisputed, &agent.Status, &agent.CurrentLeases)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan agent: %w", err)
+		}
+		if operations.Valid {
+			if err := json.Unmarshal([]byte(operations.String), &agent.Operations); err != nil {
+				return nil, fmt.Errorf("failed to decode agent operations: %w", err)
+			}
+		}
+		if throughput.Valid {
+			if err := json.Unmarshal([]byte(throughput.String), &agent.Throughput); err != nil {
+				return nil, fmt.Errorf("failed to decode agent throughput: %w", err)
+			}
+		}
+		agent.Reputation = reputation(agent.TasksCompleted, agent.ResultsDisputed)
+		agents = append(agents, &agent)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return agents, nil
+}
+
+func CountAliveAgents(ctx context.Context, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM agents WHERE status = 'alive'").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count agents: %w", err)
+	}
+	return count, nil
+}
+
+// reputation возвращает долю результатов агента, принятых при проверке
+// репликами. У агента без проверенных результатов репутация максимальна.
+func reputation(completed, disputed int) float64 {
+	if completed+disputed == 0 {
+		return 1
+	}
+	return float64(completed) / float64(completed+disputed)
+}
+
+// MarkDeadAgents помечает мёртвыми агентов, не присылавших heartbeat дольше
+// deadAfter, и возвращает их ID. Аренды этих агентов освобождает очередь задач.
+func MarkDeadAgents(ctx context.Context, db *sql.DB, deadAfter time.Duration) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE agents SET status = 'dead'
+		WHERE status = 'alive' AND last_seen <= $1
+		RETURNING id`,
+		time.Now().Add(-deadAfter).UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark dead agents: %w", err)
+	}
+	defer rows.Close()
+
+	var dead []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan agent id: %w", err)
+		}
+		dead = append(dead, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+	return dead, nil
+}
+
+// GetAliveAgentIDs возвращает ID агентов, которые не помечены мёртвыми.
+func GetAliveAgentIDs(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM agents WHERE status = 'alive'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch alive agents: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan agent id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+	return ids, nil
+}
+
+// GetAgentOperations возвращает операции, которые поддерживает агент,
+// или nil, если агент неизвестен или не ограничивает операции.
+func GetAgentOperations(ctx context.Context, db *sql.DB, agentID string) ([]string, error) {
+	if agentID == "" {
+		return nil, nil
+	}
+
+	var operations sql.NullString
+	err := db.QueryRowContext(ctx,
+		"SELECT operations FROM agents WHERE id = $1", agentID).Scan(&operations)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get agent operations: %w", err)
+	}
+	if !operations.Valid {
+		return nil, nil
+	}
+
+	var result []string
+	if err := json.Unmarshal([]byte(operations.String), &result); err != nil {
+		return nil, fmt.Errorf("failed to decode agent operations: %w", err)
+	}
+	return result, nil
+}
+
+// GetUnsupportedOperations возвращает операции из operations,
+// которые не может выполнить ни один живой агент.
+func GetUnsupportedOperations(ctx context.Context, db *sql.DB, operations []string) ([]string, error) {
+	if len(operations) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(operations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode operations: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT o.value FROM json_each($1) o
+		WHERE NOT EXISTS (
+			SELECT 1 FROM agents a
+			WHERE a.status = 'alive'
+			AND (a.operations IS NULL OR o.value IN (SELECT value FROM json_each(a.operations)))
+		)
+		ORDER BY o.value`,
+		string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check task operations: %w", err)
+	}
+	defer rows.Close()
+
+	var unsupported []string
+	for rows.Next() {
+		var operation string
+		if err := rows.Scan(&operation); err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %w", err)
+		}
+		unsupported = append(unsupported, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return unsupported, nil
+}
@@ -3,15 +3,71 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pliliya111/go_final_sprint/internal/model"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrExpressionNotFound = errors.New("expression not found")
+	ErrExpressionFinished = errors.New("expression is already finished")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrAgentNotFound      = errors.New("agent not found")
+	ErrTaskNotFound       = errors.New("task not found")
+	ErrLeaseMismatch      = errors.New("task is not leased with this token")
+	ErrResultConflict     = errors.New("task already has a different result")
+	ErrScheduleNotFound   = errors.New("schedule not found")
+	ErrLeaseNotFound      = errors.New("lease not found or already expired")
+)
+
+// Окно, за которое считается число выданных пользователю задач
+// при справедливом распределении между пользователями.
+const fairShareWindow = time.Minute
+
+// После стольких спорных раундов подряд задача реплицированного выражения
+// завершается неудачей, а не выдаётся снова.
+const maxTaskDisputes = 3
+
+// Колонки, добавленные после первой версии схемы. Для уже существующих
+// баз они добавляются через ALTER TABLE.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "weight", "REAL NOT NULL DEFAULT 1"},
+	{"expressions", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "created_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "deadline", "INTEGER"},
+	{"tasks", "dispatched_at", "INTEGER"},
+	{"task_leases", "agent_id", "TEXT"},
+	{"agents", "operations", "TEXT"},
+	{"agents", "throughput", "TEXT"},
+	{"expressions", "replicas", "INTEGER NOT NULL DEFAULT 1"},
+	{"tasks", "disputes", "INTEGER NOT NULL DEFAULT 0"},
+	{"task_leases", "result", "REAL"},
+	{"agents", "results_disputed", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "max_expressions_per_minute", "INTEGER"},
+	{"users", "max_pending_tasks", "INTEGER"},
+	{"users", "max_expression_length", "INTEGER"},
+	{"expressions", "schedule_id", "TEXT"},
+	{"tasks", "critical_path", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "critical_path", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "started_at", "INTEGER"},
+	{"expressions", "completed_at", "INTEGER"},
+	{"agents", "bench_score", "REAL NOT NULL DEFAULT 0"},
+	{"users", "is_admin", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "task_count", "INTEGER NOT NULL DEFAULT 0"},
+}
+
 func CreateTables(ctx context.Context, db *sql.DB) error {
 	fmt.Println("Creating tables")
 	const (
@@ -19,7 +75,13 @@ func CreateTables(ctx context.Context, db *sql.DB) error {
 	CREATE TABLE IF NOT EXISTS users(
 		id INTEGER PRIMARY KEY AUTOINCREMENT, 
 		name TEXT,
-		password TEXT
+		password TEXT,
+		weight REAL NOT NULL DEFAULT 1,
+		is_admin INTEGER NOT NULL DEFAULT 0,
+		-- персональные лимиты, NULL — лимит по умолчанию
+		max_expressions_per_minute INTEGER,
+		max_pending_tasks INTEGER,
+		max_expression_length INTEGER
 	);`
 
 		expressionsTable = `
@@ -29,6 +91,15 @@ func CreateTables(ctx context.Context, db *sql.DB) error {
 		status TEXT NOT NULL,
 		Result TEXT,
 		user_id INTEGER NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL DEFAULT 0,
+		deadline INTEGER,
+		replicas INTEGER NOT NULL DEFAULT 1,
+		schedule_id TEXT, -- расписание, по которому создано выражение
+		critical_path INTEGER NOT NULL DEFAULT 0,
+		started_at INTEGER,
+		completed_at INTEGER,
+		task_count INTEGER NOT NULL DEFAULT 0, -- число задач, на которые разбито выражение
 		FOREIGN KEY (user_id)  REFERENCES users (id)
 	);`
 		tasksTable = `
@@ -40,7 +111,65 @@ func CreateTables(ctx context.Context, db *sql.DB) error {
 			result TEXT,
 			expression_id TEXT NOT NULL,
 			status TEXT, 
+			dispatched_at INTEGER,
+			disputes INTEGER NOT NULL DEFAULT 0,
+			critical_path INTEGER NOT NULL DEFAULT 0,
 			FOREIGN KEY (expression_id) REFERENCES expressions (id)
+	);`
+		taskLeasesTable = `
+		CREATE TABLE IF NOT EXISTS task_leases (
+			token TEXT NOT NULL,
+			task_id TEXT NOT NULL,
+			agent_id TEXT,
+			expires_at INTEGER NOT NULL,
+			status TEXT NOT NULL, -- active, submitted, completed, released, disputed, rejected
+			result REAL, -- результат, присланный по этой аренде
+			PRIMARY KEY (token, task_id),
+			FOREIGN KEY (task_id) REFERENCES tasks (id)
+	);`
+		agentsTable = `
+		CREATE TABLE IF NOT EXISTS agents (
+			id TEXT PRIMARY KEY,
+			hostname TEXT,
+			workers INTEGER NOT NULL DEFAULT 1,
+			version TEXT,
+			operations TEXT, -- JSON-массив поддерживаемых операций, NULL — все
+			throughput TEXT, -- JSON-объект операций в секунду по операциям
+			bench_score REAL NOT NULL DEFAULT 0, -- операций в секунду по замеру агента
+			registered_at INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL,
+			tasks_completed INTEGER NOT NULL DEFAULT 0,
+			results_disputed INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL -- alive, dead
+	);`
+		operationTimingsTable = `
+		CREATE TABLE IF NOT EXISTS operation_timings (
+			operation TEXT PRIMARY KEY,
+			duration_ms INTEGER NOT NULL
+	);`
+		expressionRefsTable = `
+		CREATE TABLE IF NOT EXISTS expression_refs (
+			expression_id TEXT NOT NULL,
+			ref_expression_id TEXT NOT NULL, -- выражение, на результат которого ссылается expression_id
+			PRIMARY KEY (expression_id, ref_expression_id),
+			FOREIGN KEY (expression_id) REFERENCES expressions (id),
+			FOREIGN KEY (ref_expression_id) REFERENCES expressions (id)
+	);`
+		schedulesTable = `
+		CREATE TABLE IF NOT EXISTS schedules (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expression TEXT NOT NULL,
+			cron TEXT, -- расписание cron или интервал между запусками
+			interval_ms INTEGER,
+			priority INTEGER NOT NULL DEFAULT 0,
+			replicas INTEGER NOT NULL DEFAULT 1,
+			timeout_ms INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL, -- active, paused
+			created_at INTEGER NOT NULL,
+			next_run_at INTEGER,
+			last_run_at INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users (id)
 	);`
 	)
 
@@ -59,6 +188,56 @@ func CreateTables(ctx context.Context, db *sql.DB) error {
 		return err
 	}
 
+	if _, err := db.ExecContext(ctx, taskLeasesTable); err != nil {
+		log.Printf("Error creating task_leases table: %v", err)
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, agentsTable); err != nil {
+		log.Printf("Error creating agents table: %v", err)
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, operationTimingsTable); err != nil {
+		log.Printf("Error creating operation_timings table: %v", err)
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, schedulesTable); err != nil {
+		log.Printf("Error creating schedules table: %v", err)
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, expressionRefsTable); err != nil {
+		log.Printf("Error creating expression_refs table: %v", err)
+		return err
+	}
+
+	for _, m := range columnMigrations {
+		if err := addColumnIfNotExists(ctx, db, m.table, m.column, m.definition); err != nil {
+			log.Printf("Error migrating %s table: %v", m.table, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addColumnIfNotExists(ctx context.Context, db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	q := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	if _, err := db.ExecContext(ctx, q); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -129,19 +308,50 @@ func LoginUser(ctx context.Context, db *sql.DB, name, password string) (*model.U
 }
 
 func InsertExpression(ctx context.Context, db *sql.DB, expr *model.Expression) (string, error) {
-	var q = `INSERT INTO expressions (id, expression, status, result, user_id) VALUES ($1, $2, $3, $4, $5)`
-	_, err := db.ExecContext(ctx, q, expr.ID, expr.Expression, expr.Status, expr.Result, expr.UserId)
+	if err := insertExpression(ctx, db, expr, 0); err != nil {
+		return "", err
+	}
+	return expr.ID, nil
+}
+
+// insertExpression сохраняет выражение из tasks задач; db — *sql.DB или *sql.Tx.
+func insertExpression(ctx context.Context, db querier, expr *model.Expression, tasks int) error {
+	if expr.CreatedAt == 0 {
+		expr.CreatedAt = time.Now().UnixMilli()
+	}
+
+	var deadline sql.NullInt64
+	if expr.Deadline > 0 {
+		deadline = sql.NullInt64{Int64: expr.Deadline, Valid: true}
+	}
+
+	if expr.Replicas == 0 {
+		expr.Replicas = 1
+	}
+
+	var scheduleID sql.NullString
+	if expr.ScheduleID != "" {
+		scheduleID = sql.NullString{String: expr.ScheduleID, Valid: true}
+	}
+
+	var q = `INSERT INTO expressions (id, expression, status, result, user_id, priority, created_at, deadline, replicas, schedule_id, task_count) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	_, err := db.ExecContext(ctx, q, expr.ID, expr.Expression, expr.Status, expr.Result, expr.UserId, expr.Priority, expr.CreatedAt, deadline, expr.Replicas, scheduleID, tasks)
 	if err != nil {
 		fmt.Println(err)
-		return "", fmt.Errorf("failed to insert expression: %w", err)
+		return fmt.Errorf("failed to insert expression: %w", err)
 	}
 
-	return expr.ID, nil
+	return nil
 }
 
 func UpdateExpression(ctx context.Context, db *sql.DB, expr *model.Expression) error {
-	var q = `UPDATE expressions SET expression = $1, status = $2, result = $3 WHERE id = $4`
-	result, err := db.ExecContext(ctx, q, expr.Expression, expr.Status, expr.Result, expr.ID)
+	var startedAt sql.NullInt64
+	if expr.StartedAt > 0 {
+		startedAt = sql.NullInt64{Int64: expr.StartedAt, Valid: true}
+	}
+
+	var q = `UPDATE expressions SET expression = $1, status = $2, result = $3, critical_path = $4, started_at = $5 WHERE id = $6`
+	result, err := db.ExecContext(ctx, q, expr.Expression, expr.Status, expr.Result, expr.CriticalPath, startedAt, expr.ID)
 	if err != nil {
 		fmt.Println(err)
 		return fmt.Errorf("failed to update expression: %w", err)
@@ -157,17 +367,17 @@ func InsertTasks(ctx context.Context, db *sql.DB, tasks []*model.Task) error {
 	}
 
 	var q strings.Builder
-	q.WriteString("INSERT INTO tasks (id, arg1, arg2, operation, expression_id) VALUES ")
+	q.WriteString("INSERT INTO tasks (id, arg1, arg2, operation, expression_id, critical_path) VALUES ")
 
-	args := make([]interface{}, 0, len(tasks)*5)
+	args := make([]interface{}, 0, len(tasks)*6)
 	for i, task := range tasks {
 		if i > 0 {
 			q.WriteString(", ")
 		}
-		q.WriteString(fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)",
-			i*5+1, i*5+2, i*5+3, i*5+4, i*5+5))
+		q.WriteString(fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)",
+			i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6))
 
-		args = append(args, task.ID, task.Arg1, task.Arg2, task.Operation, task.ExpressionId)
+		args = append(args, task.ID, task.Arg1, task.Arg2, task.Operation, task.ExpressionId, task.CriticalPath)
 	}
 
 	_, err := db.ExecContext(ctx, q.String(), args...)
@@ -203,87 +413,352 @@ func GetExpressions(ctx context.Context, db *sql.DB) ([]*model.Expression, error
 
 func GetExpressionByID(ctx context.Context, db *sql.DB, id string) (*model.Expression, error) {
 	var expr model.Expression
-	query := `SELECT id, expression, status, result FROM expressions WHERE id = $1`
+	var deadline, startedAt, completedAt sql.NullInt64
+	query := `SELECT id, expression, status, result, user_id, priority, deadline, replicas,
+		critical_path, started_at, completed_at
+		FROM expressions WHERE id = $1`
 	err := db.QueryRowContext(ctx, query, id).Scan(
 		&expr.ID,
 		&expr.Expression,
 		&expr.Status,
 		&expr.Result,
+		&expr.UserId,
+		&expr.Priority,
+		&deadline,
+		&expr.Replicas,
+		&expr.CriticalPath,
+		&startedAt,
+		&completedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("expression not found")
+			return nil, ErrExpressionNotFound
 		}
 		return nil, fmt.Errorf("failed to get expression: %w", err)
 	}
+	expr.Deadline = deadline.Int64
+	expr.StartedAt = startedAt.Int64
+	expr.CompletedAt = completedAt.Int64
 	return &expr, nil
 }
 
-func GetNextPendingTask(ctx context.Context, db *sql.DB) (*model.Task, error) {
+// ClaimTasks выдаёт до max готовых к вычислению задач под одну аренду.
+// Пока аренда не истекла, эти задачи не выдаются другим агентам, кроме задач
+// выражений с replicas > 1: они выдаются одновременно нескольким разным агентам
+// и только агентам с agentID, иначе один агент мог бы прислать все реплики.
+// Выдаются только задачи с операциями из operations (nil — любые).
+// Если готовых задач нет, возвращается nil.
+func ClaimTasks(ctx context.Context, db *sql.DB, agentID string, operations []string, ordering string, max int, leaseDuration time.Duration) (*model.Lease, error) {
+	var allowed sql.NullString
+	if operations != nil {
+		data, err := json.Marshal(operations)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode operations: %w", err)
+		}
+		allowed = sql.NullString{String: string(data), Valid: true}
+	}
+
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	query := `SELECT id, arg1, arg2, operation, expression_id
-			FROM tasks 
-			WHERE result IS NULL 
-			AND arg1 NOT GLOB '*[a-zA-Z]*' 
-			AND arg2 NOT GLOB '*[a-zA-Z]*' 
-			LIMIT 1;`
-
-	var task model.Task
-	err = tx.QueryRowContext(ctx, query).Scan(
-		&task.ID,
-		&task.Arg1,
-		&task.Arg2,
-		&task.Operation,
-		&task.ExpressionId,
-	)
+	// Сначала обслуживаем пользователя, получившего меньше всего задач
+	// за последнее окно с учётом его веса, затем выражения с большим
+	// приоритетом, затем, при упорядочивании по критическому пути, задачи
+	// на самом долгом пути до результата выражения, затем более старые выражения.
+	// Приоритет сравнивается только при равной доле: высокий приоритет
+	// не позволяет пользователю обогнать тех, кто получил меньше задач.
+	query := `SELECT t.id, t.arg1, t.arg2, t.operation, t.expression_id, e.deadline
+			FROM tasks t
+			JOIN expressions e ON e.id = t.expression_id
+			LEFT JOIN users u ON u.id = e.user_id
+			LEFT JOIN (
+				SELECT e2.user_id, COUNT(*) AS served
+				FROM tasks t2 JOIN expressions e2 ON e2.id = t2.expression_id
+				WHERE t2.dispatched_at >= $1
+				GROUP BY e2.user_id
+			) s ON s.user_id = e.user_id
+			WHERE t.result IS NULL 
+			AND e.status = 'in_progress'
+			AND (e.deadline IS NULL OR e.deadline > $2)
+			AND t.arg1 NOT GLOB '*[a-zA-Z]*' 
+			AND t.arg2 NOT GLOB '*[a-zA-Z]*' 
+			AND (
+				SELECT COUNT(*) FROM task_leases l
+				WHERE l.task_id = t.id
+				AND (l.status = 'submitted' OR (l.status = 'active' AND l.expires_at > $2))
+			) < e.replicas
+			AND ($3 IS NULL OR t.operation IN (SELECT value FROM json_each($3)))
+			AND ($4 != '' OR e.replicas = 1)
+			AND ($4 = '' OR NOT EXISTS (
+				SELECT 1 FROM task_leases l
+				WHERE l.task_id = t.id AND l.agent_id = $4
+				AND (l.status = 'submitted' OR (l.status = 'active' AND l.expires_at > $2))
+			))
+			ORDER BY COALESCE(s.served, 0) / COALESCE(u.weight, 1) ASC,
+				e.priority DESC,
+				CASE WHEN $5 = 'critical_path' THEN t.critical_path ELSE 0 END DESC,
+				e.created_at ASC
+			LIMIT $6;`
 
+	now := time.Now()
+	rows, err := tx.QueryContext(ctx, query, now.Add(-fairShareWindow).UnixMilli(), now.UnixMilli(), allowed, agentID, ordering, max)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		return nil, fmt.Errorf("failed to get tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*model.Task
+	for rows.Next() {
+		var task model.Task
+		var deadline sql.NullInt64
+		if err := rows.Scan(&task.ID, &task.Arg1, &task.Arg2, &task.Operation, &task.ExpressionId, &deadline); err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		task.Deadline = deadline.Int64
+		tasks = append(tasks, &task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+	rows.Close()
+
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	lease := &model.Lease{
+		Token:     uuid.New().String(),
+		ExpiresAt: now.Add(leaseDuration).UnixMilli(),
+		Tasks:     tasks,
+	}
+
+	for _, task := range tasks {
+		task.LeaseToken = lease.Token
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO task_leases (token, task_id, agent_id, expires_at, status)
+			VALUES ($1, $2, $3, $4, 'active')`,
+			lease.Token, task.ID, sql.NullString{String: agentID, Valid: agentID != ""}, lease.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lease task: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE tasks SET dispatched_at = $1 WHERE id = $2", now.UnixMilli(), task.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark task as dispatched: %w", err)
 		}
-		fmt.Println(err)
-		return nil, fmt.Errorf("failed to get task: %w", err)
 	}
 
 	if err = tx.Commit(); err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return &task, nil
+	return lease, nil
 }
 
-func UpdateTaskResult(ctx context.Context, db *sql.DB, taskID string, result float64) error {
+// UpdateTaskResults сохраняет результаты нескольких задач в одной транзакции.
+// Отклонённые результаты не мешают сохранить остальные: для каждого результата
+// возвращается ошибка отклонения или nil. Второй результат — ошибка базы данных,
+// при которой не сохраняется ничего.
+func UpdateTaskResults(ctx context.Context, db *sql.DB, results []model.TaskResult) ([]error, error) {
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// 1. Обновляем результат задачи
+	rejections := make([]error, len(results))
+	for i, r := range results {
+		err := updateTaskResult(ctx, tx, r)
+		if IsResultRejection(err) {
+			rejections[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("task %s: %w", r.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return rejections, nil
+}
+
+// IsResultRejection сообщает, что результат отклонён из-за неизвестной задачи,
+// чужой аренды или конфликта с уже сохранённым результатом.
+func IsResultRejection(err error) bool {
+	return errors.Is(err, ErrTaskNotFound) ||
+		errors.Is(err, ErrLeaseMismatch) ||
+		errors.Is(err, ErrResultConflict)
+}
+
+func updateTaskResult(ctx context.Context, tx *sql.Tx, r model.TaskResult) error {
+	taskID, result := r.ID, r.Result
+
+	// 1. Получаем ID, статус, срок выполнения и число реплик выражения
+	var expressionID, expressionStatus string
+	var deadline sql.NullInt64
+	var storedResult sql.NullFloat64
+	var replicas int
+	err := tx.QueryRowContext(ctx, `
+        SELECT t.expression_id, t.result, e.status, e.deadline, e.replicas
+        FROM tasks t JOIN expressions e ON e.id = t.expression_id
+        WHERE t.id = $1`,
+		taskID).Scan(&expressionID, &storedResult, &expressionStatus, &deadline, &replicas)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTaskNotFound
+		}
+		return fmt.Errorf("failed to get expression ID: %w", err)
+	}
+
+	// Результаты нерешённых задач отменённого, просроченного или неудавшегося
+	// выражения просто игнорируем
+	if !storedResult.Valid && isFailedStatus(expressionStatus) {
+		return nil
+	}
+	if !storedResult.Valid && deadline.Valid && deadline.Int64 <= time.Now().UnixMilli() {
+		return nil
+	}
+
+	// Результат принимается только от держателя аренды этой задачи,
+	// в том числе повторный
+	var leaseStatus string
+	var leaseExpiresAt int64
+	var leaseResult sql.NullFloat64
+	err = tx.QueryRowContext(ctx, `
+        SELECT status, expires_at, result FROM task_leases
+        WHERE token = $1 AND task_id = $2`,
+		r.LeaseToken, taskID).Scan(&leaseStatus, &leaseExpiresAt, &leaseResult)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrLeaseMismatch
+		}
+		return fmt.Errorf("failed to get task lease: %w", err)
+	}
+
+	// Повторная отправка того же результата подтверждается без изменений,
+	// другой результат для уже решённой задачи отклоняется
+	if storedResult.Valid {
+		if storedResult.Float64 == result {
+			return nil
+		}
+		if !leaseResult.Valid {
+			if err := rejectLateResult(ctx, tx, r); err != nil {
+				return err
+			}
+		}
+		return ErrResultConflict
+	}
+
+	// По этой аренде результат уже присылался (например, реплика ждёт кворума)
+	if leaseResult.Valid {
+		if leaseResult.Float64 != result {
+			return ErrResultConflict
+		}
+		return nil
+	}
+
+	// Если аренда истекла или освобождена и задача уже выдана другим агентам,
+	// результат принадлежит новым арендам
+	if leaseStatus != "active" || leaseExpiresAt <= time.Now().UnixMilli() {
+		var otherLeases int
+		err = tx.QueryRowContext(ctx, `
+            SELECT COUNT(*) FROM task_leases
+            WHERE task_id = $1 AND token != $2
+            AND (status = 'submitted' OR (status = 'active' AND expires_at > $3))`,
+			taskID, r.LeaseToken, time.Now().UnixMilli()).Scan(&otherLeases)
+		if err != nil {
+			return fmt.Errorf("failed to check task leases: %w", err)
+		}
+		if otherLeases >= replicas {
+			return ErrLeaseMismatch
+		}
+	}
+
+	// 2. Засчитываем голос аренды и проверяем, набран ли кворум
+	_, err = tx.ExecContext(ctx, `
+        UPDATE task_leases SET status = 'submitted', result = $1
+        WHERE token = $2 AND task_id = $3`,
+		result, r.LeaseToken, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to record task result: %w", err)
+	}
+
+	// Голоса одного агента по разным арендам считаются одним голосом
+	var votes, agreeing int
+	err = tx.QueryRowContext(ctx, `
+        SELECT COUNT(DISTINCT COALESCE(agent_id, token)),
+            COUNT(DISTINCT CASE WHEN result = $1 THEN COALESCE(agent_id, token) END)
+        FROM task_leases
+        WHERE task_id = $2 AND status = 'submitted'`,
+		result, taskID).Scan(&votes, &agreeing)
+	if err != nil {
+		return fmt.Errorf("failed to count task results: %w", err)
+	}
+
+	if agreeing < quorum(replicas) {
+		if votes >= replicas {
+			return disputeTask(ctx, tx, taskID, expressionID)
+		}
+		return nil
+	}
+
+	// 3. Кворум набран - сохраняем результат задачи
 	_, err = tx.ExecContext(ctx, `
         UPDATE tasks 
         SET result = $1, status = 'completed' 
         WHERE id = $2`,
-		result, taskID)
+		formatResult(result), taskID)
 	if err != nil {
 		return fmt.Errorf("failed to update task result: %w", err)
 	}
 
-	// 2. Получаем ID выражения
-	var expressionID string
-	err = tx.QueryRowContext(ctx, `
-        SELECT expression_id FROM tasks WHERE id = $1`,
-		taskID).Scan(&expressionID)
+	// Агенты, чьи результаты (в том числе в спорных раундах) разошлись
+	// с принятым, теряют репутацию
+	_, err = tx.ExecContext(ctx, `
+        UPDATE agents SET tasks_completed = tasks_completed + 1
+        WHERE id IN (
+            SELECT agent_id FROM task_leases
+            WHERE task_id = $1 AND status IN ('submitted', 'disputed') AND result = $2
+        )`,
+		taskID, result)
 	if err != nil {
-		return fmt.Errorf("failed to get expression ID: %w", err)
+		return fmt.Errorf("failed to update agent stats: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        UPDATE agents SET results_disputed = results_disputed + 1
+        WHERE id IN (
+            SELECT agent_id FROM task_leases
+            WHERE task_id = $1 AND status IN ('submitted', 'disputed') AND result != $2
+        )`,
+		taskID, result)
+	if err != nil {
+		return fmt.Errorf("failed to update agent reputation: %w", err)
 	}
 
-	// 3. Обновляем зависимости в других задачах
+	_, err = tx.ExecContext(ctx, `
+        UPDATE task_leases
+        SET status = CASE
+            WHEN result = $1 THEN 'completed'
+            WHEN result IS NOT NULL THEN 'rejected'
+            ELSE 'released'
+        END
+        WHERE task_id = $2 AND status IN ('active', 'submitted', 'disputed')`,
+		result, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to complete task lease: %w", err)
+	}
+
+	// 4. Обновляем зависимости в других задачах, в том числе в выражениях,
+	// ссылающихся на это выражение
 	_, err = tx.ExecContext(ctx, `
         UPDATE tasks
         SET 
@@ -295,15 +770,14 @@ func UpdateTaskResult(ctx context.Context, db *sql.DB, taskID string, result flo
                 WHEN arg2 = $1 THEN $2::text 
                 ELSE arg2 
             END
-        WHERE expression_id = $3 
-        AND result IS NULL
+        WHERE result IS NULL
         AND (arg1 = $1 OR arg2 = $1)`,
-		taskID, fmt.Sprintf("%g", result), expressionID)
+		taskID, formatResult(result))
 	if err != nil {
 		return fmt.Errorf("failed to update dependent tasks: %w", err)
 	}
 
-	// 4. Проверяем, все ли задачи выражения выполнены
+	// 5. Проверяем, все ли задачи выражения выполнены
 	var pendingTasks int
 	err = tx.QueryRowContext(ctx, `
         SELECT COUNT(*) FROM tasks 
@@ -313,25 +787,276 @@ func UpdateTaskResult(ctx context.Context, db *sql.DB, taskID string, result flo
 		return fmt.Errorf("failed to check pending tasks: %w", err)
 	}
 
-	// 5. Если все задачи выполнены - обновляем выражение
+	// 6. Если все задачи выполнены - обновляем выражение
 	if pendingTasks == 0 {
 		var finalResult float64
 		err := tx.QueryRowContext(ctx, `
 			UPDATE expressions 
-			SET status = 'completed', result = (
-				SELECT tasks.result FROM tasks join expressions
-				on tasks.expression_id = expressions.id 
-				where expressions.result = tasks.id
-				LIMIT 1
+			SET status = 'completed', completed_at = $1, result = (
+				SELECT tasks.result FROM tasks
+				WHERE tasks.id = expressions.result
 			) 
-			WHERE id = $1
+			WHERE id = $2
 			RETURNING result`,
-			expressionID).Scan(&finalResult)
+			time.Now().UnixMilli(), expressionID).Scan(&finalResult)
 
 		if err != nil {
 			return fmt.Errorf("failed to update expression and get final result: %w", err)
 		}
 	}
 
+	return nil
+}
+
+// rejectLateResult сохраняет результат, присланный по аренде уже решённой
+// задачи и разошедшийся с принятым: агент опоздавшей реплики теряет репутацию
+// так же, как если бы его результат отверг кворум.
+func rejectLateResult(ctx context.Context, tx *sql.Tx, r model.TaskResult) error {
+	_, err := tx.ExecContext(ctx, `
+        UPDATE task_leases SET status = 'rejected', result = $1
+        WHERE token = $2 AND task_id = $3`,
+		r.Result, r.LeaseToken, r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record late task result: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        UPDATE agents SET results_disputed = results_disputed + 1
+        WHERE id = (SELECT agent_id FROM task_leases WHERE token = $1 AND task_id = $2)`,
+		r.LeaseToken, r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update agent reputation: %w", err)
+	}
+	return nil
+}
+
+// quorum возвращает число совпадающих результатов, при котором результат
+// задачи с заданным числом реплик принимается.
+func quorum(replicas int) int {
+	return replicas/2 + 1
+}
+
+// formatResult записывает результат задачи без экспоненты: результаты
+// подставляются в аргументы других задач, а те выдаются агентам,
+// только когда аргументы — числа без букв.
+func formatResult(result float64) string {
+	return strconv.FormatFloat(result, 'f', -1, 64)
+}
+
+// disputeTask помечает задачу спорной, если реплики не набрали кворум.
+// Голоса раунда сохраняются, чтобы после повторного запуска учесть
+// расхождения в репутации агентов, а задача снова выдаётся агентам.
+// После maxTaskDisputes спорных раундов задача завершается неудачей.
+func disputeTask(ctx context.Context, tx *sql.Tx, taskID, expressionID string) error {
+	var disputes int
+	err := tx.QueryRowContext(ctx, `
+        UPDATE tasks SET status = 'disputed', disputes = disputes + 1
+        WHERE id = $1
+        RETURNING disputes`,
+		taskID).Scan(&disputes)
+	if err != nil {
+		return fmt.Errorf("failed to mark task as disputed: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        UPDATE task_leases SET status = 'disputed'
+        WHERE task_id = $1 AND status = 'submitted'`,
+		taskID)
+	if err != nil {
+		return fmt.Errorf("failed to mark task results as disputed: %w", err)
+	}
+
+	if disputes >= maxTaskDisputes {
+		log.Printf("Task %s is disputed %d times: replicas never agreed on the result", taskID, disputes)
+		return failTask(ctx, tx, taskID, expressionID)
+	}
+
+	log.Printf("Task %s is disputed: replicas did not agree on the result, re-running", taskID)
+	return nil
+}
+
+func CancelExpression(ctx context.Context, db *sql.DB, id string, userID int) error {
+	var ownerID int
+	var status string
+	err := db.QueryRowContext(ctx,
+		"SELECT user_id, status FROM expressions WHERE id = $1", id).Scan(&ownerID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrExpressionNotFound
+		}
+		return fmt.Errorf("failed to get expression: %w", err)
+	}
+	if ownerID != userID {
+		return ErrExpressionNotFound
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE expressions SET status = 'cancelled'
+		WHERE id = $1 AND status IN ('pending', 'waiting_admission', 'in_progress')`,
+		id)
+	if err != nil {
+		return fmt.Errorf("failed to cancel expression: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to cancel expression: %w", err)
+	}
+	if affected == 0 {
+		return ErrExpressionFinished
+	}
+
+	// Выражения, ссылающиеся на отменённое, уже не получат результат
+	if err := failDependentExpressions(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func SetUserWeight(ctx context.Context, db *sql.DB, userID int64, weight float64) error {
+	result, err := db.ExecContext(ctx, "UPDATE users SET weight = $1 WHERE id = $2", weight, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update user weight: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update user weight: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// SetAdmins отмечает администраторами пользователей с именами из names и
+// снимает отметку с остальных. Возвращает число администраторов.
+func SetAdmins(ctx context.Context, db *sql.DB, names []string) (int64, error) {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode admin names: %w", err)
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE users SET is_admin = (name IN (SELECT value FROM json_each($1)))", string(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to update admins: %w", err)
+	}
+
+	var count int64
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE is_admin = 1").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count admins: %w", err)
+	}
+	return count, nil
+}
+
+// IsAdmin сообщает, отмечен ли пользователь администратором.
+func IsAdmin(ctx context.Context, db *sql.DB, userID int) (bool, error) {
+	var admin bool
+	err := db.QueryRowContext(ctx, "SELECT is_admin FROM users WHERE id = $1", userID).Scan(&admin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrUserNotFound
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check admin: %w", err)
+	}
+	return admin, nil
+}
+
+// ExpireExpressions переводит в статус timed_out выражения, срок выполнения
+// которых истёк, и возвращает их количество.
+func ExpireExpressions(ctx context.Context, db *sql.DB) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE expressions SET status = 'timed_out'
+		WHERE status IN ('pending', 'waiting_admission', 'in_progress')
+		AND deadline IS NOT NULL
+		AND deadline <= $1
+		RETURNING id`,
+		time.Now().UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire expressions: %w", err)
+	}
+
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan expression: %w", err)
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	// Выражения, ссылающиеся на просроченные, уже не получат результат
+	if err := failDependentExpressions(ctx, tx, expired...); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return int64(len(expired)), nil
+}
+
+func GetOperationTimings(ctx context.Context, db *sql.DB) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT operation, duration_ms FROM operation_timings")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch operation timings: %w", err)
+	}
+	defer rows.Close()
+
+	timings := make(map[string]int)
+	for rows.Next() {
+		var operation string
+		var durationMS int
+		if err := rows.Scan(&operation, &durationMS); err != nil {
+			return nil, fmt.Errorf("failed to scan operation timing: %w", err)
+		}
+		timings[operation] = durationMS
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return timings, nil
+}
+
+func SetOperationTimings(ctx context.Context, db *sql.DB, timings map[string]int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for operation, durationMS := range timings {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO operation_timings (operation, duration_ms) VALUES ($1, $2)
+			ON CONFLICT (operation) DO UPDATE SET duration_ms = excluded.duration_ms`,
+			operation, durationMS)
+		if err != nil {
+			return fmt.Errorf("failed to save operation timing: %w", err)
+		}
+	}
+
 	return tx.Commit()
 }
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Окно, за которое считается число отправленных пользователем выражений.
+const rateLimitWindow = time.Minute
+
+var (
+	ErrRateLimitExceeded    = errors.New("expressions per minute limit exceeded")
+	ErrPendingTasksExceeded = errors.New("pending tasks limit exceeded")
+)
+
+// Quota — лимиты, которые проверяются при сохранении выражения. 0 — без ограничения.
+type Quota struct {
+	ExpressionsPerMinute int
+	MaxPendingTasks      int
+}
+
+// querier — *sql.DB или *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func GetUserLimits(ctx context.Context, db *sql.DB, userID int64) (*model.UserLimits, error) {
+	var perMinute, pendingTasks, expressionLength sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT max_expressions_per_minute, max_pending_tasks, max_expression_length
+		FROM users WHERE id = $1`,
+		userID).Scan(&perMinute, &pendingTasks, &expressionLength)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user limits: %w", err)
+	}
+
+	return &model.UserLimits{
+		ExpressionsPerMinute: nullIntPtr(perMinute),
+		MaxPendingTasks:      nullIntPtr(pendingTasks),
+		MaxExpressionLength:  nullIntPtr(expressionLength),
+	}, nil
+}
+
+// SetUserLimits заменяет персональные лимиты пользователя.
+// Незаданные (nil) лимиты возвращаются к значениям по умолчанию.
+func SetUserLimits(ctx context.Context, db *sql.DB, userID int64, limits *model.UserLimits) error {
+	result, err := db.ExecContext(ctx, `
+		UPDATE users SET
+			max_expressions_per_minute = $1,
+			max_pending_tasks = $2,
+			max_expression_length = $3
+		WHERE id = $4`,
+		intPtrNull(limits.ExpressionsPerMinute),
+		intPtrNull(limits.MaxPendingTasks),
+		intPtrNull(limits.MaxExpressionLength),
+		userID)
+	if err != nil {
+		return fmt.Errorf("failed to update user limits: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update user limits: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// GetUserUsage возвращает число выражений пользователя за последнюю минуту
+// и число ещё не решённых задач его незавершённых выражений.
+func GetUserUsage(ctx context.Context, db *sql.DB, userID int64) (*model.UserUsage, error) {
+	return userUsage(ctx, db, userID)
+}
+
+// InsertExpressionWithinQuota сохраняет выражение из tasks задач, если
+// пользователь не превысил лимиты quota, иначе возвращает ErrRateLimitExceeded
+// или ErrPendingTasksExceeded. Возвращает потребление с учётом этого выражения.
+// Транзакция начинается со вставки и сразу берёт блокировку записи, поэтому
+// одновременные запросы пользователя проверяются по очереди и не проходят
+// лимит вместе.
+func InsertExpressionWithinQuota(ctx context.Context, db *sql.DB, expr *model.Expression, tasks int, quota Quota) (*model.UserUsage, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertExpression(ctx, tx, expr, tasks); err != nil {
+		return nil, err
+	}
+
+	usage, err := userUsage(ctx, tx, int64(expr.UserId))
+	if err != nil {
+		return nil, err
+	}
+	if quota.ExpressionsPerMinute > 0 && usage.ExpressionsLastMinute > quota.ExpressionsPerMinute {
+		return usage, ErrRateLimitExceeded
+	}
+	if quota.MaxPendingTasks > 0 && usage.PendingTasks > quota.MaxPendingTasks {
+		return usage, ErrPendingTasksExceeded
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return usage, nil
+}
+
+// userUsage считает потребление лимитов пользователем. Для выражений, задачи
+// которых ещё не созданы (ожидающих допуска или только что сохранённых)
+// или хранятся в очереди в памяти, а не в базе, нерешёнными считаются
+// все их задачи.
+func userUsage(ctx context.Context, db querier, userID int64) (*model.UserUsage, error) {
+	var usage model.UserUsage
+	var oldest sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), MIN(created_at) FROM expressions
+		WHERE user_id = $1 AND created_at > $2`,
+		userID, time.Now().Add(-rateLimitWindow).UnixMilli()).Scan(&usage.ExpressionsLastMinute, &oldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count user expressions: %w", err)
+	}
+	usage.OldestInWindow = oldest.Int64
+
+	err = db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(CASE
+			WHEN EXISTS (SELECT 1 FROM tasks t WHERE t.expression_id = e.id)
+			THEN (SELECT COUNT(*) FROM tasks t WHERE t.expression_id = e.id AND t.result IS NULL)
+			ELSE e.task_count
+		END), 0)
+		FROM expressions e
+		WHERE e.user_id = $1
+		AND e.status IN ('pending', 'waiting_admission', 'in_progress')`,
+		userID).Scan(&usage.PendingTasks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count user pending tasks: %w", err)
+	}
+
+	return &usage, nil
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	i := int(v.Int64)
+	return &i
+}
+
+func intPtrNull(v *int) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*v), Valid: true}
+}
@@ -0,0 +1,222 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// GetStalledExpressions возвращает выражения, задачи которых не были
+// поставлены в очередь из-за остановки оркестратора: оставшиеся в статусе
+// pending и вычисляемые выражения без единой задачи. Просроченные выражения
+// не возвращаются, их завершает ExpireExpressions.
+func GetStalledExpressions(ctx context.Context, db *sql.DB) ([]*model.Expression, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, expression, status, user_id, priority, created_at, deadline, replicas, schedule_id
+		FROM expressions e
+		WHERE (e.status = 'pending'
+			OR (e.status = 'in_progress' AND NOT EXISTS (SELECT 1 FROM tasks t WHERE t.expression_id = e.id)))
+		AND (e.deadline IS NULL OR e.deadline > $1)
+		ORDER BY e.created_at ASC`,
+		time.Now().UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch stalled expressions: %w", err)
+	}
+	defer rows.Close()
+
+	var expressions []*model.Expression
+	for rows.Next() {
+		var expr model.Expression
+		var deadline sql.NullInt64
+		var scheduleID sql.NullString
+		err := rows.Scan(&expr.ID, &expr.Expression, &expr.Status, &expr.UserId, &expr.Priority,
+			&expr.CreatedAt, &deadline, &expr.Replicas, &scheduleID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan expression: %w", err)
+		}
+		expr.Deadline = deadline.Int64
+		expr.ScheduleID = scheduleID.String
+		expressions = append(expressions, &expr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return expressions, nil
+}
+
+// DeleteExpressionTasks удаляет задачи выражения вместе с их арендами,
+// чтобы заново разбить выражение на задачи.
+func DeleteExpressionTasks(ctx context.Context, db *sql.DB, expressionID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM task_leases
+		WHERE task_id IN (SELECT id FROM tasks WHERE expression_id = $1)`,
+		expressionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete task leases: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM tasks WHERE expression_id = $1", expressionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete tasks: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ResolveSolvedDependencies подставляет в нерешённые задачи результаты
+// уже решённых задач, от которых они зависят, и возвращает число исправленных задач.
+func ResolveSolvedDependencies(ctx context.Context, db *sql.DB) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	resolved, err := resolveDependencies(ctx, tx, "")
+	if err != nil {
+		return 0, err
+	}
+	return resolved, tx.Commit()
+}
+
+// resolveDependencies подставляет результаты решённых задач в аргументы
+// нерешённых задач выражения expressionID (всех выражений, если он пуст)
+// и возвращает число исправленных задач. Результат форматируется заново:
+// записанный в старых версиях текст мог содержать экспоненту (1.0e+21),
+// а задачи с такими аргументами не выдаются агентам.
+func resolveDependencies(ctx context.Context, tx *sql.Tx, expressionID string) (int64, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT t.id, r.id, r.result FROM tasks t
+		JOIN tasks r ON r.id IN (t.arg1, t.arg2)
+		WHERE t.result IS NULL AND r.result IS NOT NULL
+		AND ($1 = '' OR t.expression_id = $1)`,
+		expressionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get solved dependencies: %w", err)
+	}
+
+	type dependency struct {
+		taskID, depID string
+		result        float64
+	}
+	var dependencies []dependency
+	for rows.Next() {
+		var d dependency
+		if err := rows.Scan(&d.taskID, &d.depID, &d.result); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan dependency: %w", err)
+		}
+		dependencies = append(dependencies, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	resolved := make(map[string]bool)
+	for _, d := range dependencies {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE tasks SET
+				arg1 = CASE WHEN arg1 = $1 THEN $2 ELSE arg1 END,
+				arg2 = CASE WHEN arg2 = $1 THEN $2 ELSE arg2 END
+			WHERE id = $3`,
+			d.depID, formatResult(d.result), d.taskID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to resolve task dependency: %w", err)
+		}
+		resolved[d.taskID] = true
+	}
+	return int64(len(resolved)), nil
+}
+
+// FinalizeSolvedExpressions завершает вычисляемые выражения, все задачи
+// которых уже решены, и возвращает их число.
+func FinalizeSolvedExpressions(ctx context.Context, db *sql.DB) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		UPDATE expressions
+		SET status = 'completed', completed_at = $1, result = (
+			SELECT tasks.result FROM tasks
+			WHERE tasks.id = expressions.result
+		)
+		WHERE status = 'in_progress'
+		AND EXISTS (SELECT 1 FROM tasks t WHERE t.id = expressions.result AND t.result IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM tasks t WHERE t.expression_id = expressions.id AND t.result IS NULL)`,
+		time.Now().UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("failed to finalize expressions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// ReleaseAgentLeases освобождает действующие аренды агентов, для которых
+// orphaned возвращает true, чтобы их задачи сразу выдались другим агентам.
+// Аренды агентов без ID (HTTP без agent_id) не освобождаются: жив ли такой
+// агент, неизвестно, и его аренды освободятся по истечении.
+// Возвращает число освобождённых аренд.
+func ReleaseAgentLeases(ctx context.Context, db *sql.DB, orphaned func(agentID string) bool) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT agent_id FROM task_leases
+		WHERE status = 'active' AND agent_id IS NOT NULL AND expires_at > $1`,
+		time.Now().UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch lease holders: %w", err)
+	}
+	var agentIDs []string
+	for rows.Next() {
+		var agentID string
+		if err := rows.Scan(&agentID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan lease holder: %w", err)
+		}
+		if orphaned(agentID) {
+			agentIDs = append(agentIDs, agentID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+	rows.Close()
+	if len(agentIDs) == 0 {
+		return 0, nil
+	}
+
+	data, err := json.Marshal(agentIDs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode agent ids: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, `
+		UPDATE task_leases SET status = 'released'
+		WHERE status = 'active' AND agent_id IN (SELECT value FROM json_each($1))`,
+		string(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to release agent leases: %w", err)
+	}
+	released, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to release agent leases: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return int(released), nil
+}
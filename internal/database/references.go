@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// LinkExpressionRefs запоминает выражения, на результаты которых ссылается
+// выражение expressionID. Если какое-то из них уже вычислено, его результат
+// сразу подставляется в задачи, а если завершилось неудачей, выражение
+// тоже помечается неудавшимся.
+func LinkExpressionRefs(ctx context.Context, db *sql.DB, expressionID string, refs []string) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	failed := false
+	for _, ref := range refs {
+		_, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO expression_refs (expression_id, ref_expression_id)
+			VALUES ($1, $2)`,
+			expressionID, ref)
+		if err != nil {
+			return fmt.Errorf("failed to save expression reference: %w", err)
+		}
+
+		var status string
+		err = tx.QueryRowContext(ctx, "SELECT status FROM expressions WHERE id = $1", ref).Scan(&status)
+		if err != nil {
+			return fmt.Errorf("failed to get referenced expression: %w", err)
+		}
+		if isFailedStatus(status) {
+			failed = true
+		}
+	}
+
+	// Ссылка могла завершиться, пока выражение сохранялось
+	if _, err := resolveDependencies(ctx, tx, expressionID); err != nil {
+		return err
+	}
+
+	if failed {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE expressions SET status = 'failed' WHERE id = $1", expressionID)
+		if err != nil {
+			return fmt.Errorf("failed to fail expression: %w", err)
+		}
+		if err := failDependentExpressions(ctx, tx, expressionID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// isFailedStatus сообщает, что выражение уже не получит результат.
+func isFailedStatus(status string) bool {
+	return status == "cancelled" || status == "timed_out" || status == "failed"
+}
+
+// failDependentExpressions помечает неудавшимися незавершённые выражения,
+// которые прямо или через другие выражения ссылаются на выражения ids.
+func failDependentExpressions(ctx context.Context, tx *sql.Tx, ids ...string) error {
+	for len(ids) > 0 {
+		id := ids[0]
+		ids = ids[1:]
+
+		rows, err := tx.QueryContext(ctx, `
+			SELECT e.id FROM expression_refs r
+			JOIN expressions e ON e.id = r.expression_id
+			WHERE r.ref_expression_id = $1
+			AND e.status IN ('pending', 'waiting_admission', 'in_progress')`,
+			id)
+		if err != nil {
+			return fmt.Errorf("failed to get dependent expressions: %w", err)
+		}
+
+		var dependents []string
+		for rows.Next() {
+			var dependent string
+			if err := rows.Scan(&dependent); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan dependent expression: %w", err)
+			}
+			dependents = append(dependents, dependent)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error occurred during rows iteration: %w", err)
+		}
+
+		for _, dependent := range dependents {
+			_, err := tx.ExecContext(ctx,
+				"UPDATE expressions SET status = 'failed' WHERE id = $1", dependent)
+			if err != nil {
+				return fmt.Errorf("failed to fail dependent expression: %w", err)
+			}
+			log.Printf("Expression %s failed: referenced expression %s failed", dependent, id)
+		}
+		ids = append(ids, dependents...)
+	}
+
+	return nil
+}
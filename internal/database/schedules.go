@@ -0,0 +1,173 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+const scheduleColumns = `id, user_id, expression, cron, interval_ms, priority, replicas,
+	timeout_ms, status, created_at, next_run_at, last_run_at`
+
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*model.Schedule, error) {
+	var s model.Schedule
+	var cron sql.NullString
+	var interval, nextRun, lastRun sql.NullInt64
+	err := row.Scan(&s.ID, &s.UserId, &s.Expression, &cron, &interval, &s.Priority, &s.Replicas,
+		&s.TimeoutMs, &s.Status, &s.CreatedAt, &nextRun, &lastRun)
+	if err != nil {
+		return nil, err
+	}
+	s.Cron = cron.String
+	s.IntervalMs = interval.Int64
+	s.NextRunAt = nextRun.Int64
+	s.LastRunAt = lastRun.Int64
+	return &s, nil
+}
+
+func InsertSchedule(ctx context.Context, db *sql.DB, s *model.Schedule) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO schedules (id, user_id, expression, cron, interval_ms, priority, replicas,
+			timeout_ms, status, created_at, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		s.ID, s.UserId, s.Expression,
+		sql.NullString{String: s.Cron, Valid: s.Cron != ""},
+		sql.NullInt64{Int64: s.IntervalMs, Valid: s.IntervalMs > 0},
+		s.Priority, s.Replicas, s.TimeoutMs, s.Status, s.CreatedAt,
+		sql.NullInt64{Int64: s.NextRunAt, Valid: s.NextRunAt > 0})
+	if err != nil {
+		return fmt.Errorf("failed to insert schedule: %w", err)
+	}
+	return nil
+}
+
+func GetSchedules(ctx context.Context, db *sql.DB, userID int) ([]*model.Schedule, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+scheduleColumns+" FROM schedules WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []*model.Schedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return schedules, nil
+}
+
+// GetSchedule возвращает расписание пользователя. Чужие расписания
+// для него не существуют.
+func GetSchedule(ctx context.Context, db *sql.DB, id string, userID int) (*model.Schedule, error) {
+	s, err := scanSchedule(db.QueryRowContext(ctx,
+		"SELECT "+scheduleColumns+" FROM schedules WHERE id = $1", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, fmt.Errorf("failed to get schedule: %w", err)
+	}
+	if s.UserId != userID {
+		return nil, ErrScheduleNotFound
+	}
+	return s, nil
+}
+
+// GetDueSchedules возвращает активные расписания, время запуска которых наступило.
+func GetDueSchedules(ctx context.Context, db *sql.DB, now int64) ([]*model.Schedule, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+scheduleColumns+` FROM schedules
+		WHERE status = 'active' AND next_run_at IS NOT NULL AND next_run_at <= $1
+		ORDER BY next_run_at`,
+		now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch due schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []*model.Schedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return schedules, nil
+}
+
+// UpdateScheduleStatus ставит расписание на паузу или возобновляет его
+// со следующим запуском в nextRunAt.
+func UpdateScheduleStatus(ctx context.Context, db *sql.DB, id string, status string, nextRunAt int64) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE schedules SET status = $1, next_run_at = $2 WHERE id = $3",
+		status, sql.NullInt64{Int64: nextRunAt, Valid: nextRunAt > 0}, id)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+	return nil
+}
+
+// SetScheduleRun запоминает время запуска расписания и время следующего запуска.
+func SetScheduleRun(ctx context.Context, db *sql.DB, id string, lastRunAt, nextRunAt int64) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE schedules SET last_run_at = $1, next_run_at = $2 WHERE id = $3",
+		lastRunAt, sql.NullInt64{Int64: nextRunAt, Valid: nextRunAt > 0}, id)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule run: %w", err)
+	}
+	return nil
+}
+
+// DeleteSchedule удаляет расписание. Уже созданные по нему выражения остаются.
+func DeleteSchedule(ctx context.Context, db *sql.DB, id string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM schedules WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return nil
+}
+
+// GetScheduleRuns возвращает выражения, созданные по расписанию, от новых к старым.
+func GetScheduleRuns(ctx context.Context, db *sql.DB, scheduleID string) ([]*model.Expression, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, expression, status, result, created_at FROM expressions
+		WHERE schedule_id = $1
+		ORDER BY created_at DESC`,
+		scheduleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch schedule runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []*model.Expression
+	for rows.Next() {
+		var expr model.Expression
+		if err := rows.Scan(&expr.ID, &expr.Expression, &expr.Status, &expr.Result, &expr.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan expression: %w", err)
+		}
+		runs = append(runs, &expr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ExtendLease продлевает действующую аренду так, чтобы она истекала
+// не раньше чем через d, и возвращает новый срок аренды.
+func ExtendLease(ctx context.Context, db *sql.DB, token string, d time.Duration) (int64, error) {
+	now := time.Now()
+	var expiresAt int64
+	err := db.QueryRowContext(ctx, `
+		UPDATE task_leases SET expires_at = MAX(expires_at, $1)
+		WHERE token = $2 AND status = 'active' AND expires_at > $3
+		RETURNING expires_at`,
+		now.Add(d).UnixMilli(), token, now.UnixMilli()).Scan(&expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrLeaseNotFound
+		}
+		return 0, fmt.Errorf("failed to extend lease: %w", err)
+	}
+	return expiresAt, nil
+}
+
+// ReleaseLease освобождает действующую аренду задач taskIDs (всех задач
+// аренды, если taskIDs пуст) и возвращает число освобождённых задач.
+func ReleaseLease(ctx context.Context, db *sql.DB, token string, taskIDs []string) (int, error) {
+	var ids sql.NullString
+	if len(taskIDs) > 0 {
+		encoded, err := json.Marshal(taskIDs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode task ids: %w", err)
+		}
+		ids = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE task_leases SET status = 'released'
+		WHERE token = $1 AND status = 'active' AND expires_at > $2
+		AND ($3 IS NULL OR task_id IN (SELECT value FROM json_each($3)))`,
+		token, time.Now().UnixMilli(), ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release lease: %w", err)
+	}
+
+	released, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if released == 0 {
+		return 0, ErrLeaseNotFound
+	}
+	return int(released), nil
+}
+
+// ReleaseExpressionLeases освобождает действующие аренды задач выражения.
+func ReleaseExpressionLeases(ctx context.Context, db *sql.DB, expressionID string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE task_leases SET status = 'released'
+		WHERE status = 'active'
+		AND task_id IN (SELECT id FROM tasks WHERE expression_id = $1)`,
+		expressionID)
+	if err != nil {
+		return fmt.Errorf("failed to release expression leases: %w", err)
+	}
+	return nil
+}
+
+// FailTask отмечает, что задачу невозможно вычислить (например, при делении
+// на ноль). Выражение задачи и ссылающиеся на него выражения помечаются
+// неудавшимися. Сообщить о неудаче может только держатель аренды задачи.
+func FailTask(ctx context.Context, db *sql.DB, taskID, leaseToken string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var expressionID string
+	var storedResult sql.NullFloat64
+	err = tx.QueryRowContext(ctx,
+		"SELECT expression_id, result FROM tasks WHERE id = $1", taskID).Scan(&expressionID, &storedResult)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTaskNotFound
+		}
+		return fmt.Errorf("failed to get task: %w", err)
+	}
+	if storedResult.Valid {
+		return ErrResultConflict
+	}
+
+	var leases int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM task_leases
+		WHERE token = $1 AND task_id = $2 AND status = 'active'`,
+		leaseToken, taskID).Scan(&leases)
+	if err != nil {
+		return fmt.Errorf("failed to get task lease: %w", err)
+	}
+	if leases == 0 {
+		return ErrLeaseMismatch
+	}
+
+	if err := failTask(ctx, tx, taskID, expressionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// failTask завершает неудачей задачу, её выражение и выражения,
+// ссылающиеся на него, и освобождает аренды задачи.
+func failTask(ctx context.Context, tx *sql.Tx, taskID, expressionID string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE tasks SET status = 'failed' WHERE id = $1", taskID)
+	if err != nil {
+		return fmt.Errorf("failed to fail task: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE task_leases SET status = 'released'
+		WHERE task_id = $1 AND status IN ('active', 'submitted')`,
+		taskID)
+	if err != nil {
+		return fmt.Errorf("failed to release task leases: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE expressions SET status = 'failed'
+		WHERE id = $1 AND status = 'in_progress'`,
+		expressionID)
+	if err != nil {
+		return fmt.Errorf("failed to fail expression: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to fail expression: %w", err)
+	}
+	if affected > 0 {
+		log.Printf("Expression %s failed: task %s cannot be computed", expressionID, taskID)
+		if err := failDependentExpressions(ctx, tx, expressionID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetTaskOperations возвращает операции нерешённых задач выражения.
+func GetTaskOperations(ctx context.Context, db *sql.DB, expressionID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT operation FROM tasks
+		WHERE expression_id = $1 AND result IS NULL
+		ORDER BY operation`,
+		expressionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task operations: %w", err)
+	}
+	defer rows.Close()
+
+	var operations []string
+	for rows.Next() {
+		var operation string
+		if err := rows.Scan(&operation); err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %w", err)
+		}
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred during rows iteration: %w", err)
+	}
+
+	return operations, nil
+}
+
+// CountExpressionDisputes возвращает, сколько раз реплики задач выражения
+// расходились в результатах.
+func CountExpressionDisputes(ctx context.Context, db *sql.DB, expressionID string) (int, error) {
+	var disputes int
+	err := db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(disputes), 0) FROM tasks WHERE expression_id = $1",
+		expressionID).Scan(&disputes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count disputes: %w", err)
+	}
+	return disputes, nil
+}
+
+// CompleteExpression сохраняет результат вычисленного выражения.
+func CompleteExpression(ctx context.Context, db *sql.DB, id string, result float64) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE expressions SET status = 'completed', result = $1, completed_at = $2
+		WHERE id = $3 AND status IN ('pending', 'waiting_admission', 'in_progress')`,
+		formatResult(result), time.Now().UnixMilli(), id)
+	if err != nil {
+		return fmt.Errorf("failed to complete expression: %w", err)
+	}
+	return nil
+}
+
+// RecordAgentResults учитывает в статистике агентов принятые (agreed)
+// и отвергнутые кворумом реплик (disputed) результаты.
+func RecordAgentResults(ctx context.Context, db *sql.DB, agreed, disputed []string) error {
+	for _, id := range agreed {
+		_, err := db.ExecContext(ctx,
+			"UPDATE agents SET tasks_completed = tasks_completed + 1 WHERE id = $1", id)
+		if err != nil {
+			return fmt.Errorf("failed to update agent stats: %w", err)
+		}
+	}
+	for _, id := range disputed {
+		_, err := db.ExecContext(ctx,
+			"UPDATE agents SET results_disputed = results_disputed + 1 WHERE id = $1", id)
+		if err != nil {
+			return fmt.Errorf("failed to update agent reputation: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetUserWeight возвращает вес пользователя при справедливом распределении задач.
+func GetUserWeight(ctx context.Context, db *sql.DB, userID int) (float64, error) {
+	var weight float64
+	err := db.QueryRowContext(ctx, "SELECT weight FROM users WHERE id = $1", userID).Scan(&weight)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 1, nil
+		}
+		return 0, fmt.Errorf("failed to get user weight: %w", err)
+	}
+	return weight, nil
+}
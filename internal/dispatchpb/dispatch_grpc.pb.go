@@ -0,0 +1,142 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v25.3.0
+// source: dispatch.proto
+
+package dispatchpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Dispatch_Connect_FullMethodName = "/calc.dispatch.v1.Dispatch/Connect"
+)
+
+// DispatchClient is the client API for Dispatch service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DispatchClient interface {
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Dispatch_ConnectClient, error)
+}
+
+type dispatchClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDispatchClient(cc grpc.ClientConnInterface) DispatchClient {
+	return &dispatchClient{cc}
+}
+
+func (c *dispatchClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Dispatch_ConnectClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Dispatch_ServiceDesc.Streams[0], Dispatch_Connect_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dispatchConnectClient{ClientStream: stream}
+	return x, nil
+}
+
+type Dispatch_ConnectClient interface {
+	Send(*AgentMessage) error
+	Recv() (*OrchestratorMessage, error)
+	grpc.ClientStream
+}
+
+type dispatchConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *dispatchConnectClient) Send(m *AgentMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *dispatchConnectClient) Recv() (*OrchestratorMessage, error) {
+	m := new(OrchestratorMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DispatchServer is the server API for Dispatch service.
+// All implementations must embed UnimplementedDispatchServer
+// for forward compatibility
+type DispatchServer interface {
+	Connect(Dispatch_ConnectServer) error
+	mustEmbedUnimplementedDispatchServer()
+}
+
+// UnimplementedDispatchServer must be embedded to have forward compatible implementations.
+type UnimplementedDispatchServer struct {
+}
+
+func (UnimplementedDispatchServer) Connect(Dispatch_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedDispatchServer) mustEmbedUnimplementedDispatchServer() {}
+
+// UnsafeDispatchServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DispatchServer will
+// result in compilation errors.
+type UnsafeDispatchServer interface {
+	mustEmbedUnimplementedDispatchServer()
+}
+
+func RegisterDispatchServer(s grpc.ServiceRegistrar, srv DispatchServer) {
+	s.RegisterService(&Dispatch_ServiceDesc, srv)
+}
+
+func _Dispatch_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DispatchServer).Connect(&dispatchConnectServer{ServerStream: stream})
+}
+
+type Dispatch_ConnectServer interface {
+	Send(*OrchestratorMessage) error
+	Recv() (*AgentMessage, error)
+	grpc.ServerStream
+}
+
+type dispatchConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *dispatchConnectServer) Send(m *OrchestratorMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *dispatchConnectServer) Recv() (*AgentMessage, error) {
+	m := new(AgentMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Dispatch_ServiceDesc is the grpc.ServiceDesc for Dispatch service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Dispatch_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "calc.dispatch.v1.Dispatch",
+	HandlerType: (*DispatchServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Dispatch_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "dispatch.proto",
+}
@@ -0,0 +1,5 @@
+// Package dispatchpb содержит код gRPC-сервиса Dispatch, сгенерированный
+// из dispatch.proto.
+package dispatchpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative dispatch.proto
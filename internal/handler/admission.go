@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Сколько ожидающих выражений допускается к вычислению за один проход.
+const admissionBatch = 100
+
+// maxQueuedTasks возвращает глобальный лимит нерешённых задач (0 — без ограничения).
+func maxQueuedTasks() int {
+	return getEnvInt("MAX_QUEUED_TASKS", 10000)
+}
+
+// admissionMode возвращает, что делать с выражением при переполненной очереди:
+// reject — отклонять с кодом 503, queue — сохранять в статусе waiting_admission.
+func admissionMode() string {
+	if mode := os.Getenv("ADMISSION_MODE"); mode != "" {
+		return mode
+	}
+	return "reject"
+}
+
+// admissionError — выражение отклонено, потому что очередь задач переполнена.
+type admissionError struct {
+	retryAfter time.Duration
+}
+
+func (e *admissionError) Error() string {
+	return "task queue is full"
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// checkAdmission проверяет, можно ли поставить в очередь ещё tasks задач,
+// и если нельзя, оценивает время ожидания. Если fifo, новое выражение
+// не обгоняет выражения, уже ожидающие допуска.
+func checkAdmission(ctx context.Context, tasks int, fifo bool) (bool, time.Duration, error) {
+	limit := maxQueuedTasks()
+	if limit <= 0 {
+		return true, 0, nil
+	}
+
+	queued, err := taskQueue.Depth(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if fifo {
+		waiting, err := store.CountWaitingExpressions(ctx)
+		if err != nil {
+			return false, 0, err
+		}
+		if waiting > 0 {
+			wait, err := estimateWait(ctx, queued+tasks-limit)
+			return false, wait, err
+		}
+	}
+
+	// Выражение больше всего лимита допускается в пустую очередь,
+	// иначе оно не было бы допущено никогда
+	if queued == 0 || queued+tasks <= limit {
+		return true, 0, nil
+	}
+
+	wait, err := estimateWait(ctx, queued+tasks-limit)
+	return false, wait, err
+}
+
+// estimateWait оценивает, сколько времени нужно живым агентам,
+// чтобы решить excess задач.
+func estimateWait(ctx context.Context, excess int) (time.Duration, error) {
+	workers, err := store.CountAliveWorkers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	timings := currentOperationTimings()
+	total := 0
+	for _, ms := range timings {
+		total += ms
+	}
+	average := time.Duration(total/len(timings)) * time.Millisecond
+
+	rounds := (excess + workers - 1) / workers
+	wait := time.Duration(rounds) * average
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait, nil
+}
+
+// AdmitWaitingExpressions создаёт задачи ожидающих выражений, пока в очереди
+// есть место, и возвращает число допущенных выражений.
+func AdmitWaitingExpressions(ctx context.Context) (int, error) {
+	waiting, err := store.GetWaitingExpressions(ctx, admissionBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	admitted := 0
+	for _, expr := range waiting {
+		tokens := parseExpression(expr.Expression)
+		admit, _, err := checkAdmission(ctx, len(tokens)/2, false)
+		if err != nil {
+			return admitted, err
+		}
+		if !admit {
+			break
+		}
+
+		// Ссылки разрешаются заново: выражения могли вычислиться за время ожидания
+		var refErr *referenceError
+		refs, refsWaiting, err := resolveReferences(ctx, expr.UserId, tokens)
+		if errors.As(err, &refErr) {
+			log.Printf("Expression %s failed: %v", expr.ID, refErr)
+			if err := store.FailExpression(ctx, expr.ID); err != nil {
+				return admitted, err
+			}
+			continue
+		}
+		if err != nil {
+			return admitted, err
+		}
+		// Выражение, на которое оно ссылается, ещё не допущено
+		if refsWaiting {
+			continue
+		}
+
+		if err := startExpression(ctx, expr, tokens, refs); err != nil {
+			return admitted, fmt.Errorf("expression %s: %w", expr.ID, err)
+		}
+		admitted++
+	}
+	return admitted, nil
+}
+
+func GetQueue(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	queued, err := taskQueue.Depth(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get queue depth"})
+		return
+	}
+
+	waiting, err := store.CountWaitingExpressions(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get queue depth"})
+		return
+	}
+
+	// Оценка ожидания для нового выражения из одной задачи
+	_, wait, err := checkAdmission(ctx, 1, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get queue depth"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"queued_tasks":      queued,
+		"max_queued_tasks":  maxQueuedTasks(),
+		"waiting_admission": waiting,
+		"estimated_wait_ms": wait.Milliseconds(),
+		"admission_mode":    admissionMode(),
+	})
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+var agentHeartbeatMS = getEnvInt("AGENT_HEARTBEAT_MS", 5000)
+
+func isSupportedOperation(operation string) bool {
+	for _, op := range supportedOperations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func RegisterAgent(c *gin.Context) {
+	var request struct {
+		ID         string             `json:"id"`
+		Hostname   string             `json:"hostname"`
+		Workers    int                `json:"workers"`
+		Version    string             `json:"version"`
+		Operations []string           `json:"operations"`
+		Throughput map[string]float64 `json:"throughput"`
+		BenchScore float64            `json:"bench_score"`
+	}
+
+	if err := c.BindJSON(&request); err != nil || request.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
+		return
+	}
+
+	agent := &model.Agent{
+		ID:         request.ID,
+		Hostname:   request.Hostname,
+		Workers:    request.Workers,
+		Version:    request.Version,
+		Operations: request.Operations,
+		Throughput: request.Throughput,
+		BenchScore: request.BenchScore,
+	}
+	var agentErr *agentError
+	err := registerAgent(c.Request.Context(), agent)
+	if errors.As(err, &agentErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": agentErr.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register agent"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                    agent.ID,
+		"heartbeat_interval_ms": agentHeartbeatMS,
+	})
+}
+
+func AgentHeartbeat(c *gin.Context) {
+	err := store.AgentHeartbeat(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, database.ErrAgentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update heartbeat"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+func GetAgents(c *gin.Context) {
+	agents, err := store.GetAgents(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch agents"})
+		return
+	}
+
+	if agents == nil {
+		agents = []*model.Agent{}
+	}
+	c.JSON(http.StatusOK, gin.H{"agents": agents})
+}
+
+// MarkDeadAgents помечает мёртвыми агентов, не присылавших heartbeat дольше
+// deadAfter, и возвращает в очередь задачи их аренд. Возвращает число
+// помеченных агентов.
+func MarkDeadAgents(ctx context.Context, deadAfter time.Duration) (int, error) {
+	dead, err := store.MarkDeadAgents(ctx, deadAfter)
+	if err != nil || len(dead) == 0 {
+		return 0, err
+	}
+
+	isDead := make(map[string]bool, len(dead))
+	for _, id := range dead {
+		isDead[id] = true
+	}
+	released, err := taskQueue.ReleaseAgentLeases(ctx, func(agentID string) bool {
+		return isDead[agentID]
+	})
+	if err != nil {
+		return len(dead), err
+	}
+	if released > 0 {
+		notifier.broadcast()
+	}
+	return len(dead), nil
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
+)
+
+// Логика раздачи задач, общая для HTTP и gRPC: оба транспорта только
+// разбирают запросы агента и вызывают функции этого файла.
+
+// agentError — агент сообщил о себе неверные данные.
+type agentError struct {
+	msg string
+}
+
+func (e *agentError) Error() string {
+	return e.msg
+}
+
+// registerAgent проверяет возможности агента и регистрирует его.
+func registerAgent(ctx context.Context, agent *model.Agent) error {
+	for _, op := range agent.Operations {
+		if !isSupportedOperation(op) {
+			return &agentError{fmt.Sprintf("unknown operation: %s", op)}
+		}
+	}
+	for op, value := range agent.Throughput {
+		if !isSupportedOperation(op) || value <= 0 {
+			return &agentError{fmt.Sprintf("invalid throughput for operation: %s", op)}
+		}
+	}
+
+	if agent.BenchScore < 0 || math.IsNaN(agent.BenchScore) || math.IsInf(agent.BenchScore, 0) {
+		return &agentError{"invalid bench score"}
+	}
+
+	if agent.Workers < 1 {
+		agent.Workers = 1
+	}
+
+	return store.RegisterAgent(ctx, agent)
+}
+
+// leaseDuration возвращает время аренды для пачки из n задач: базовый
+// таймаут плюс время самой долгой операции на каждую задачу.
+func leaseDuration(n int) time.Duration {
+	longest := 0
+	for _, op := range supportedOperations {
+		if t := getOperationTime(op); t > longest {
+			longest = t
+		}
+	}
+	return time.Duration(taskLeaseMS+longest*n) * time.Millisecond
+}
+
+// waitForTasks пытается арендовать до max задач, ожидая их появления не дольше wait.
+func waitForTasks(ctx context.Context, agentID string, max int, wait time.Duration) (*model.Lease, error) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	// Агенту выдаются только задачи с поддерживаемыми им операциями
+	operations, err := store.GetAgentOperations(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	req := queue.ClaimRequest{
+		AgentID:       agentID,
+		Operations:    operations,
+		Ordering:      taskOrdering(),
+		Max:           max,
+		LeaseDuration: leaseDuration(max),
+	}
+
+	for {
+		// Канал берём до попытки, чтобы не пропустить уведомление между ними
+		ready := notifier.wait()
+
+		lease, err := taskQueue.Claim(ctx, req)
+		if err != nil || lease != nil || wait <= 0 {
+			return lease, err
+		}
+
+		select {
+		case <-ready:
+		case <-time.After(taskRecheckInterval):
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// submitResults принимает результаты задач. Для каждого результата
+// возвращает причину отказа или nil, если результат принят.
+func submitResults(ctx context.Context, results []model.TaskResult) ([]error, error) {
+	rejections, err := taskQueue.Complete(ctx, results)
+	if err != nil {
+		return nil, err
+	}
+	notifier.broadcast()
+
+	for i, rejection := range rejections {
+		if rejection != nil {
+			logRejectedResult(results[i], rejection)
+		}
+	}
+	return rejections, nil
+}
+
+// failTask завершает задачу с ошибкой по сообщению агента.
+func failTask(ctx context.Context, id, leaseToken, agentID, reason string) error {
+	err := taskQueue.Fail(ctx, id, leaseToken)
+	if queue.IsResultRejection(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("Failed to fail task %s: %v", id, err)
+		return err
+	}
+	log.Printf("Task %s reported as failed by agent %s: %s", id, agentID, reason)
+	return nil
+}
+
+// releaseLease возвращает в очередь задачи аренды и будит ожидающих агентов.
+func releaseLease(ctx context.Context, leaseToken string, taskIDs []string) (int, error) {
+	released, err := taskQueue.Release(ctx, leaseToken, taskIDs)
+	if err != nil {
+		return 0, err
+	}
+	notifier.broadcast()
+	return released, nil
+}
+
+// logRejectedResult записывает в лог отклонённый результат вместе с задачей и агентом.
+func logRejectedResult(r model.TaskResult, reason error) {
+	agentID := r.AgentID
+	if agentID == "" {
+		agentID = "unknown"
+	}
+	log.Printf("Rejected result %v for task %s from agent %s (lease %q): %v",
+		r.Result, r.ID, agentID, r.LeaseToken, reason)
+}
+
+func rejectionStatus(err error) int {
+	if errors.Is(err, queue.ErrTaskNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusConflict
+}
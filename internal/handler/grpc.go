@@ -0,0 +1,472 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/dispatchpb"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Сколько запросов задач агент может держать без ответа в одном потоке.
+const maxPendingRequests = maxTaskBatch
+
+// Сколько ждать освобождения задач агента, поток которого разорвался.
+const releaseStreamTimeout = 5 * time.Second
+
+// DispatchService раздаёт задачи агентам по gRPC: каждый агент держит один
+// двунаправленный поток, по которому получает аренды и отправляет результаты.
+type DispatchService struct {
+	dispatchpb.UnimplementedDispatchServer
+}
+
+func NewDispatchService() *DispatchService {
+	return &DispatchService{}
+}
+
+// agentStream — подключённый по gRPC агент и арендованные им задачи.
+type agentStream struct {
+	agentID string
+	stream  dispatchpb.Dispatch_ConnectServer
+
+	sendMu sync.Mutex
+	closed bool
+
+	mu     sync.Mutex
+	leased map[string]leasedTask // по ID задачи
+}
+
+type leasedTask struct {
+	expressionID string
+	leaseToken   string
+}
+
+// send отправляет сообщение агенту. После закрытия потока сообщения
+// отбрасываются.
+func (s *agentStream) send(msg *dispatchpb.OrchestratorMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.closed {
+		return errors.New("stream closed")
+	}
+	return s.stream.Send(msg)
+}
+
+func (s *agentStream) close() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.closed = true
+}
+
+func (s *agentStream) track(lease *model.Lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range lease.Tasks {
+		s.leased[task.ID] = leasedTask{expressionID: task.ExpressionId, leaseToken: lease.Token}
+	}
+}
+
+func (s *agentStream) forget(taskIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range taskIDs {
+		delete(s.leased, id)
+	}
+}
+
+// forgetLease забывает задачи аренды, все или только перечисленные.
+func (s *agentStream) forgetLease(leaseToken string, taskIDs []string) {
+	if len(taskIDs) > 0 {
+		s.forget(taskIDs...)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, task := range s.leased {
+		if task.leaseToken == leaseToken {
+			delete(s.leased, id)
+		}
+	}
+}
+
+// takeExpression забывает и возвращает задачи выражения, выданные агенту.
+func (s *agentStream) takeExpression(expressionID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var taskIDs []string
+	for id, task := range s.leased {
+		if task.expressionID == expressionID {
+			taskIDs = append(taskIDs, id)
+			delete(s.leased, id)
+		}
+	}
+	return taskIDs
+}
+
+// releaseAll освобождает все задачи, выданные агенту, чтобы после разрыва
+// потока они сразу достались другим агентам, а не ждали истечения аренды.
+func (s *agentStream) releaseAll() {
+	s.mu.Lock()
+	leases := make(map[string][]string)
+	for id, task := range s.leased {
+		leases[task.leaseToken] = append(leases[task.leaseToken], id)
+	}
+	s.leased = map[string]leasedTask{}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseStreamTimeout)
+	defer cancel()
+	for token, taskIDs := range leases {
+		released, err := releaseLease(ctx, token, taskIDs)
+		if err != nil && !errors.Is(err, queue.ErrLeaseNotFound) {
+			log.Printf("Failed to release tasks of disconnected agent %s: %v", s.agentID, err)
+			continue
+		}
+		if released > 0 {
+			log.Printf("Released %d tasks of disconnected agent %s", released, s.agentID)
+		}
+	}
+}
+
+// streamRegistry хранит подключённых по gRPC агентов, чтобы сообщать им
+// об отменённых выражениях.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[*agentStream]struct{}
+}
+
+var agentStreams = &streamRegistry{streams: map[*agentStream]struct{}{}}
+
+func (r *streamRegistry) add(s *agentStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streams[s] = struct{}{}
+}
+
+func (r *streamRegistry) remove(s *agentStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, s)
+}
+
+// cancelExpression отправляет Cancel агентам, вычисляющим задачи выражения.
+func (r *streamRegistry) cancelExpression(expressionID string) {
+	r.mu.Lock()
+	streams := make([]*agentStream, 0, len(r.streams))
+	for s := range r.streams {
+		streams = append(streams, s)
+	}
+	r.mu.Unlock()
+
+	for _, s := range streams {
+		taskIDs := s.takeExpression(expressionID)
+		if len(taskIDs) == 0 {
+			continue
+		}
+		err := s.send(&dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Cancel{
+			Cancel: &dispatchpb.Cancel{ExpressionId: expressionID, TaskIds: taskIDs},
+		}})
+		if err != nil {
+			log.Printf("Failed to send cancellation of expression %s to agent %s: %v", expressionID, s.agentID, err)
+		}
+	}
+}
+
+// Connect обслуживает поток агента. Первое сообщение должно быть Hello,
+// на него оркестратор отвечает Welcome с согласованными операциями.
+func (d *DispatchService) Connect(stream dispatchpb.Dispatch_ConnectServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := first.GetHello()
+	if hello == nil || hello.AgentId == "" {
+		return status.Error(codes.InvalidArgument, "first message must be hello with agent_id")
+	}
+	info := agentFromHello(hello)
+	if err := registerStreamAgent(ctx, info); err != nil {
+		return err
+	}
+
+	operations := info.Operations
+	if len(operations) == 0 {
+		operations = supportedOperations
+	}
+	s := &agentStream{agentID: info.ID, stream: stream, leased: map[string]leasedTask{}}
+	err = s.send(&dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Welcome{
+		Welcome: &dispatchpb.Welcome{
+			HeartbeatIntervalMs: int64(agentHeartbeatMS),
+			Operations:          operations,
+			MaxBatch:            maxTaskBatch,
+		},
+	}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Agent %s connected over gRPC", info.ID)
+
+	agentStreams.add(s)
+	defer agentStreams.remove(s)
+	// Отправлять после выхода из обработчика нельзя
+	defer s.close()
+	// Выполняется после остановки раздачи, когда новых аренд уже не будет
+	defer s.releaseAll()
+
+	// Recv читается в отдельной горутине, чтобы обработчик мог
+	// завершиться по ошибке раздачи задач
+	incoming := make(chan *dispatchpb.AgentMessage)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case incoming <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	requests := make(chan int, maxPendingRequests)
+	dispatchErr := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dispatchErr <- d.dispatch(ctx, s, requests)
+	}()
+	// Раздача должна закончиться раньше, чем закроется поток
+	defer wg.Wait()
+	defer cancel()
+
+	for {
+		select {
+		case err := <-recvErr:
+			log.Printf("Agent %s disconnected from gRPC: %v", info.ID, err)
+			return nil
+		case err := <-dispatchErr:
+			if err != nil {
+				log.Printf("Failed to dispatch tasks to agent %s: %v", info.ID, err)
+				return status.Error(codes.Internal, "failed to get task")
+			}
+			return nil
+		case msg := <-incoming:
+			if err := d.handle(ctx, s, info, msg, requests); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func agentFromHello(hello *dispatchpb.Hello) *model.Agent {
+	return &model.Agent{
+		ID:         hello.AgentId,
+		Hostname:   hello.Hostname,
+		Workers:    int(hello.Workers),
+		Version:    hello.Version,
+		Operations: hello.Operations,
+		Throughput: hello.Throughput,
+		BenchScore: hello.BenchScore,
+	}
+}
+
+func registerStreamAgent(ctx context.Context, info *model.Agent) error {
+	var agentErr *agentError
+	err := registerAgent(ctx, info)
+	if errors.As(err, &agentErr) {
+		return status.Error(codes.InvalidArgument, agentErr.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "failed to register agent")
+	}
+	return nil
+}
+
+// handle обрабатывает одно сообщение агента после Hello.
+func (d *DispatchService) handle(ctx context.Context, s *agentStream, info *model.Agent, msg *dispatchpb.AgentMessage, requests chan<- int) error {
+	switch body := msg.Body.(type) {
+	case *dispatchpb.AgentMessage_Request:
+		n := min(max(int(body.Request.Max), 1), maxTaskBatch)
+		select {
+		case requests <- n:
+		default:
+			return status.Errorf(codes.ResourceExhausted, "more than %d pending task requests", maxPendingRequests)
+		}
+		return nil
+
+	case *dispatchpb.AgentMessage_Results:
+		return s.send(ack(msg.Id, submitStreamResults(ctx, s, body.Results.Results)))
+
+	case *dispatchpb.AgentMessage_Failure:
+		failure := body.Failure
+		result := &dispatchpb.Ack{Status: http.StatusOK}
+		if failure.Id == "" {
+			result = &dispatchpb.Ack{Status: http.StatusBadRequest, Error: "invalid data"}
+		} else if err := failTask(ctx, failure.Id, failure.LeaseToken, s.agentID, failure.Error); queue.IsResultRejection(err) {
+			s.forget(failure.Id)
+			result = &dispatchpb.Ack{Status: int32(rejectionStatus(err)), Error: err.Error()}
+		} else if err != nil {
+			result = &dispatchpb.Ack{Status: http.StatusInternalServerError, Error: "failed to fail task"}
+		} else {
+			s.forget(failure.Id)
+		}
+		return s.send(ack(msg.Id, result))
+
+	case *dispatchpb.AgentMessage_Release:
+		release := body.Release
+		released, err := releaseLease(ctx, release.LeaseToken, release.TaskIds)
+		result := &dispatchpb.Ack{Status: http.StatusOK, Accepted: int32(released)}
+		if errors.Is(err, queue.ErrLeaseNotFound) {
+			result = &dispatchpb.Ack{Status: http.StatusNotFound, Error: err.Error()}
+		} else if err != nil {
+			result = &dispatchpb.Ack{Status: http.StatusInternalServerError, Error: "failed to release lease"}
+		}
+		if err == nil || errors.Is(err, queue.ErrLeaseNotFound) {
+			s.forgetLease(release.LeaseToken, release.TaskIds)
+		}
+		return s.send(ack(msg.Id, result))
+
+	case *dispatchpb.AgentMessage_Heartbeat:
+		err := store.AgentHeartbeat(ctx, s.agentID)
+		if errors.Is(err, database.ErrAgentNotFound) {
+			// Оркестратор забыл агента, но поток жив: регистрируем заново
+			log.Printf("Agent %s is not registered, registering it again from gRPC hello", s.agentID)
+			return registerStreamAgent(ctx, info)
+		}
+		if err != nil {
+			log.Printf("Failed to update heartbeat of agent %s: %v", s.agentID, err)
+		}
+		return nil
+
+	case *dispatchpb.AgentMessage_Hello:
+		return status.Error(codes.InvalidArgument, "hello must be sent once")
+	}
+	return status.Errorf(codes.InvalidArgument, "unknown message %T", msg.Body)
+}
+
+func ack(id uint64, result *dispatchpb.Ack) *dispatchpb.OrchestratorMessage {
+	result.Id = id
+	return &dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Ack{Ack: result}}
+}
+
+func submitStreamResults(ctx context.Context, s *agentStream, in []*dispatchpb.TaskResult) *dispatchpb.Ack {
+	if len(in) == 0 || len(in) > maxTaskBatch {
+		return &dispatchpb.Ack{
+			Status: http.StatusBadRequest,
+			Error:  fmt.Sprintf("results must contain from 1 to %d items", maxTaskBatch),
+		}
+	}
+
+	results := make([]model.TaskResult, 0, len(in))
+	for _, r := range in {
+		results = append(results, model.TaskResult{
+			ID:         r.Id,
+			Result:     r.Result,
+			LeaseToken: r.LeaseToken,
+			AgentID:    s.agentID,
+		})
+	}
+
+	rejections, err := submitResults(ctx, results)
+	if err != nil {
+		log.Printf("Failed to submit results of agent %s: %v", s.agentID, err)
+		return &dispatchpb.Ack{Status: http.StatusInternalServerError, Error: "failed to submit results"}
+	}
+
+	result := &dispatchpb.Ack{Status: http.StatusOK}
+	for i, rejection := range rejections {
+		s.forget(results[i].ID)
+		if rejection == nil {
+			result.Accepted++
+			continue
+		}
+		result.Rejected = append(result.Rejected, &dispatchpb.Rejection{
+			Id:     results[i].ID,
+			Status: int32(rejectionStatus(rejection)),
+			Error:  rejection.Error(),
+		})
+	}
+	return result
+}
+
+// dispatch отвечает арендой на каждый запрос задач агента по порядку.
+func (d *DispatchService) dispatch(ctx context.Context, s *agentStream, requests <-chan int) error {
+	for {
+		var n int
+		select {
+		case n = <-requests:
+		case <-ctx.Done():
+			return nil
+		}
+
+		var lease *model.Lease
+		for lease == nil {
+			var err error
+			lease, err = waitForTasks(ctx, s.agentID, n, maxTaskWait)
+			if ctx.Err() != nil {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			if lease != nil {
+				releaseUndelivered(ctx, lease)
+			}
+			return nil
+		}
+
+		s.track(lease)
+		if err := s.send(assignment(lease)); err != nil {
+			s.forgetLease(lease.Token, nil)
+			releaseUndelivered(ctx, lease)
+			return nil
+		}
+	}
+}
+
+// releaseUndelivered возвращает в очередь задачи аренды, которую агент не получил.
+func releaseUndelivered(ctx context.Context, lease *model.Lease) {
+	if _, err := releaseLease(context.WithoutCancel(ctx), lease.Token, nil); err != nil {
+		log.Printf("Failed to release undelivered lease %s: %v", lease.Token, err)
+	}
+}
+
+func assignment(lease *model.Lease) *dispatchpb.OrchestratorMessage {
+	tasks := make([]*dispatchpb.Task, 0, len(lease.Tasks))
+	for _, task := range lease.Tasks {
+		tasks = append(tasks, &dispatchpb.Task{
+			Id:            task.ID,
+			Arg1:          fmt.Sprint(task.Arg1),
+			Arg2:          fmt.Sprint(task.Arg2),
+			Operation:     task.Operation,
+			OperationTime: int64(getOperationTime(task.Operation)),
+			ExpressionId:  task.ExpressionId,
+			Deadline:      task.Deadline,
+		})
+	}
+	return &dispatchpb.OrchestratorMessage{Body: &dispatchpb.OrchestratorMessage_Assignment{
+		Assignment: &dispatchpb.Assignment{
+			LeaseToken: lease.Token,
+			ExpiresAt:  lease.ExpiresAt,
+			Tasks:      tasks,
+		},
+	}}
+}
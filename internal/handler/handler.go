@@ -1,34 +1,64 @@
 package handler
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/pliliya111/go_final_sprint/internal/database"
 	"github.com/pliliya111/go_final_sprint/internal/middleware"
 	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var db *sql.DB // Глобальная переменная
+// Хранилище выражений, пользователей, агентов и расписаний.
+var store Store
+
+// Очередь задач, через которую задачи выдаются агентам и принимаются их результаты.
+var taskQueue queue.TaskQueue
+
+const (
+	// Максимальное число задач, выдаваемых или принимаемых за один запрос.
+	maxTaskBatch = 100
+	// Максимальное время ожидания задачи в long polling.
+	maxTaskWait = time.Minute
+	// На сколько можно продлить аренду за один запрос.
+	maxLeaseExtension = 10 * time.Minute
+	// Как часто ожидающий запрос перепроверяет очередь без уведомления,
+	// например, чтобы подхватить задачи с истёкшей арендой.
+	taskRecheckInterval = time.Second
+	// Максимальное число агентов, независимо вычисляющих одну задачу.
+	maxReplicas = 3
+)
+
+var (
+	notifier            = newTaskNotifier()
+	supportedOperations = []string{"+", "-", "*", "/"}
+)
 
-func SetDB(database *sql.DB) {
-	db = database
+// SetStore задаёт хранилище состояния оркестратора. Очередь задач
+// задаётся отдельно через SetTaskQueue.
+func SetStore(s Store) {
+	store = s
+}
+
+func SetTaskQueue(q queue.TaskQueue) {
+	taskQueue = q
 }
 
 var (
-	timeAdditionMS       = getEnvInt("TIME_ADDITION_MS", 1000)
-	timeSubtractionMS    = getEnvInt("TIME_SUBTRACTION_MS", 1000)
-	timeMultiplicationMS = getEnvInt("TIME_MULTIPLICATIONS_MS", 1000)
-	timeDivisionMS       = getEnvInt("TIME_DIVISIONS_MS", 1000)
-	validExpressionRegex = regexp.MustCompile(`^[\d\s\+\-\*\/\(\)]+$`)
+	taskLeaseMS          = getEnvInt("TASK_LEASE_MS", 30000)
+	validExpressionRegex = regexp.MustCompile(`^(?:[\d\s\.\+\-\*\/\(\)]|expr\("[^"]+"\))+$`)
 )
 
 func getEnvInt(key string, defaultValue int) int {
@@ -44,13 +74,44 @@ func getEnvInt(key string, defaultValue int) int {
 }
 
 func parseExpression(expression string) []string {
-	re := regexp.MustCompile(`\d+|\+|\-|\*|\/`)
+	re := regexp.MustCompile(`expr\("[^"]+"\)|\d+(?:\.\d+)?|\+|\-|\*|\/`)
 	return re.FindAllString(expression, -1)
 }
 
+// parseDeadline возвращает срок выполнения выражения в unix ms
+// (0, если срок не задан).
+func parseDeadline(timeoutMs int64, deadline string) (int64, error) {
+	if timeoutMs != 0 && deadline != "" {
+		return 0, errors.New("only one of timeout_ms and deadline can be specified")
+	}
+
+	if timeoutMs < 0 {
+		return 0, errors.New("timeout_ms must be positive")
+	}
+	if timeoutMs > 0 {
+		return time.Now().Add(time.Duration(timeoutMs) * time.Millisecond).UnixMilli(), nil
+	}
+
+	if deadline == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, deadline)
+	if err != nil {
+		return 0, errors.New("deadline must be in RFC 3339 format")
+	}
+	if !t.After(time.Now()) {
+		return 0, errors.New("deadline is in the past")
+	}
+	return t.UnixMilli(), nil
+}
+
 func AddExpression(c *gin.Context) {
 	var request struct {
 		Expression string `json:"expression"`
+		Priority   int    `json:"priority"`
+		TimeoutMs  int64  `json:"timeout_ms"`
+		Deadline   string `json:"deadline"` // RFC 3339
+		Replicas   int    `json:"replicas"`
 	}
 	userId, exists := c.Get("userId")
 	if !exists {
@@ -69,20 +130,158 @@ func AddExpression(c *gin.Context) {
 		return
 	}
 
-	expressionID := uuid.New().String()
+	deadline, err := parseDeadline(request.TimeoutMs, request.Deadline)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Replicas == 0 {
+		request.Replicas = 1
+	}
+	if request.Replicas < 1 || request.Replicas > maxReplicas {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("replicas must be from 1 to %d", maxReplicas)})
+		return
+	}
+
 	expr := &model.Expression{
-		ID:         expressionID,
+		ID:         uuid.New().String(),
 		Expression: request.Expression,
 		Status:     "pending",
 		UserId:     userID,
+		Priority:   request.Priority,
+		Deadline:   deadline,
+		Replicas:   request.Replicas,
+	}
+
+	var refErr *referenceError
+	var admissionErr *admissionError
+	var quotaErr *quotaError
+	err = submitExpression(c.Request.Context(), expr)
+	if errors.Is(err, database.ErrUserNotFound) {
+		// Токен пользователя, которого уже нет в базе
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
 	}
-
-	if _, err := database.InsertExpression(c.Request.Context(), db, expr); err != nil {
+	if errors.As(err, &quotaErr) {
+		respondQuotaError(c, quotaErr)
+		return
+	}
+	if errors.As(err, &refErr) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": refErr.Error()})
+		return
+	}
+	if errors.As(err, &admissionErr) {
+		seconds := retryAfterSeconds(admissionErr.retryAfter)
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": admissionErr.Error(), "retry_after": seconds})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save expression"})
 		return
 	}
 
-	tokens := parseExpression(request.Expression)
+	if expr.Status == "waiting_admission" {
+		c.JSON(http.StatusAccepted, gin.H{"id": expr.ID, "status": expr.Status})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": expr.ID})
+}
+
+// submitExpression проверяет лимиты пользователя и сохраняет выражение и,
+// если очередь задач не переполнена, его задачи. Через него проходят
+// и выражения, отправленные пользователем, и создаваемые по расписанию.
+func submitExpression(ctx context.Context, expr *model.Expression) error {
+	l, err := checkQuota(ctx, int64(expr.UserId), expr.Expression)
+	if err != nil {
+		return err
+	}
+
+	// Каждый оператор выражения становится отдельной задачей
+	tokens := parseExpression(expr.Expression)
+	refs, refsWaiting, err := resolveReferences(ctx, expr.UserId, tokens)
+	if err != nil {
+		return err
+	}
+
+	admit, wait, err := checkAdmission(ctx, len(tokens)/2, true)
+	if err != nil {
+		return err
+	}
+	// Выражение, ссылающееся на ожидающее допуска, ждёт вместе с ним
+	// в любом режиме ADMISSION_MODE: отказ не помог бы, ссылка корректна
+	if !admit || refsWaiting {
+		if !refsWaiting && admissionMode() != "queue" {
+			return &admissionError{retryAfter: wait}
+		}
+
+		// Задачи будут созданы, когда в очереди освободится место
+		expr.Status = "waiting_admission"
+		if err := insertWithinQuota(ctx, expr, len(tokens)/2, l); err != nil {
+			return err
+		}
+		return store.LinkExpressionRefs(ctx, expr.ID, refs)
+	}
+
+	if err := insertWithinQuota(ctx, expr, len(tokens)/2, l); err != nil {
+		return err
+	}
+	return startExpression(ctx, expr, tokens, refs)
+}
+
+// startExpression создаёт задачи сохранённого выражения и будит агентов,
+// ожидающих задачи. Выражение из одного числа сразу завершается им.
+func startExpression(ctx context.Context, expr *model.Expression, tokens []string, refs []string) error {
+	if len(tokens) == 1 {
+		if value, err := strconv.ParseFloat(tokens[0], 64); err == nil {
+			expr.Status = "completed"
+			expr.Result = value
+			return store.CompleteExpression(ctx, expr.ID, value)
+		}
+	}
+
+	tasks := planTasks(expr.ID, tokens)
+	if len(tasks) > 0 {
+		expr.Result = tasks[len(tasks)-1].ID
+	}
+	expr.Status = "in_progress"
+	expr.CriticalPath = criticalPaths(tasks)
+	expr.StartedAt = time.Now().UnixMilli()
+
+	// Выражение переводится в in_progress до постановки задач в очередь,
+	// чтобы их результаты не пришли раньше
+	if err := store.UpdateExpression(ctx, expr); err != nil {
+		return err
+	}
+	if err := taskQueue.Enqueue(ctx, expr, tasks); err != nil {
+		return err
+	}
+	if err := store.LinkExpressionRefs(ctx, expr.ID, refs); err != nil {
+		return err
+	}
+	notifier.broadcast()
+
+	return nil
+}
+
+// planTasks разбивает выражение на задачи: сначала умножение и деление,
+// затем сложение и вычитание. Аргументом задачи может быть число или ID
+// задачи, от результата которой она зависит. Последняя задача даёт
+// результат всего выражения.
+func planTasks(expressionID string, tokens []string) []*model.Task {
+	// Выражение из одной ссылки на ещё не вычисленное выражение становится
+	// задачей «результат + 0»: она ждёт результата, как любая зависимая задача
+	if len(tokens) == 1 {
+		return []*model.Task{{
+			ID:           uuid.New().String(),
+			Arg1:         tokens[0],
+			Arg2:         "0",
+			Operation:    "+",
+			ExpressionId: expressionID,
+		}}
+	}
+
 	var tasks []*model.Task
 
 	// Обработка операций умножения и деления
@@ -99,9 +298,11 @@ func AddExpression(c *gin.Context) {
 				ExpressionId: expressionID,
 			}
 			tasks = append(tasks, task)
-			tokens[i-1] = taskID
+			// Результат занимает место правого операнда, чтобы следующая
+			// операция той же цепочки (2 * 3 * 4) взяла его аргументом
+			tokens[i-1] = ""
 			tokens[i] = ""
-			tokens[i+1] = ""
+			tokens[i+1] = taskID
 		}
 	}
 
@@ -127,35 +328,19 @@ func AddExpression(c *gin.Context) {
 				ExpressionId: expressionID,
 			}
 			tasks = append(tasks, task)
-			tokens[i-1] = taskID
+			tokens[i-1] = ""
 			tokens[i] = ""
-			tokens[i+1] = ""
-		}
-	}
-
-	// Вставляем все задачи одним запросом
-	if len(tasks) > 0 {
-		if err := database.InsertTasks(c.Request.Context(), db, tasks); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save tasks"})
-			return
+			tokens[i+1] = taskID
 		}
-
-		expr.Result = tasks[len(tasks)-1].ID
-	}
-	expr.Status = "in_progress"
-
-	if err := database.UpdateExpression(c.Request.Context(), db, expr); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update expression"})
-		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"id": expressionID})
+	return tasks
 }
 
 func GetExpressions(c *gin.Context) {
 	ctx := c.Request.Context()
 
-	expressions, err := database.GetExpressions(ctx, db)
+	expressions, err := store.GetExpressions(ctx)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch expressions"})
 		return
@@ -176,7 +361,7 @@ func GetExpressionByID(c *gin.Context) {
 	expressionID := c.Param("id")
 	ctx := c.Request.Context()
 
-	expr, err := database.GetExpressionByID(ctx, db, expressionID)
+	expr, err := store.GetExpressionByID(ctx, expressionID)
 	if err != nil {
 		if err.Error() == "expression not found" {
 			c.JSON(http.StatusNotFound, gin.H{"error": "expression not found"})
@@ -186,84 +371,314 @@ func GetExpressionByID(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"expression": gin.H{
-			"id":         expr.ID,
-			"expression": expr.Expression,
-			"status":     expr.Status,
-			"result":     expr.Result,
-		},
-	})
+	// Задачи выражения хранит очередь задач, а не таблица выражений
+	if expr.Disputes, err = taskQueue.Disputes(ctx, expressionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch expression"})
+		return
+	}
+
+	// Предупреждаем о задачах, которые не может выполнить ни один агент
+	warnings := []string{}
+	if expr.Status == "in_progress" {
+		operations, err := taskQueue.Operations(ctx, expressionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch expression"})
+			return
+		}
+		unsupported, err := store.GetUnsupportedOperations(ctx, operations)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch expression"})
+			return
+		}
+		for _, op := range unsupported {
+			warnings = append(warnings, fmt.Sprintf("no registered agent supports operation %s", op))
+		}
+
+		if expr.Replicas > 1 {
+			alive, err := store.CountAliveAgents(ctx)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch expression"})
+				return
+			}
+			if alive < expr.Replicas {
+				warnings = append(warnings, fmt.Sprintf("expression needs %d agents to verify results, only %d alive", expr.Replicas, alive))
+			}
+		}
+	}
+
+	response := gin.H{
+		"id":               expr.ID,
+		"expression":       expr.Expression,
+		"status":           expr.Status,
+		"result":           expr.Result,
+		"priority":         expr.Priority,
+		"deadline":         expr.Deadline,
+		"replicas":         expr.Replicas,
+		"disputes":         expr.Disputes,
+		"critical_path_ms": expr.CriticalPath,
+		"warnings":         warnings,
+	}
+	// Фактическое время вычисления от постановки задач в очередь до результата
+	if expr.StartedAt > 0 && expr.CompletedAt > 0 {
+		response["makespan_ms"] = expr.CompletedAt - expr.StartedAt
+	}
+
+	c.JSON(http.StatusOK, gin.H{"expression": response})
+}
+
+func CancelExpression(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user id not found"})
+		return
+	}
+
+	expressionID := c.Param("id")
+	ctx := c.Request.Context()
+	err := store.CancelExpression(ctx, expressionID, userId.(int))
+	if err == nil {
+		err = taskQueue.Cancel(ctx, expressionID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrExpressionNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, database.ErrExpressionFinished):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel expression"})
+		}
+		return
+	}
+
+	// Агентам на gRPC сообщаем сразу, чтобы они не вычисляли лишнего
+	agentStreams.cancelExpression(expressionID)
+
+	c.JSON(http.StatusOK, gin.H{"id": expressionID, "status": "cancelled"})
 }
 
-func getOperationTime(operation string) int {
-	switch operation {
-	case "+":
-		return timeAdditionMS
-	case "-":
-		return timeSubtractionMS
-	case "*":
-		return timeMultiplicationMS
-	case "/":
-		return timeDivisionMS
-	default:
-		return 0
+func taskResponse(task *model.Task) gin.H {
+	response := gin.H{
+		"id":             task.ID,
+		"arg1":           task.Arg1,
+		"arg2":           task.Arg2,
+		"operation":      task.Operation,
+		"operation_time": getOperationTime(task.Operation),
+		"expression_id":  task.ExpressionId,
+		"lease_token":    task.LeaseToken,
 	}
+	if task.Deadline > 0 {
+		response["deadline"] = task.Deadline
+	}
+	return response
 }
 
 func GetTask(c *gin.Context) {
 	ctx := c.Request.Context()
 
-	task, err := database.GetNextPendingTask(ctx, db)
+	max := 1
+	batch := c.Query("max") != ""
+	if batch {
+		var err error
+		max, err = strconv.Atoi(c.Query("max"))
+		if err != nil || max < 1 || max > maxTaskBatch {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("max must be between 1 and %d", maxTaskBatch)})
+			return
+		}
+	}
+
+	var wait time.Duration
+	if c.Query("wait") != "" {
+		var err error
+		wait, err = time.ParseDuration(c.Query("wait"))
+		if err != nil || wait < 0 || wait > maxTaskWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("wait must be a duration up to %s", maxTaskWait)})
+			return
+		}
+	}
+
+	lease, err := waitForTasks(ctx, c.Query("agent_id"), max, wait)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get task"})
 		return
 	}
 
-	if task == nil {
+	if lease == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "no tasks available"})
 		return
 	}
 
-	opTime := getOperationTime(task.Operation)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !batch {
+		c.JSON(http.StatusOK, gin.H{"task": taskResponse(lease.Tasks[0])})
 		return
 	}
 
+	tasks := make([]gin.H, 0, len(lease.Tasks))
+	for _, task := range lease.Tasks {
+		tasks = append(tasks, taskResponse(task))
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"task": gin.H{
-			"id":             task.ID,
-			"arg1":           task.Arg1,
-			"arg2":           task.Arg2,
-			"operation":      task.Operation,
-			"operation_time": opTime,
-			"expression_id":  task.ExpressionId,
+		"lease": gin.H{
+			"token":      lease.Token,
+			"expires_at": lease.ExpiresAt,
 		},
+		"tasks": tasks,
 	})
 }
 
 func SubmitTaskResult(c *gin.Context) {
-	var request struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
-	}
+	var request model.TaskResult
 
 	if err := c.BindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
 		return
 	}
 
-	ctx := c.Request.Context()
-	if err := database.UpdateTaskResult(ctx, db, request.ID, request.Result); err != nil {
-		fmt.Println(err)
+	rejections, err := submitResults(c.Request.Context(), []model.TaskResult{request})
+	if err != nil {
+		agentID := request.AgentID
+		if agentID == "" {
+			agentID = "unknown"
+		}
+		log.Printf("Failed to update task %s from agent %s: %v", request.ID, agentID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to submit result"})
 		return
 	}
+	if rejections[0] != nil {
+		c.JSON(rejectionStatus(rejections[0]), gin.H{"error": rejections[0].Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "result submitted"})
 }
 
+func SubmitTaskResults(c *gin.Context) {
+	var request struct {
+		Results []model.TaskResult `json:"results"`
+	}
+
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
+		return
+	}
+
+	if len(request.Results) == 0 || len(request.Results) > maxTaskBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("results must contain from 1 to %d items", maxTaskBatch)})
+		return
+	}
+
+	rejections, err := submitResults(c.Request.Context(), request.Results)
+	if err != nil {
+		log.Printf("Failed to submit %d task results: %v", len(request.Results), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to submit results"})
+		return
+	}
+
+	rejected := []gin.H{}
+	for i, rejection := range rejections {
+		if rejection == nil {
+			continue
+		}
+		rejected = append(rejected, gin.H{
+			"id":     request.Results[i].ID,
+			"status": rejectionStatus(rejection),
+			"error":  rejection.Error(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "results submitted",
+		"accepted": len(request.Results) - len(rejected),
+		"rejected": rejected,
+	})
+}
+
+// FailTask принимает от агента сообщение, что задачу невозможно вычислить.
+func FailTask(c *gin.Context) {
+	var request struct {
+		ID         string `json:"id"`
+		LeaseToken string `json:"lease_token"`
+		AgentID    string `json:"agent_id"`
+		Error      string `json:"error"`
+	}
+
+	if err := c.BindJSON(&request); err != nil || request.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
+		return
+	}
+
+	err := failTask(c.Request.Context(), request.ID, request.LeaseToken, request.AgentID, request.Error)
+	if queue.IsResultRejection(err) {
+		c.JSON(rejectionStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fail task"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "task failed"})
+}
+
+// ExtendLease продлевает аренду, если агент не успевает вычислить задачи.
+func ExtendLease(c *gin.Context) {
+	var request struct {
+		DurationMS int `json:"duration_ms"`
+	}
+
+	if err := c.BindJSON(&request); err != nil || request.DurationMS < 0 || request.DurationMS > int(maxLeaseExtension.Milliseconds()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration_ms must be from 0 to %d", maxLeaseExtension.Milliseconds())})
+		return
+	}
+
+	d := time.Duration(request.DurationMS) * time.Millisecond
+	if d == 0 {
+		d = leaseDuration(1)
+	}
+
+	expiresAt, err := taskQueue.Extend(c.Request.Context(), c.Param("token"), d)
+	if errors.Is(err, queue.ErrLeaseNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to extend lease"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": c.Param("token"), "expires_at": expiresAt})
+}
+
+// ReleaseLease возвращает в очередь задачи аренды, которые агент не будет
+// вычислять (например, при остановке). Без task_ids освобождается вся аренда.
+func ReleaseLease(c *gin.Context) {
+	var request struct {
+		TaskIDs []string `json:"task_ids"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
+		return
+	}
+	if len(request.TaskIDs) > maxTaskBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("task_ids must contain at most %d items", maxTaskBatch)})
+		return
+	}
+
+	released, err := releaseLease(c.Request.Context(), c.Param("token"), request.TaskIDs)
+	if errors.Is(err, queue.ErrLeaseNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to release lease"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": c.Param("token"), "released": released})
+}
+
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	return string(bytes), err
@@ -283,6 +698,10 @@ func RegisterUser(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Invalid request data"})
 		return
 	}
+	if middleware.IsAdminName(request.Name) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user name is reserved"})
+		return
+	}
 	hashedPassword, err := hashPassword(request.Password)
 	if err != nil {
 		log.Fatalf("Ошибка хэширования пароля: %v", err)
@@ -292,7 +711,7 @@ func RegisterUser(c *gin.Context) {
 		Password: hashedPassword,
 	}
 
-	userID, err := database.InsertUser(c.Request.Context(), db, &user)
+	userID, err := store.InsertUser(c.Request.Context(), &user)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to register user"})
 		return
@@ -304,6 +723,16 @@ func RegisterUser(c *gin.Context) {
 	})
 }
 
+// IsAdmin проверяет отметку администратора у пользователя; для
+// middleware.AdminMiddleware. Удалённый пользователь — не администратор.
+func IsAdmin(ctx context.Context, userID int) (bool, error) {
+	admin, err := store.IsAdmin(ctx, userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return false, nil
+	}
+	return admin, err
+}
+
 func LoginUser(c *gin.Context) {
 	var request struct {
 		Name     string `json:"name"`
@@ -315,7 +744,7 @@ func LoginUser(c *gin.Context) {
 		return
 	}
 
-	user, err := database.LoginUser(c.Request.Context(), db, request.Name, request.Password)
+	user, err := store.LoginUser(c.Request.Context(), request.Name, request.Password)
 	if err != nil {
 		switch err.Error() {
 		case "user not found":
@@ -340,3 +769,32 @@ func LoginUser(c *gin.Context) {
 		"token":   tokenString,
 	})
 }
+
+func SetUserWeight(c *gin.Context) {
+	var request struct {
+		Weight float64 `json:"weight"`
+	}
+
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Weight <= 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "weight must be a positive number"})
+		return
+	}
+
+	err = store.SetUserWeight(c.Request.Context(), userID, request.Weight)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user weight"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "weight": request.Weight})
+}
@@ -5,20 +5,31 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/dispatchpb"
 	"github.com/pliliya111/go_final_sprint/internal/handler"
 	"github.com/pliliya111/go_final_sprint/internal/middleware"
 	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 var (
@@ -42,7 +53,7 @@ func setupDatabase() {
 		panic(err)
 	}
 
-	handler.SetDB(db)
+	handler.SetStore(handler.NewSQLStore(db))
 }
 
 func teardownDatabase() {
@@ -69,18 +80,101 @@ func setupRouter() *gin.Engine {
 	auth.POST("/calculate", handler.AddExpression)
 	auth.GET("/expressions", handler.GetExpressions)
 	auth.GET("/expressions/:id", handler.GetExpressionByID)
+	auth.DELETE("/expressions/:id", handler.CancelExpression)
+	auth.GET("/queue", handler.GetQueue)
+
+	auth.POST("/schedules", handler.AddSchedule)
+	auth.GET("/schedules", handler.GetSchedules)
+	auth.GET("/schedules/:id", handler.GetSchedule)
+	auth.POST("/schedules/:id/pause", handler.PauseSchedule)
+	auth.POST("/schedules/:id/resume", handler.ResumeSchedule)
+	auth.DELETE("/schedules/:id", handler.DeleteSchedule)
+
+	auth.GET("/agents", middleware.AdminMiddleware(handler.IsAdmin), handler.GetAgents)
+
+	admin := auth.Group("/admin")
+	admin.Use(middleware.AdminMiddleware(handler.IsAdmin))
+	admin.PUT("/users/:id/weight", handler.SetUserWeight)
+	admin.GET("/users/:id/limits", handler.GetUserLimits)
+	admin.PUT("/users/:id/limits", handler.SetUserLimits)
+	admin.GET("/timings", handler.GetOperationTimings)
+	admin.PUT("/timings", handler.SetOperationTimings)
 
 	r.GET("/internal/task", handler.GetTask)
 	r.POST("/internal/task", handler.SubmitTaskResult)
+	r.POST("/internal/tasks/results", handler.SubmitTaskResults)
+	r.POST("/internal/task/fail", handler.FailTask)
+	r.POST("/internal/leases/:token/extend", handler.ExtendLease)
+	r.POST("/internal/leases/:token/release", handler.ReleaseLease)
+	r.POST("/internal/agents", handler.RegisterAgent)
+	r.POST("/internal/agents/:id/heartbeat", handler.AgentHeartbeat)
 
 	return r
 }
 
+// newAdminToken регистрирует пользователя, отмечает его администратором
+// и возвращает его токен.
+func newAdminToken(t *testing.T) string {
+	t.Helper()
+	ctx := context.Background()
+	name := "admin_" + uuid.NewString()
+	id, err := database.InsertUser(ctx, db, &model.User{Name: name, Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SetAdmins(ctx, db, []string{name}); err != nil {
+		t.Fatal(err)
+	}
+	token, err := middleware.GenerateToken(name, int(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// memoryQueue сообщает, что тесты идут с очередью задач в памяти.
+var memoryQueue bool
+
+// finalTaskID возвращает ID задачи, результат которой — результат
+// вычисляемого выражения: пока выражение не вычислено, он хранится
+// в поле result выражения при любой очереди задач.
+func finalTaskID(t *testing.T, expressionID string) string {
+	t.Helper()
+	var taskID string
+	err := db.QueryRow("SELECT result FROM expressions WHERE id = ?", expressionID).Scan(&taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taskID
+}
+
+// TestMain прогоняет тесты с обеими реализациями очереди задач,
+// каждый раз на новой базе.
 func TestMain(m *testing.M) {
-	setupDatabase()
-	code := m.Run()
-	teardownDatabase()
-	os.Exit(code)
+	for _, memory := range []bool{false, true} {
+		memoryQueue = memory
+		setupDatabase()
+		if memory {
+			handler.SetTaskQueue(queue.NewMemoryQueue(queue.NewSQLStore(db)))
+		} else {
+			handler.SetTaskQueue(queue.NewSQLiteQueue(db))
+		}
+		code := m.Run()
+		teardownDatabase()
+		if code != 0 {
+			os.Exit(code)
+		}
+	}
+	os.Exit(0)
+}
+
+// requireSQLiteQueue пропускает тест, который проверяет задачи
+// и аренды в таблицах базы, с очередью в памяти.
+func requireSQLiteQueue(t *testing.T) {
+	t.Helper()
+	if memoryQueue {
+		t.Skip("test inspects tasks stored in the database")
+	}
 }
 
 func TestAddExpression(t *testing.T) {
@@ -146,11 +240,17 @@ func TestGetTask(t *testing.T) {
 }
 
 func TestSubmitTaskResult(t *testing.T) {
+	requireSQLiteQueue(t)
 	router := setupRouter()
 
+	// Задача из TestGetTask уже арендована, поэтому создаём новое выражение
+	token, err := middleware.GenerateToken("user_1", 1)
+	assert.NoError(t, err)
+
 	payload := `{"expression": "2 + 3 * 4"}`
 	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
@@ -160,13 +260,15 @@ func TestSubmitTaskResult(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	var taskResponse map[string]interface{}
-	err := json.Unmarshal(w.Body.Bytes(), &taskResponse)
+	err = json.Unmarshal(w.Body.Bytes(), &taskResponse)
 	assert.NoError(t, err)
 
 	task := taskResponse["task"].(map[string]interface{})
 	taskID := task["id"].(string)
 
-	resultPayload := `{"id": "` + taskID + `", "result": 12}`
+	leaseToken := task["lease_token"].(string)
+
+	resultPayload := `{"id": "` + taskID + `", "result": 12, "lease_token": "` + leaseToken + `"}`
 	req, _ = http.NewRequest("POST", "/internal/task", bytes.NewBufferString(resultPayload))
 	req.Header.Set("Content-Type", "application/json")
 
@@ -278,3 +380,2355 @@ func TestGetExpressionByID(t *testing.T) {
 	assert.Equal(t, expressionID, exprMap["id"])
 	assert.Equal(t, "in_progress", exprMap["status"])
 }
+
+func TestCancelExpression(t *testing.T) {
+	requireSQLiteQueue(t)
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_4",
+		Password: "password",
+	}
+
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"expression": "7 * 8 + 1"}`
+	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	expressionID := response["id"]
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/expressions/"+expressionID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var status string
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", expressionID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "cancelled", status)
+
+	// Повторная отмена уже завершённого выражения
+	req, _ = http.NewRequest("DELETE", "/api/v1/expressions/"+expressionID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Опоздавший результат для задачи отменённого выражения игнорируется
+	var taskID string
+	err = db.QueryRow("SELECT id FROM tasks WHERE expression_id = ? AND operation = '*'", expressionID).Scan(&taskID)
+	assert.NoError(t, err)
+
+	resultPayload := `{"id": "` + taskID + `", "result": 56}`
+	req, _ = http.NewRequest("POST", "/internal/task", bytes.NewBufferString(resultPayload))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var result sql.NullString
+	err = db.QueryRow("SELECT result FROM tasks WHERE id = ?", taskID).Scan(&result)
+	assert.NoError(t, err)
+	assert.False(t, result.Valid)
+}
+
+func TestFairShareScheduling(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_5",
+		Password: "password",
+	}
+
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"expression": "9 * 9", "priority": 5}`
+	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	// Задачи user_1 уже выдавались, поэтому первым обслуживается новый пользователь
+	req, _ = http.NewRequest("GET", "/internal/task", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var taskResponse map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &taskResponse)
+	assert.NoError(t, err)
+
+	task := taskResponse["task"].(map[string]interface{})
+	assert.Equal(t, response["id"], task["expression_id"])
+}
+
+func TestPriorityWithinFairShare(t *testing.T) {
+	router := setupRouter()
+
+	newUser := func() string {
+		name := "user_" + uuid.NewString()
+		userId, err := database.InsertUser(context.Background(), db, &model.User{Name: name, Password: "password"})
+		assert.NoError(t, err)
+		token, err := middleware.GenerateToken(name, int(userId))
+		assert.NoError(t, err)
+		return token
+	}
+	calculate := func(token, payload string) string {
+		req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var created map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		return created["id"]
+	}
+	// claim выдаёт задачи по одной, пока не встретится задача одного из
+	// выражений ids, и возвращает её выражение. Чужие задачи освобождаются.
+	claim := func(ids ...string) string {
+		for i := 0; i < 100; i++ {
+			req, _ := http.NewRequest("GET", "/internal/task", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if !assert.Equal(t, http.StatusOK, w.Code) {
+				return ""
+			}
+			var response struct {
+				Task model.Task `json:"task"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			for _, id := range ids {
+				if response.Task.ExpressionId == id {
+					return id
+				}
+			}
+			req, _ = http.NewRequest("POST", "/internal/leases/"+response.Task.LeaseToken+"/release",
+				bytes.NewBufferString(`{"task_ids": ["`+response.Task.ID+`"]}`))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		return ""
+	}
+
+	// Пользователь served уже получил задачу
+	served := newUser()
+	first := calculate(served, `{"expression": "1 + 1"}`)
+	assert.Equal(t, first, claim(first))
+
+	// Приоритет упорядочивает только выражения одного пользователя: выражение
+	// с большим приоритетом не обгоняет пользователя, получившего меньше задач
+	urgent := calculate(served, `{"expression": "2 + 2", "priority": 100}`)
+	fresh := calculate(newUser(), `{"expression": "3 + 3"}`)
+	assert.Equal(t, fresh, claim(urgent, fresh))
+	assert.Equal(t, urgent, claim(urgent))
+}
+
+func TestSetUserWeight(t *testing.T) {
+	router := setupRouter()
+	adminToken := newAdminToken(t)
+	adminId, err := middleware.ExtractUserIdFromToken(adminToken)
+	assert.NoError(t, err)
+
+	userName := "user_" + uuid.NewString()
+	userId, err := database.InsertUser(context.Background(), db, &model.User{Name: userName, Password: "password"})
+	assert.NoError(t, err)
+	userToken, err := middleware.GenerateToken(userName, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"weight": 2.5}`
+	req, _ := http.NewRequest("PUT", "/api/v1/admin/users/"+strconv.Itoa(int(adminId))+"/weight", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req, _ = http.NewRequest("PUT", "/api/v1/admin/users/"+strconv.Itoa(int(adminId))+"/weight", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var weight float64
+	err = db.QueryRow("SELECT weight FROM users WHERE id = ?", adminId).Scan(&weight)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, weight)
+
+	req, _ = http.NewRequest("PUT", "/api/v1/admin/users/100000/weight", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminAccess(t *testing.T) {
+	router := setupRouter()
+	t.Setenv("ADMIN_USERS", "boss")
+
+	// Имя из ADMIN_USERS нельзя занять регистрацией
+	req, _ := http.NewRequest("POST", "/api/v1/register", bytes.NewBufferString(`{"name": "boss", "password": "password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Права определяются отметкой пользователя, а не именем в токене
+	userID, err := database.InsertUser(context.Background(), db, &model.User{Name: "not_boss", Password: "password"})
+	assert.NoError(t, err)
+	token, err := middleware.GenerateToken("boss", int(userID))
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("GET", "/api/v1/agents", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req, _ = http.NewRequest("GET", "/api/v1/agents", nil)
+	req.Header.Set("Authorization", "Bearer "+newAdminToken(t))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestExpressionDeadline(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_6",
+		Password: "password",
+	}
+
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"expression": "1 + 1", "timeout_ms": 100, "deadline": "2030-01-01T00:00:00Z"}`
+	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	payload = `{"expression": "1 + 1", "timeout_ms": 1}`
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	expressionID := response["id"]
+
+	time.Sleep(5 * time.Millisecond)
+	_, err = database.ExpireExpressions(context.Background(), db)
+	assert.NoError(t, err)
+
+	var status string
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", expressionID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "timed_out", status)
+
+	// Задачи просроченного выражения больше не выдаются агентам
+	req, _ = http.NewRequest("GET", "/internal/task", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var dispatched int
+	err = db.QueryRow("SELECT COUNT(*) FROM tasks WHERE expression_id = ? AND dispatched_at IS NOT NULL", expressionID).Scan(&dispatched)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dispatched)
+}
+
+func TestBatchTasks(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_7",
+		Password: "password",
+	}
+
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"expression": "1 * 2 + 3 * 4"}`
+	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=100", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Lease struct {
+			Token string `json:"token"`
+		} `json:"lease"`
+		Tasks []model.Task `json:"tasks"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, response.Lease.Token)
+	assert.GreaterOrEqual(t, len(response.Tasks), 2)
+
+	// Арендованные задачи не выдаются повторно
+	req, _ = http.NewRequest("GET", "/internal/task?max=100", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	results := make([]model.TaskResult, 0, len(response.Tasks))
+	for _, task := range response.Tasks {
+		results = append(results, model.TaskResult{ID: task.ID, Result: 1, LeaseToken: response.Lease.Token})
+	}
+	body, err := json.Marshal(map[string]interface{}{"results": results})
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("POST", "/internal/tasks/results", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for _, task := range response.Tasks {
+		if memoryQueue {
+			break
+		}
+		var result float64
+		err = db.QueryRow("SELECT result FROM tasks WHERE id = ?", task.ID).Scan(&result)
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, result)
+	}
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=0", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLongPollTask(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_8",
+		Password: "password",
+	}
+
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	// Разбираем все готовые задачи из предыдущих тестов
+	req, _ := http.NewRequest("GET", "/internal/task?max=100", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	req, _ = http.NewRequest("GET", "/internal/task?wait=10ms", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	done := make(chan *httptest.ResponseRecorder)
+	start := time.Now()
+	go func() {
+		req, _ := http.NewRequest("GET", "/internal/task?wait=5s", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		done <- w
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	payload := `{"expression": "6 * 7"}`
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	w = <-done
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Less(t, time.Since(start), 900*time.Millisecond)
+
+	var taskResponse map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &taskResponse)
+	assert.NoError(t, err)
+
+	task := taskResponse["task"].(map[string]interface{})
+	assert.Equal(t, response["id"], task["expression_id"])
+}
+
+func TestAgentRegistry(t *testing.T) {
+	router := setupRouter()
+	adminToken := newAdminToken(t)
+
+	user := &model.User{
+		Name:     "user_9",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"id": "agent_1", "hostname": "host_1", "workers": 2, "version": "1.1.0", "bench_score": 1500000}`
+	req, _ := http.NewRequest("POST", "/internal/agents", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("POST", "/internal/agents/agent_1/heartbeat", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("POST", "/internal/agents/unknown/heartbeat", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	payload = `{"expression": "3 * 3"}`
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=100&agent_id=agent_1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("GET", "/api/v1/agents", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Agents []model.Agent `json:"agents"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Len(t, response.Agents, 1)
+	assert.Equal(t, "alive", response.Agents[0].Status)
+	assert.Equal(t, 2, response.Agents[0].Workers)
+	assert.Equal(t, 1500000.0, response.Agents[0].BenchScore)
+	if !memoryQueue {
+		// Аренды агента считаются по таблице task_leases
+		assert.Greater(t, response.Agents[0].CurrentLeases, 0)
+	}
+
+	// Агент без heartbeat считается мёртвым, его задачи снова доступны
+	dead, err := handler.MarkDeadAgents(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dead)
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=100", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCapabilityRouting(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_10",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"id": "agent_div", "workers": 1, "operations": ["/"], "throughput": {"/": 10.5}}`
+	req, _ := http.NewRequest("POST", "/internal/agents", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	payload = `{"id": "agent_bad", "operations": ["^"]}`
+	req, _ = http.NewRequest("POST", "/internal/agents", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	payload = `{"expression": "8 / 2 + 1"}`
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=100&agent_id=agent_div", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Tasks []model.Task `json:"tasks"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, response.Tasks)
+	for _, task := range response.Tasks {
+		assert.Equal(t, "/", task.Operation)
+	}
+
+	// Сложение не умеет выполнять ни один живой агент
+	req, _ = http.NewRequest("GET", "/api/v1/expressions/"+created["id"], nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var exprResponse struct {
+		Expression struct {
+			Warnings []string `json:"warnings"`
+		} `json:"expression"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &exprResponse)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"no registered agent supports operation +"}, exprResponse.Expression.Warnings)
+}
+
+func TestOperationTimings(t *testing.T) {
+	router := setupRouter()
+	adminToken := newAdminToken(t)
+
+	payload := `{"/": 250, "^": 10}`
+	req, _ := http.NewRequest("PUT", "/api/v1/admin/timings", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	payload = `{"/": 250}`
+	req, _ = http.NewRequest("PUT", "/api/v1/admin/timings", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var durationMS int
+	err := db.QueryRow("SELECT duration_ms FROM operation_timings WHERE operation = '/'").Scan(&durationMS)
+	assert.NoError(t, err)
+	assert.Equal(t, 250, durationMS)
+
+	// Новая длительность сразу отправляется агентам вместе с задачей
+	user := &model.User{
+		Name:     "user_11",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload = `{"expression": "9 / 3"}`
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=100&agent_id=agent_div", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var tasksResponse struct {
+		Tasks []model.Task `json:"tasks"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &tasksResponse)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tasksResponse.Tasks)
+	for _, task := range tasksResponse.Tasks {
+		assert.Equal(t, 250, task.OperationTime)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/admin/timings", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Timings map[string]int `json:"timings"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, 250, response.Timings["/"])
+}
+
+func TestSubmitTaskResultValidation(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_12",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	payload := `{"expression": "5 - 2"}`
+	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	taskID := finalTaskID(t, created["id"])
+
+	req, _ = http.NewRequest("GET", "/internal/task?max=100", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var leaseResponse struct {
+		Lease struct {
+			Token string `json:"token"`
+		} `json:"lease"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &leaseResponse)
+	assert.NoError(t, err)
+	leaseToken := leaseResponse.Lease.Token
+
+	submit := func(id string, result float64, leaseToken string) int {
+		body, _ := json.Marshal(model.TaskResult{ID: id, Result: result, LeaseToken: leaseToken, AgentID: "agent_test"})
+		req, _ := http.NewRequest("POST", "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, submit("unknown", 3, leaseToken))
+	assert.Equal(t, http.StatusConflict, submit(taskID, 3, "wrong-token"))
+	assert.Equal(t, http.StatusOK, submit(taskID, 3, leaseToken))
+	// Повтор того же результата подтверждается, другой результат отклоняется
+	assert.Equal(t, http.StatusOK, submit(taskID, 3, leaseToken))
+	assert.Equal(t, http.StatusConflict, submit(taskID, 4, leaseToken))
+	// Подтверждение повтора получает только держатель аренды
+	assert.Equal(t, http.StatusConflict, submit(taskID, 3, "wrong-token"))
+
+	var result string
+	err = db.QueryRow("SELECT result FROM expressions WHERE id = ?", created["id"]).Scan(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", result)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"results": []model.TaskResult{
+			{ID: taskID, Result: 3, LeaseToken: leaseToken},
+			{ID: "unknown", Result: 1, LeaseToken: leaseToken},
+		},
+	})
+	req, _ = http.NewRequest("POST", "/internal/tasks/results", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var batchResponse struct {
+		Accepted int `json:"accepted"`
+		Rejected []struct {
+			ID     string `json:"id"`
+			Status int    `json:"status"`
+		} `json:"rejected"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &batchResponse)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, batchResponse.Accepted)
+	assert.Len(t, batchResponse.Rejected, 1)
+	assert.Equal(t, "unknown", batchResponse.Rejected[0].ID)
+	assert.Equal(t, http.StatusNotFound, batchResponse.Rejected[0].Status)
+}
+
+func TestReplicatedTasks(t *testing.T) {
+	router := setupRouter()
+	adminToken := newAdminToken(t)
+
+	user := &model.User{
+		Name:     "user_13",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	for _, agentID := range []string{"replica_a", "replica_b", "replica_c"} {
+		payload := `{"id": "` + agentID + `", "hostname": "host", "workers": 1, "version": "1.1.0"}`
+		req, _ := http.NewRequest("POST", "/internal/agents", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	payload := `{"expression": "2 + 3", "replicas": 4}`
+	req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	payload = `{"expression": "2 + 3", "replicas": 2}`
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+	expressionID := created["id"]
+
+	// fetch возвращает токен аренды задачи выражения, выданной агенту, или ""
+	fetch := func(agentID string) string {
+		req, _ := http.NewRequest("GET", "/internal/task?max=100&agent_id="+agentID, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return ""
+		}
+
+		var response struct {
+			Lease model.Lease   `json:"lease"`
+			Tasks []*model.Task `json:"tasks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			return ""
+		}
+		for _, task := range response.Tasks {
+			if task.ExpressionId == expressionID {
+				return response.Lease.Token
+			}
+		}
+		return ""
+	}
+
+	taskID := finalTaskID(t, expressionID)
+
+	submit := func(agentID, leaseToken string, result float64) {
+		body, _ := json.Marshal(model.TaskResult{ID: taskID, Result: result, LeaseToken: leaseToken, AgentID: agentID})
+		req, _ := http.NewRequest("POST", "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	getExpression := func() model.Expression {
+		req, _ := http.NewRequest("GET", "/api/v1/expressions/"+expressionID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Expression model.Expression `json:"expression"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Expression
+	}
+
+	// Каждая реплика выдаётся разным агентам
+	leaseA := fetch("replica_a")
+	assert.NotEmpty(t, leaseA)
+	assert.Empty(t, fetch("replica_a"))
+	leaseB := fetch("replica_b")
+	assert.NotEmpty(t, leaseB)
+	assert.Empty(t, fetch("replica_c"))
+
+	// Реплики не сошлись - задача становится спорной и выдаётся снова
+	submit("replica_a", leaseA, 5)
+	assert.Equal(t, "in_progress", getExpression().Status)
+	submit("replica_b", leaseB, 6)
+
+	expr := getExpression()
+	assert.Equal(t, "in_progress", expr.Status)
+	assert.Equal(t, 2, expr.Replicas)
+	assert.Equal(t, 1, expr.Disputes)
+
+	leaseA = fetch("replica_a")
+	assert.NotEmpty(t, leaseA)
+	leaseC := fetch("replica_c")
+	assert.NotEmpty(t, leaseC)
+
+	submit("replica_a", leaseA, 5)
+	submit("replica_c", leaseC, 5)
+
+	expr = getExpression()
+	assert.Equal(t, "completed", expr.Status)
+	result, err := strconv.ParseFloat(expr.Result.(string), 64)
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, result)
+
+	req, _ = http.NewRequest("GET", "/api/v1/agents", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Agents []model.Agent `json:"agents"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	agents := map[string]model.Agent{}
+	for _, agent := range response.Agents {
+		agents[agent.ID] = agent
+	}
+	assert.Equal(t, 1, agents["replica_b"].ResultsDisputed)
+	assert.Equal(t, 0.0, agents["replica_b"].Reputation)
+	assert.Equal(t, 0, agents["replica_a"].ResultsDisputed)
+	assert.Equal(t, 1.0, agents["replica_a"].Reputation)
+	assert.Equal(t, 1, agents["replica_c"].TasksCompleted)
+}
+
+func TestReplicaDisputes(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_25",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, agentID := range []string{"dispute_a", "dispute_b", "dispute_c"} {
+		w := request("POST", "/internal/agents", `{"id": "`+agentID+`", "hostname": "host", "workers": 1, "version": "1.1.0"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	calculate := func(replicas int) string {
+		w := request("POST", "/api/v1/calculate", `{"expression": "6 / 3", "replicas": `+strconv.Itoa(replicas)+`}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var created map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		return created["id"]
+	}
+
+	// claim возвращает токен аренды задачи выражения, выданной агенту, или ""
+	claim := func(agentID, expressionID string) string {
+		w := request("GET", "/internal/task?max=100&agent_id="+agentID, "")
+		var response struct {
+			Lease model.Lease   `json:"lease"`
+			Tasks []*model.Task `json:"tasks"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		for _, task := range response.Tasks {
+			if task.ExpressionId == expressionID {
+				return response.Lease.Token
+			}
+		}
+		return ""
+	}
+
+	submit := func(taskID, agentID, leaseToken string, result float64) int {
+		body, _ := json.Marshal(model.TaskResult{ID: taskID, Result: result, LeaseToken: leaseToken, AgentID: agentID})
+		return request("POST", "/internal/task", string(body)).Code
+	}
+
+	status := func(expressionID string) string {
+		var status string
+		err := db.QueryRow("SELECT status FROM expressions WHERE id = ?", expressionID).Scan(&status)
+		assert.NoError(t, err)
+		return status
+	}
+
+	// Реплики не выдаются агенту без ID, иначе он прислал бы их все сам
+	expressionID := calculate(2)
+	taskID := finalTaskID(t, expressionID)
+	assert.Empty(t, claim("", expressionID))
+
+	// Реплики ни разу не сошлись - после нескольких спорных раундов
+	// выражение завершается неудачей, а не выдаётся бесконечно
+	for round := 0; status(expressionID) == "in_progress"; round++ {
+		if round == 10 {
+			t.Fatal("disputed task is re-queued forever")
+		}
+		leaseA, leaseB := claim("dispute_a", expressionID), claim("dispute_b", expressionID)
+		assert.NotEmpty(t, leaseA)
+		assert.NotEmpty(t, leaseB)
+		assert.Equal(t, http.StatusOK, submit(taskID, "dispute_a", leaseA, 2))
+		assert.Equal(t, http.StatusOK, submit(taskID, "dispute_b", leaseB, 3))
+	}
+	assert.Equal(t, "failed", status(expressionID))
+
+	w := request("GET", "/api/v1/expressions/"+expressionID, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Expression model.Expression `json:"expression"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 3, response.Expression.Disputes)
+
+	// Опоздавшая реплика, разошедшаяся с принятым результатом, отклоняется
+	// и теряет репутацию
+	expressionID = calculate(3)
+	taskID = finalTaskID(t, expressionID)
+	leases := map[string]string{}
+	for _, agentID := range []string{"dispute_a", "dispute_b", "dispute_c"} {
+		leases[agentID] = claim(agentID, expressionID)
+		assert.NotEmpty(t, leases[agentID])
+	}
+	assert.Equal(t, http.StatusOK, submit(taskID, "dispute_a", leases["dispute_a"], 2))
+	assert.Equal(t, http.StatusOK, submit(taskID, "dispute_b", leases["dispute_b"], 2))
+	assert.Equal(t, "completed", status(expressionID))
+
+	var disputed int
+	err = db.QueryRow("SELECT results_disputed FROM agents WHERE id = 'dispute_c'").Scan(&disputed)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, submit(taskID, "dispute_c", leases["dispute_c"], 3))
+	assert.Equal(t, http.StatusConflict, submit(taskID, "dispute_c", leases["dispute_c"], 3))
+
+	var after int
+	err = db.QueryRow("SELECT results_disputed FROM agents WHERE id = 'dispute_c'").Scan(&after)
+	assert.NoError(t, err)
+	assert.Equal(t, disputed+1, after)
+}
+
+func TestUserLimits(t *testing.T) {
+	router := setupRouter()
+	adminToken := newAdminToken(t)
+
+	user := &model.User{
+		Name:     "user_14",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	setLimits := func(userID, payload string) int {
+		req, _ := http.NewRequest("PUT", "/api/v1/admin/users/"+userID+"/limits", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	calculate := func(expression string) *httptest.ResponseRecorder {
+		payload := `{"expression": "` + expression + `"}`
+		req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	userID := strconv.FormatInt(userId, 10)
+	assert.Equal(t, http.StatusNotFound, setLimits("100000", `{"expressions_per_minute": 2}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, setLimits(userID, `{"expressions_per_minute": -1}`))
+	assert.Equal(t, http.StatusOK, setLimits(userID, `{"expressions_per_minute": 2, "max_expression_length": 10}`))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, calculate("1 + 1 + 1 + 1").Code)
+	assert.Equal(t, http.StatusCreated, calculate("1 + 1").Code)
+	assert.Equal(t, http.StatusCreated, calculate("1 + 1").Code)
+
+	w := calculate("1 + 1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60)
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/users/"+userID+"/limits", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Limits struct {
+			ExpressionsPerMinute int `json:"expressions_per_minute"`
+			MaxPendingTasks      int `json:"max_pending_tasks"`
+		} `json:"limits"`
+		Usage model.UserUsage `json:"usage"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, response.Limits.ExpressionsPerMinute)
+	assert.Equal(t, 1000, response.Limits.MaxPendingTasks)
+	assert.Equal(t, 2, response.Usage.ExpressionsLastMinute)
+	assert.Equal(t, 2, response.Usage.PendingTasks)
+
+	// Без ограничения по частоте упираемся в лимит нерешённых задач
+	assert.Equal(t, http.StatusOK, setLimits(userID, `{"expressions_per_minute": 0, "max_pending_tasks": 2}`))
+	w = calculate("1 + 1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Сброс персональных лимитов возвращает лимиты по умолчанию
+	assert.Equal(t, http.StatusOK, setLimits(userID, `{}`))
+	assert.Equal(t, http.StatusCreated, calculate("1 + 1").Code)
+}
+
+func TestUserLimitsConcurrent(t *testing.T) {
+	router := setupRouter()
+	adminToken := newAdminToken(t)
+
+	user := &model.User{
+		Name:     "user_" + uuid.NewString(),
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/admin/users/"+strconv.FormatInt(userId, 10)+"/limits",
+		bytes.NewBufferString(`{"expressions_per_minute": 3}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Одновременные запросы не проходят лимит вместе
+	const requests = 10
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "1 + 1"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, code)
+		}
+	}
+	assert.Equal(t, 3, created)
+
+	// Токен пользователя, которого нет в базе
+	token, err = middleware.GenerateToken("user_deleted", 1000000)
+	assert.NoError(t, err)
+	req, _ = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "1 + 1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestSchedules(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_15",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnprocessableEntity, request("POST", "/api/v1/schedules", `{"expression": "2 + 2"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, request("POST", "/api/v1/schedules", `{"expression": "2 + 2", "cron": "@daily", "interval_ms": 60000}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, request("POST", "/api/v1/schedules", `{"expression": "2 + 2", "cron": "61 * * * *"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, request("POST", "/api/v1/schedules", `{"expression": "2 + 2", "interval_ms": 10}`).Code)
+
+	w := request("POST", "/api/v1/schedules", `{"expression": "2 + 2", "cron": "@daily"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created struct {
+		ID        string `json:"id"`
+		NextRunAt int64  `json:"next_run_at"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+	assert.Greater(t, created.NextRunAt, time.Now().UnixMilli())
+	dailyID := created.ID
+
+	w = request("POST", "/api/v1/schedules", `{"expression": "2 + 3", "interval_ms": 60000}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+	scheduleID := created.ID
+
+	// Переносим запуск в прошлое, чтобы планировщик сработал сразу
+	_, err = db.Exec("UPDATE schedules SET next_run_at = ? WHERE id = ?", time.Now().UnixMilli()-1, scheduleID)
+	assert.NoError(t, err)
+
+	runs, err := handler.RunDueSchedules(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, runs)
+
+	// Следующий запуск уже запланирован, повторно расписание не срабатывает
+	runs, err = handler.RunDueSchedules(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, runs)
+
+	w = request("GET", "/api/v1/schedules/"+scheduleID, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Schedule model.Schedule `json:"schedule"`
+		Runs     []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"runs"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, "active", response.Schedule.Status)
+	assert.Greater(t, response.Schedule.LastRunAt, int64(0))
+	assert.Greater(t, response.Schedule.NextRunAt, time.Now().UnixMilli())
+	assert.Len(t, response.Runs, 1)
+	assert.Equal(t, "in_progress", response.Runs[0].Status)
+
+	var scheduleRef string
+	err = db.QueryRow("SELECT schedule_id FROM expressions WHERE id = ?", response.Runs[0].ID).Scan(&scheduleRef)
+	assert.NoError(t, err)
+	assert.Equal(t, scheduleID, scheduleRef)
+
+	// Приостановленное расписание не запускается
+	assert.Equal(t, http.StatusOK, request("POST", "/api/v1/schedules/"+scheduleID+"/pause", "").Code)
+	_, err = db.Exec("UPDATE schedules SET next_run_at = ? WHERE id = ?", time.Now().UnixMilli()-1, scheduleID)
+	assert.NoError(t, err)
+	runs, err = handler.RunDueSchedules(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, runs)
+
+	assert.Equal(t, http.StatusOK, request("POST", "/api/v1/schedules/"+scheduleID+"/resume", "").Code)
+
+	w = request("GET", "/api/v1/schedules", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Schedules []model.Schedule `json:"schedules"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	assert.NoError(t, err)
+	assert.Len(t, list.Schedules, 2)
+
+	// Чужое расписание недоступно
+	otherToken, err := middleware.GenerateToken("user_1", 1)
+	assert.NoError(t, err)
+	req, _ := http.NewRequest("DELETE", "/api/v1/schedules/"+dailyID, nil)
+	req.Header.Set("Authorization", "Bearer "+otherToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/schedules/"+dailyID, "").Code)
+	assert.Equal(t, http.StatusNotFound, request("GET", "/api/v1/schedules/"+dailyID, "").Code)
+}
+
+func TestScheduleFailureDoesNotBlockOthers(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_" + uuid.NewString(),
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	addSchedule := func(expression string) string {
+		req, _ := http.NewRequest("POST", "/api/v1/schedules",
+			bytes.NewBufferString(`{"expression": "`+expression+`", "interval_ms": 60000}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		return created.ID
+	}
+	failingID := addSchedule("3 + 4")
+	laterID := addSchedule("4 + 5")
+
+	// Первое по времени расписание падает при сохранении выражения
+	now := time.Now().UnixMilli()
+	_, err = db.Exec("UPDATE schedules SET next_run_at = ? WHERE id = ?", now-2, failingID)
+	assert.NoError(t, err)
+	_, err = db.Exec("UPDATE schedules SET next_run_at = ? WHERE id = ?", now-1, laterID)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE TRIGGER fail_schedule BEFORE INSERT ON expressions
+		WHEN NEW.schedule_id = '` + failingID + `'
+		BEGIN SELECT RAISE(ABORT, 'insert failed'); END`)
+	assert.NoError(t, err)
+	defer db.Exec("DROP TRIGGER IF EXISTS fail_schedule")
+
+	runs, err := handler.RunDueSchedules(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, runs)
+
+	var laterRuns int
+	err = db.QueryRow("SELECT COUNT(*) FROM expressions WHERE schedule_id = ?", laterID).Scan(&laterRuns)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, laterRuns)
+
+	// Упавшее расписание отложено, а не запускается на каждом тике
+	var nextRunAt int64
+	err = db.QueryRow("SELECT next_run_at FROM schedules WHERE id = ?", failingID).Scan(&nextRunAt)
+	assert.NoError(t, err)
+	assert.Greater(t, nextRunAt, time.Now().UnixMilli())
+}
+
+func TestExpressionReferences(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_16",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	calculate := func(token, expression string) (int, string) {
+		body, _ := json.Marshal(map[string]string{"expression": expression})
+		req, _ := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var created map[string]string
+		json.Unmarshal(w.Body.Bytes(), &created)
+		return w.Code, created["id"]
+	}
+
+	// solve выдаёт агенту задачу выражения и отправляет её результат
+	solve := func(expressionID string, result float64) {
+		req, _ := http.NewRequest("GET", "/internal/task?max=100", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Lease model.Lease   `json:"lease"`
+			Tasks []*model.Task `json:"tasks"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+		for _, task := range response.Tasks {
+			if task.ExpressionId != expressionID {
+				continue
+			}
+			body, _ := json.Marshal(model.TaskResult{ID: task.ID, Result: result, LeaseToken: response.Lease.Token})
+			req, _ := http.NewRequest("POST", "/internal/task", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			return
+		}
+		t.Fatalf("task of expression %s was not dispatched", expressionID)
+	}
+
+	status := func(expressionID string) string {
+		var status string
+		err := db.QueryRow("SELECT status FROM expressions WHERE id = ?", expressionID).Scan(&status)
+		assert.NoError(t, err)
+		return status
+	}
+
+	code, base := calculate(token, "2 * 3")
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, dependent := calculate(token, `expr("`+base+`") * 1.5`)
+	assert.Equal(t, http.StatusCreated, code)
+
+	// arg1 возвращает первый аргумент задачи выражения. Задачи в базе хранит
+	// только SQLiteQueue, с очередью в памяти подстановку результата
+	// проверяет то, что задача выдаётся агентам
+	arg1 := func(expressionID, want string) {
+		if memoryQueue {
+			return
+		}
+		var arg1 string
+		err := db.QueryRow("SELECT arg1 FROM tasks WHERE expression_id = ?", expressionID).Scan(&arg1)
+		assert.NoError(t, err)
+		if want == "" {
+			_, err = uuid.Parse(arg1)
+			assert.NoError(t, err)
+			return
+		}
+		assert.Equal(t, want, arg1)
+	}
+
+	// Задача зависимого выражения ждёт результата базового
+	arg1(dependent, "")
+
+	solve(base, 6)
+	arg1(dependent, "6")
+
+	solve(dependent, 9)
+	assert.Equal(t, "completed", status(dependent))
+
+	// Ссылка на вычисленное выражение сразу заменяется его результатом
+	code, completedRef := calculate(token, `expr("`+base+`") + 1`)
+	assert.Equal(t, http.StatusCreated, code)
+	arg1(completedRef, "6")
+
+	result := func(expressionID string) string {
+		var result sql.NullString
+		err := db.QueryRow("SELECT result FROM expressions WHERE id = ?", expressionID).Scan(&result)
+		assert.NoError(t, err)
+		return result.String
+	}
+
+	// Выражение из одной ссылки завершается результатом ссылки: сразу,
+	// если он уже есть, иначе после завершения выражения, на которое оно ссылается
+	code, onlyRef := calculate(token, `expr("`+base+`")`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "completed", status(onlyRef))
+	assert.Equal(t, "6", result(onlyRef))
+
+	code, inFlight := calculate(token, "4 + 4")
+	assert.Equal(t, http.StatusCreated, code)
+	code, onlyPendingRef := calculate(token, `expr("`+inFlight+`")`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "in_progress", status(onlyPendingRef))
+	solve(inFlight, 8)
+	solve(onlyPendingRef, 8)
+	assert.Equal(t, "completed", status(onlyPendingRef))
+	assert.Equal(t, "8", result(onlyPendingRef))
+
+	// Отмена выражения проваливает ссылающиеся на него выражения
+	code, cancelled := calculate(token, "1 + 1")
+	assert.Equal(t, http.StatusCreated, code)
+	code, first := calculate(token, `expr("`+cancelled+`") - 1`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, second := calculate(token, `expr("`+first+`") * 2`)
+	assert.Equal(t, http.StatusCreated, code)
+
+	req, _ := http.NewRequest("DELETE", "/api/v1/expressions/"+cancelled, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "failed", status(first))
+	assert.Equal(t, "failed", status(second))
+
+	code, _ = calculate(token, `expr("`+cancelled+`") + 1`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// На чужие и несуществующие выражения ссылаться нельзя
+	otherToken, err := middleware.GenerateToken("user_1", 1)
+	assert.NoError(t, err)
+	code, _ = calculate(otherToken, `expr("`+base+`") + 1`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = calculate(token, `expr("unknown") + 1`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// Большой результат подставляется без экспоненты, иначе задача не выдаётся агентам
+	code, large := calculate(otherToken, "1000000000 * 1000000000000")
+	assert.Equal(t, http.StatusCreated, code)
+	code, waiting := calculate(otherToken, `expr("`+large+`") + 1`)
+	assert.Equal(t, http.StatusCreated, code)
+
+	solve(large, 1e21)
+	arg1(waiting, "1000000000000000000000")
+	solve(waiting, 1e21+1)
+	assert.Equal(t, "completed", status(waiting))
+
+	code, resolved := calculate(otherToken, `expr("`+large+`") + 1`)
+	assert.Equal(t, http.StatusCreated, code)
+	arg1(resolved, "1000000000000000000000")
+	solve(resolved, 1e21+1)
+	assert.Equal(t, "completed", status(resolved))
+}
+
+func TestAdmissionControl(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_17",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var queue struct {
+		QueuedTasks      int `json:"queued_tasks"`
+		WaitingAdmission int `json:"waiting_admission"`
+	}
+	w := request("GET", "/api/v1/queue", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &queue)
+	assert.NoError(t, err)
+
+	// Оставляем в очереди место ровно для одной задачи
+	t.Setenv("MAX_QUEUED_TASKS", strconv.Itoa(queue.QueuedTasks+1))
+
+	w = request("POST", "/api/v1/calculate", `{"expression": "1 + 1"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+	admittedID := created["id"]
+
+	w = request("POST", "/api/v1/calculate", `{"expression": "1 + 1"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	t.Setenv("ADMISSION_MODE", "queue")
+	w = request("POST", "/api/v1/calculate", `{"expression": "2 + 2"}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+	assert.Equal(t, "waiting_admission", created["status"])
+	waitingID := created["id"]
+
+	var tasks int
+	err = db.QueryRow("SELECT COUNT(*) FROM tasks WHERE expression_id = ?", waitingID).Scan(&tasks)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tasks)
+
+	// Выражение, ссылающееся на ожидающее допуска, ждёт вместе с ним,
+	// даже если его самого можно было бы отклонить
+	t.Setenv("ADMISSION_MODE", "reject")
+	w = request("POST", "/api/v1/calculate", `{"expression": "expr(\"`+waitingID+`\") * 2"}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+	assert.Equal(t, "waiting_admission", created["status"])
+	dependentID := created["id"]
+
+	w = request("GET", "/api/v1/queue", "")
+	err = json.Unmarshal(w.Body.Bytes(), &queue)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.WaitingAdmission)
+
+	admitted, err := handler.AdmitWaitingExpressions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, admitted)
+
+	// Отмена выражения освобождает место в очереди
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/expressions/"+admittedID, "").Code)
+
+	admitted, err = handler.AdmitWaitingExpressions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, admitted)
+
+	var status string
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", waitingID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "in_progress", status)
+	if !memoryQueue {
+		err = db.QueryRow("SELECT COUNT(*) FROM tasks WHERE expression_id = ?", waitingID).Scan(&tasks)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, tasks)
+	}
+
+	// Зависимое выражение допускается, когда для него найдётся место,
+	// и его задача ждёт результата допущенного выражения
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", dependentID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "waiting_admission", status)
+
+	t.Setenv("MAX_QUEUED_TASKS", "0")
+	admitted, err = handler.AdmitWaitingExpressions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, admitted)
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", dependentID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "in_progress", status)
+	if !memoryQueue {
+		var arg1 string
+		err = db.QueryRow("SELECT arg1 FROM tasks WHERE expression_id = ?", dependentID).Scan(&arg1)
+		assert.NoError(t, err)
+		assert.Equal(t, finalTaskID(t, waitingID), arg1)
+	}
+}
+
+func TestFailTaskAndExtendLease(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_18",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/api/v1/calculate", `{"expression": "7 / 0"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	w = request("GET", "/internal/task?max=100", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var leaseResponse struct {
+		Lease struct {
+			Token     string `json:"token"`
+			ExpiresAt int64  `json:"expires_at"`
+		} `json:"lease"`
+		Tasks []model.Task `json:"tasks"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &leaseResponse)
+	assert.NoError(t, err)
+
+	var taskID string
+	for _, task := range leaseResponse.Tasks {
+		if task.ExpressionId == created["id"] {
+			taskID = task.ID
+		}
+	}
+	assert.NotEmpty(t, taskID)
+	leaseToken := leaseResponse.Lease.Token
+
+	w = request("POST", "/internal/leases/"+leaseToken+"/extend", `{"duration_ms": 300000}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var extended struct {
+		ExpiresAt int64 `json:"expires_at"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &extended)
+	assert.NoError(t, err)
+	assert.Greater(t, extended.ExpiresAt, leaseResponse.Lease.ExpiresAt)
+
+	assert.Equal(t, http.StatusNotFound, request("POST", "/internal/leases/unknown/extend", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/internal/leases/"+leaseToken+"/extend", `{"duration_ms": -1}`).Code)
+
+	fail := func(id, leaseToken string) int {
+		body, _ := json.Marshal(map[string]string{"id": id, "lease_token": leaseToken, "error": "division by zero"})
+		return request("POST", "/internal/task/fail", string(body)).Code
+	}
+	assert.Equal(t, http.StatusNotFound, fail("unknown", leaseToken))
+	assert.Equal(t, http.StatusConflict, fail(taskID, "wrong-token"))
+	assert.Equal(t, http.StatusOK, fail(taskID, leaseToken))
+
+	var status string
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", created["id"]).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", status)
+}
+
+func TestCriticalPathOrdering(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_19",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Деление быстрее умножения
+	req, _ := http.NewRequest("PUT", "/api/v1/admin/timings", bytes.NewBufferString(`{"/": 250}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+newAdminToken(t))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Готовы задачи 8 / 2 и 5 * 6, но путь до результата через 5 * 6
+	// длиннее, поэтому она выдаётся первой, хотя 8 / 2 стоит раньше
+	w = request("POST", "/api/v1/calculate", `{"expression": "8 / 2 + 5 * 6", "priority": 7}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	type taskResponse struct {
+		Task model.Task `json:"task"`
+	}
+	claim := func() model.Task {
+		w := request("GET", "/internal/task", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response taskResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		return response.Task
+	}
+
+	first := claim()
+	assert.Equal(t, created["id"], first.ExpressionId)
+	assert.Equal(t, "*", first.Operation)
+	assert.Equal(t, "5", first.Arg1)
+
+	// Вычисляем выражение до конца
+	submit := func(task model.Task) {
+		a, _ := strconv.ParseFloat(task.Arg1.(string), 64)
+		b, _ := strconv.ParseFloat(task.Arg2.(string), 64)
+		result := a + b
+		switch task.Operation {
+		case "*":
+			result = a * b
+		case "/":
+			result = a / b
+		}
+		body, _ := json.Marshal(model.TaskResult{ID: task.ID, Result: result, LeaseToken: task.LeaseToken})
+		assert.Equal(t, http.StatusOK, request("POST", "/internal/task", string(body)).Code)
+	}
+	submit(first)
+	for i := 0; i < 2; i++ {
+		task := claim()
+		assert.Equal(t, created["id"], task.ExpressionId)
+		submit(task)
+	}
+
+	w = request("GET", "/api/v1/expressions/"+created["id"], "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Expression struct {
+			Status       string `json:"status"`
+			Result       string `json:"result"`
+			CriticalPath int    `json:"critical_path_ms"`
+			Makespan     *int64 `json:"makespan_ms"`
+		} `json:"expression"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, "completed", response.Expression.Status)
+	result, err := strconv.ParseFloat(response.Expression.Result, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, 34.0, result)
+	assert.Greater(t, response.Expression.CriticalPath, 0)
+	assert.NotNil(t, response.Expression.Makespan)
+}
+
+func TestChainedOperators(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_" + uuid.NewString(),
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Операции одного приоритета подряд выполняются слева направо,
+	// результат каждой становится аргументом следующей
+	cases := map[string]float64{
+		"2 - 3 - 4":             -5,
+		"2 * 3 * 4":             24,
+		"8 / 2 / 2":             2,
+		"1 + 2 + 3 + 4 + 5 * 6": 40,
+		"10 - 2 * 3 * 1 - 1":    3,
+	}
+	for expression, want := range cases {
+		w := request("POST", "/api/v1/calculate", `{"expression": "`+expression+`"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var created map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+		// Решаем задачи выражения по мере готовности, чужие задачи возвращаем в очередь
+		for round := 0; round < 10; round++ {
+			w := request("GET", "/internal/task?max=100", "")
+			if w.Code != http.StatusOK {
+				break
+			}
+			var response struct {
+				Lease model.Lease   `json:"lease"`
+				Tasks []*model.Task `json:"tasks"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+			var results []model.TaskResult
+			var others []string
+			for _, task := range response.Tasks {
+				if task.ExpressionId != created["id"] {
+					others = append(others, task.ID)
+					continue
+				}
+				a, _ := strconv.ParseFloat(task.Arg1.(string), 64)
+				b, _ := strconv.ParseFloat(task.Arg2.(string), 64)
+				var result float64
+				switch task.Operation {
+				case "+":
+					result = a + b
+				case "-":
+					result = a - b
+				case "*":
+					result = a * b
+				case "/":
+					result = a / b
+				}
+				results = append(results, model.TaskResult{ID: task.ID, Result: result, LeaseToken: response.Lease.Token})
+			}
+			if len(others) > 0 {
+				body, _ := json.Marshal(map[string]interface{}{"task_ids": others})
+				request("POST", "/internal/leases/"+response.Lease.Token+"/release", string(body))
+			}
+			if len(results) == 0 {
+				break
+			}
+			body, _ := json.Marshal(map[string]interface{}{"results": results})
+			assert.Equal(t, http.StatusOK, request("POST", "/internal/tasks/results", string(body)).Code)
+		}
+
+		var status string
+		var result sql.NullString
+		err := db.QueryRow("SELECT status, result FROM expressions WHERE id = ?", created["id"]).Scan(&status, &result)
+		assert.NoError(t, err)
+		assert.Equal(t, "completed", status, expression)
+		value, err := strconv.ParseFloat(result.String, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, want, value, expression)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	user := &model.User{
+		Name:     "user_20",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(ctx, db, user)
+	assert.NoError(t, err)
+
+	insert := func(expression, status string, result interface{}) string {
+		expr := &model.Expression{
+			ID:         uuid.New().String(),
+			UserId:     int(userId),
+			Expression: expression,
+			Status:     status,
+			Result:     result,
+		}
+		_, err := database.InsertExpression(ctx, db, expr)
+		assert.NoError(t, err)
+		return expr.ID
+	}
+
+	// Оркестратор остановился, успев сохранить только часть задач
+	stalledID := insert("2 * 3 + 1", "pending", nil)
+	err = database.InsertTasks(ctx, db, []*model.Task{
+		{ID: uuid.New().String(), Arg1: "2", Arg2: "3", Operation: "*", ExpressionId: stalledID},
+	})
+	assert.NoError(t, err)
+
+	// Выражение без операций
+	numberID := insert("5", "pending", nil)
+
+	// Результат первой задачи не подставлен во вторую
+	firstID, secondID := uuid.New().String(), uuid.New().String()
+	solvedID := insert("4 + 4 + 1", "in_progress", secondID)
+	err = database.InsertTasks(ctx, db, []*model.Task{
+		{ID: firstID, Arg1: "4", Arg2: "4", Operation: "+", ExpressionId: solvedID},
+		{ID: secondID, Arg1: firstID, Arg2: "1", Operation: "+", ExpressionId: solvedID},
+	})
+	assert.NoError(t, err)
+	_, err = db.Exec("UPDATE tasks SET result = 8 WHERE id = ?", firstID)
+	assert.NoError(t, err)
+
+	// Задача, арендованная агентом, которого оркестратор не знает
+	_, err = db.Exec(`INSERT INTO task_leases (token, task_id, agent_id, expires_at, status)
+		VALUES (?, ?, 'vanished_agent', ?, 'active')`,
+		uuid.New().String(), secondID, time.Now().Add(time.Hour).UnixMilli())
+	assert.NoError(t, err)
+
+	// Результат, записанный старой версией с экспонентой, и аренда агента
+	// без ID, который ещё может прислать ответ
+	largeID, nextID := uuid.New().String(), uuid.New().String()
+	largeExprID := insert("1000000000000000000000 + 0 + 1", "in_progress", nextID)
+	err = database.InsertTasks(ctx, db, []*model.Task{
+		{ID: largeID, Arg1: "1000000000000000000000", Arg2: "0", Operation: "+", ExpressionId: largeExprID},
+		{ID: nextID, Arg1: largeID, Arg2: "1", Operation: "+", ExpressionId: largeExprID},
+	})
+	assert.NoError(t, err)
+	_, err = db.Exec("UPDATE tasks SET result = '1.0e+21' WHERE id = ?", largeID)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO task_leases (token, task_id, agent_id, expires_at, status)
+		VALUES (?, ?, NULL, ?, 'active')`,
+		uuid.New().String(), nextID, time.Now().Add(time.Hour).UnixMilli())
+	assert.NoError(t, err)
+
+	// Выражение пользователя, которого больше нет, не перезапускается
+	orphanID := uuid.New().String()
+	_, err = database.InsertExpression(ctx, db, &model.Expression{
+		ID:         orphanID,
+		UserId:     1000000,
+		Expression: "1 + 1",
+		Status:     "pending",
+	})
+	assert.NoError(t, err)
+
+	// Очередь в памяти после перезапуска пуста. Задачу в ней арендует агент,
+	// которого оркестратор не знает, до того как сверка освободит его аренды
+	var restarted *queue.MemoryQueue
+	ghostTaskID := uuid.New().String()
+	if memoryQueue {
+		restarted = queue.NewMemoryQueue(queue.NewSQLStore(db))
+		handler.SetTaskQueue(restarted)
+
+		err = restarted.Enqueue(ctx,
+			&model.Expression{ID: uuid.New().String(), UserId: int(userId), Result: ghostTaskID, Replicas: 1},
+			[]*model.Task{{ID: ghostTaskID, Arg1: "1", Arg2: "2", Operation: "+"}})
+		assert.NoError(t, err)
+		lease, err := restarted.Claim(ctx, queue.ClaimRequest{AgentID: "vanished_agent", Max: 1, LeaseDuration: time.Hour})
+		assert.NoError(t, err)
+		assert.NotNil(t, lease)
+	}
+
+	summary, err := handler.Reconcile(ctx)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, summary.Restarted, 1)
+	assert.GreaterOrEqual(t, summary.Released, 1)
+
+	var status string
+	var tasks int
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", stalledID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "in_progress", status)
+
+	var result string
+	err = db.QueryRow("SELECT status, result FROM expressions WHERE id = ?", numberID).Scan(&status, &result)
+	assert.NoError(t, err)
+	assert.Equal(t, "completed", status)
+	value, _ := strconv.ParseFloat(result, 64)
+	assert.Equal(t, 5.0, value)
+
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", orphanID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", status)
+	err = db.QueryRow("SELECT COUNT(*) FROM tasks WHERE expression_id = ?", orphanID).Scan(&tasks)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tasks)
+
+	if memoryQueue {
+		// Задача освобождённой аренды снова выдаётся, а задачи
+		// перезапущенного выражения стоят в очереди в памяти
+		lease, err := restarted.Claim(ctx, queue.ClaimRequest{AgentID: "agent_20", Max: 10000, LeaseDuration: time.Hour})
+		assert.NoError(t, err)
+		if assert.NotNil(t, lease) {
+			var ghost, stalled bool
+			for _, task := range lease.Tasks {
+				ghost = ghost || task.ID == ghostTaskID
+				stalled = stalled || task.ExpressionId == stalledID
+			}
+			assert.True(t, ghost, "task of the released lease must be dispatched again")
+			assert.True(t, stalled, "stalled expression must be enqueued")
+		}
+		return
+	}
+
+	err = db.QueryRow("SELECT COUNT(*) FROM tasks WHERE expression_id = ?", stalledID).Scan(&tasks)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tasks)
+
+	var arg1 string
+	err = db.QueryRow("SELECT arg1 FROM tasks WHERE id = ?", secondID).Scan(&arg1)
+	assert.NoError(t, err)
+	value, _ = strconv.ParseFloat(arg1, 64)
+	assert.Equal(t, 8.0, value)
+
+	var leaseStatus string
+	err = db.QueryRow("SELECT status FROM task_leases WHERE task_id = ?", secondID).Scan(&leaseStatus)
+	assert.NoError(t, err)
+	assert.Equal(t, "released", leaseStatus)
+
+	err = db.QueryRow("SELECT arg1 FROM tasks WHERE id = ?", nextID).Scan(&arg1)
+	assert.NoError(t, err)
+	assert.Equal(t, "1000000000000000000000", arg1)
+	err = db.QueryRow("SELECT status FROM task_leases WHERE task_id = ?", nextID).Scan(&leaseStatus)
+	assert.NoError(t, err)
+	assert.Equal(t, "active", leaseStatus)
+
+	// Последняя задача ещё не решена, поэтому выражение пока не завершено
+	err = db.QueryRow("SELECT status FROM expressions WHERE id = ?", solvedID).Scan(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, "in_progress", status)
+
+	_, err = db.Exec("UPDATE tasks SET result = 9 WHERE id = ?", secondID)
+	assert.NoError(t, err)
+	summary, err = handler.Reconcile(ctx)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, summary.Finalized, int64(1))
+
+	err = db.QueryRow("SELECT status, result FROM expressions WHERE id = ?", solvedID).Scan(&status, &result)
+	assert.NoError(t, err)
+	assert.Equal(t, "completed", status)
+	value, _ = strconv.ParseFloat(result, 64)
+	assert.Equal(t, 9.0, value)
+}
+
+func TestReleaseLease(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_21",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/api/v1/calculate", `{"expression": "2 + 3"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	claim := func() (string, string) {
+		w := request("GET", "/internal/task?max=100", "")
+		if w.Code != http.StatusOK {
+			return "", ""
+		}
+		var response struct {
+			Lease struct {
+				Token string `json:"token"`
+			} `json:"lease"`
+			Tasks []model.Task `json:"tasks"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		for _, task := range response.Tasks {
+			if task.ExpressionId == created["id"] {
+				return response.Lease.Token, task.ID
+			}
+		}
+		return response.Lease.Token, ""
+	}
+
+	leaseToken, taskID := claim()
+	assert.NotEmpty(t, taskID)
+	_, again := claim()
+	assert.Empty(t, again, "leased task must not be handed out twice")
+
+	w = request("POST", "/internal/leases/"+leaseToken+"/release", `{"task_ids": ["`+taskID+`"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"released":1`)
+
+	assert.Equal(t, http.StatusNotFound, request("POST", "/internal/leases/"+leaseToken+"/release", `{"task_ids": ["`+taskID+`"]}`).Code)
+	assert.Equal(t, http.StatusNotFound, request("POST", "/internal/leases/unknown/release", "").Code)
+
+	// Освобождённая задача сразу выдаётся снова
+	_, again = claim()
+	assert.Equal(t, taskID, again)
+}
+
+func TestReplayedResultsAreDeduplicated(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_22",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/internal/agents", `{"id": "replay_agent", "hostname": "host", "workers": 1, "version": "1.1.0"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request("POST", "/api/v1/calculate", `{"expression": "4 * 5"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	w = request("GET", "/internal/task?max=100&agent_id=replay_agent", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var leaseResponse struct {
+		Lease struct {
+			Token string `json:"token"`
+		} `json:"lease"`
+		Tasks []model.Task `json:"tasks"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &leaseResponse)
+	assert.NoError(t, err)
+
+	var taskID string
+	for _, task := range leaseResponse.Tasks {
+		if task.ExpressionId == created["id"] {
+			taskID = task.ID
+		}
+	}
+	assert.NotEmpty(t, taskID)
+
+	submit := func(result float64) string {
+		body, _ := json.Marshal(map[string]interface{}{"results": []model.TaskResult{{
+			ID: taskID, Result: result, LeaseToken: leaseResponse.Lease.Token, AgentID: "replay_agent",
+		}}})
+		w := request("POST", "/internal/tasks/results", string(body))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	assert.Contains(t, submit(20), `"accepted":1`)
+	// Журнал агента присылает тот же результат по той же аренде ещё раз
+	assert.Contains(t, submit(20), `"accepted":1`)
+	assert.Contains(t, submit(21), `"accepted":0`)
+
+	var completed int
+	err = db.QueryRow("SELECT tasks_completed FROM agents WHERE id = ?", "replay_agent").Scan(&completed)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, completed, "replayed result must not be counted twice")
+
+	var result string
+	err = db.QueryRow("SELECT result FROM expressions WHERE id = ?", created["id"]).Scan(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, "20", result)
+}
+
+func TestGRPCDispatch(t *testing.T) {
+	router := setupRouter()
+
+	user := &model.User{
+		Name:     "user_23",
+		Password: "password",
+	}
+	userId, err := database.InsertUser(context.Background(), db, user)
+	assert.NoError(t, err)
+
+	token, err := middleware.GenerateToken(user.Name, int(userId))
+	assert.NoError(t, err)
+
+	request := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	calculate := func(expression string) string {
+		w := request("POST", "/api/v1/calculate", `{"expression": "`+expression+`"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var created map[string]string
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		return created["id"]
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	dispatchpb.RegisterDispatchServer(server, handler.NewDispatchService())
+	go server.Serve(listener)
+	// Ждём завершения обработчиков потоков: после разрыва они ещё
+	// освобождают задачи, а база следующего прогона уже другая
+	defer server.GracefulStop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := dispatchpb.NewDispatchClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Первым сообщением должен быть Hello
+	bad, err := client.Connect(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, bad.Send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Heartbeat{Heartbeat: &dispatchpb.Heartbeat{}}}))
+	_, err = bad.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.Connect(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Hello{
+		Hello: &dispatchpb.Hello{AgentId: "grpc_agent", Workers: 2, Version: "test"},
+	}}))
+	msg, err := stream.Recv()
+	assert.NoError(t, err)
+	welcome := msg.GetWelcome()
+	if assert.NotNil(t, welcome) {
+		assert.EqualValues(t, 100, welcome.MaxBatch)
+		assert.ElementsMatch(t, []string{"+", "-", "*", "/"}, welcome.Operations)
+	}
+
+	// Агент регистрируется так же, как по HTTP
+	var workers int
+	err = db.QueryRow("SELECT workers FROM agents WHERE id = 'grpc_agent'").Scan(&workers)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, workers)
+
+	// claim запрашивает задачи, пока не придёт задача выражения expressionID
+	claim := func(stream dispatchpb.Dispatch_ConnectClient, expressionID string) (*dispatchpb.Assignment, *dispatchpb.Task) {
+		for i := 0; i < 5; i++ {
+			err := stream.Send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Request{
+				Request: &dispatchpb.TaskRequest{Max: 100},
+			}})
+			assert.NoError(t, err)
+			msg, err := stream.Recv()
+			if !assert.NoError(t, err) {
+				return nil, nil
+			}
+			assignment := msg.GetAssignment()
+			if !assert.NotNil(t, assignment) {
+				return nil, nil
+			}
+			for _, task := range assignment.Tasks {
+				if task.ExpressionId == expressionID {
+					return assignment, task
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	expressionID := calculate("2 + 3")
+	assignment, task := claim(stream, expressionID)
+	if !assert.NotNil(t, task) {
+		return
+	}
+	assert.Equal(t, "2", task.Arg1)
+	assert.Equal(t, "3", task.Arg2)
+	assert.Equal(t, "+", task.Operation)
+
+	assert.NoError(t, stream.Send(&dispatchpb.AgentMessage{Id: 1, Body: &dispatchpb.AgentMessage_Results{
+		Results: &dispatchpb.Results{Results: []*dispatchpb.TaskResult{
+			{Id: task.Id, Result: 5, LeaseToken: assignment.LeaseToken},
+			{Id: "unknown", Result: 1, LeaseToken: assignment.LeaseToken},
+		}},
+	}}))
+	msg, err = stream.Recv()
+	assert.NoError(t, err)
+	ack := msg.GetAck()
+	if assert.NotNil(t, ack) {
+		assert.EqualValues(t, 1, ack.Id)
+		assert.EqualValues(t, http.StatusOK, ack.Status)
+		assert.EqualValues(t, 1, ack.Accepted)
+		if assert.Len(t, ack.Rejected, 1) {
+			assert.EqualValues(t, http.StatusNotFound, ack.Rejected[0].Status)
+		}
+	}
+
+	var result sql.NullString
+	err = db.QueryRow("SELECT result FROM expressions WHERE id = ?", expressionID).Scan(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, "5", result.String)
+
+	assert.NoError(t, stream.Send(&dispatchpb.AgentMessage{Id: 2, Body: &dispatchpb.AgentMessage_Release{
+		Release: &dispatchpb.Release{LeaseToken: "unknown"},
+	}}))
+	msg, err = stream.Recv()
+	assert.NoError(t, err)
+	if ack := msg.GetAck(); assert.NotNil(t, ack) {
+		assert.EqualValues(t, 2, ack.Id)
+		assert.EqualValues(t, http.StatusNotFound, ack.Status)
+	}
+
+	// Об отмене выражения агент узнаёт сразу
+	expressionID = calculate("6 * 7")
+	_, task = claim(stream, expressionID)
+	if !assert.NotNil(t, task) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, request("DELETE", "/api/v1/expressions/"+expressionID, "").Code)
+	msg, err = stream.Recv()
+	assert.NoError(t, err)
+	if cancelled := msg.GetCancel(); assert.NotNil(t, cancelled) {
+		assert.Equal(t, expressionID, cancelled.ExpressionId)
+		assert.Equal(t, []string{task.Id}, cancelled.TaskIds)
+	}
+
+	// Задачи разорванного потока сразу достаются другому агенту
+	expressionID = calculate("4 + 4")
+	_, task = claim(stream, expressionID)
+	if !assert.NotNil(t, task) {
+		return
+	}
+	assert.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Error(t, err)
+
+	other, err := client.Connect(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, other.Send(&dispatchpb.AgentMessage{Body: &dispatchpb.AgentMessage_Hello{
+		Hello: &dispatchpb.Hello{AgentId: "grpc_agent_2", Workers: 1, Version: "test"},
+	}}))
+	msg, err = other.Recv()
+	assert.NoError(t, err)
+	assert.NotNil(t, msg.GetWelcome())
+	_, reclaimed := claim(other, expressionID)
+	if assert.NotNil(t, reclaimed) {
+		assert.Equal(t, task.Id, reclaimed.Id)
+	}
+}
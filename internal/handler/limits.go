@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Лимиты по умолчанию для пользователей без персональных лимитов.
+// 0 — без ограничения.
+var defaultLimits = limits{
+	ExpressionsPerMinute: getEnvInt("QUOTA_EXPRESSIONS_PER_MINUTE", 60),
+	MaxPendingTasks:      getEnvInt("QUOTA_MAX_PENDING_TASKS", 1000),
+	MaxExpressionLength:  getEnvInt("QUOTA_MAX_EXPRESSION_LENGTH", 1000),
+}
+
+// Через сколько предлагать повторить запрос, если у пользователя слишком
+// много нерешённых задач: за это время агенты успевают решить часть из них.
+const pendingTasksRetryAfter = 5 * time.Second
+
+// Наименьшее время до повтора запроса, превысившего лимит.
+const minRetryAfter = time.Second
+
+// limits — лимиты, действующие для пользователя.
+type limits struct {
+	ExpressionsPerMinute int `json:"expressions_per_minute"`
+	MaxPendingTasks      int `json:"max_pending_tasks"`
+	MaxExpressionLength  int `json:"max_expression_length"`
+}
+
+func effectiveLimits(overrides *model.UserLimits) limits {
+	l := defaultLimits
+	if overrides.ExpressionsPerMinute != nil {
+		l.ExpressionsPerMinute = *overrides.ExpressionsPerMinute
+	}
+	if overrides.MaxPendingTasks != nil {
+		l.MaxPendingTasks = *overrides.MaxPendingTasks
+	}
+	if overrides.MaxExpressionLength != nil {
+		l.MaxExpressionLength = *overrides.MaxExpressionLength
+	}
+	return l
+}
+
+// quotaError описывает превышенный лимит. Если повтор запроса позже
+// может помочь, retryAfter больше нуля.
+type quotaError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return e.message
+}
+
+// checkQuota проверяет лимиты, которые не зависят от других выражений
+// пользователя, и возвращает лимиты, действующие для него. Остальные лимиты
+// проверяет insertWithinQuota при сохранении выражения.
+func checkQuota(ctx context.Context, userID int64, expression string) (limits, error) {
+	overrides, err := store.GetUserLimits(ctx, userID)
+	if err != nil {
+		return limits{}, err
+	}
+	l := effectiveLimits(overrides)
+
+	if l.MaxExpressionLength > 0 && len(expression) > l.MaxExpressionLength {
+		return l, &quotaError{message: fmt.Sprintf("expression is longer than %d characters", l.MaxExpressionLength)}
+	}
+	return l, nil
+}
+
+// insertWithinQuota сохраняет выражение из tasks задач, если пользователь
+// не превысил лимиты l на число выражений в минуту и нерешённых задач.
+func insertWithinQuota(ctx context.Context, expr *model.Expression, tasks int, l limits) error {
+	quota := database.Quota{ExpressionsPerMinute: l.ExpressionsPerMinute, MaxPendingTasks: l.MaxPendingTasks}
+	usage, err := store.InsertExpressionWithinQuota(ctx, expr, tasks, quota)
+	switch {
+	case errors.Is(err, database.ErrRateLimitExceeded):
+		// Окно могло сдвинуться, пока шёл запрос: повтор раньше секунды не имеет смысла
+		retryAfter := time.Until(time.UnixMilli(usage.OldestInWindow).Add(time.Minute))
+		if retryAfter < minRetryAfter {
+			retryAfter = minRetryAfter
+		}
+		return &quotaError{
+			message:    fmt.Sprintf("rate limit of %d expressions per minute exceeded", l.ExpressionsPerMinute),
+			retryAfter: retryAfter,
+		}
+	case errors.Is(err, database.ErrPendingTasksExceeded):
+		return &quotaError{
+			message:    fmt.Sprintf("limit of %d pending tasks exceeded", l.MaxPendingTasks),
+			retryAfter: pendingTasksRetryAfter,
+		}
+	}
+	return err
+}
+
+// respondQuotaError отвечает 429 с заголовком Retry-After, если лимит
+// освободится со временем, и 422, если запрос не пройдёт никогда.
+func respondQuotaError(c *gin.Context, err *quotaError) {
+	if err.retryAfter <= 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.message})
+		return
+	}
+
+	seconds := retryAfterSeconds(err.retryAfter)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": err.message, "retry_after": seconds})
+}
+
+func GetUserLimits(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	overrides, err := store.GetUserLimits(ctx, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user limits"})
+		}
+		return
+	}
+
+	usage, err := store.GetUserUsage(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user limits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":   userID,
+		"limits":    effectiveLimits(overrides),
+		"overrides": overrides,
+		"usage":     usage,
+	})
+}
+
+func SetUserLimits(c *gin.Context) {
+	var request model.UserLimits
+
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
+		return
+	}
+
+	for _, v := range []*int{request.ExpressionsPerMinute, request.MaxPendingTasks, request.MaxExpressionLength} {
+		if v != nil && *v < 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "limits must not be negative"})
+			return
+		}
+	}
+
+	err = store.SetUserLimits(c.Request.Context(), userID, &request)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user limits"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":   userID,
+		"limits":    effectiveLimits(&request),
+		"overrides": request,
+	})
+}
@@ -0,0 +1,28 @@
+package handler
+
+import "sync"
+
+// taskNotifier будит агентов, ожидающих задачи в long polling,
+// когда появляются новые готовые к вычислению задачи.
+type taskNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newTaskNotifier() *taskNotifier {
+	return &taskNotifier{ch: make(chan struct{})}
+}
+
+// wait возвращает канал, который закроется при следующем вызове broadcast.
+func (n *taskNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+func (n *taskNotifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"os"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
+)
+
+// taskOrdering возвращает порядок выдачи готовых задач из TASK_ORDERING:
+// critical_path (по умолчанию) или fifo — для сравнения времени вычисления.
+func taskOrdering() string {
+	if os.Getenv("TASK_ORDERING") == queue.OrderFIFO {
+		return queue.OrderFIFO
+	}
+	return queue.OrderCriticalPath
+}
+
+// criticalPaths считает для каждой задачи выражения длину самого долгого
+// пути от неё до результата выражения (время самой задачи плюс время задач,
+// ждущих её результата) и возвращает длину критического пути всего выражения.
+// Задачи идут в порядке planTasks: зависимая задача всегда позже своих аргументов.
+func criticalPaths(tasks []*model.Task) int {
+	downstream := make(map[string]int, len(tasks))
+	for _, task := range tasks {
+		downstream[task.ID] = 0
+	}
+
+	longest := 0
+	for i := len(tasks) - 1; i >= 0; i-- {
+		task := tasks[i]
+		task.CriticalPath = getOperationTime(task.Operation) + downstream[task.ID]
+		if task.CriticalPath > longest {
+			longest = task.CriticalPath
+		}
+
+		for _, arg := range []interface{}{task.Arg1, task.Arg2} {
+			id, ok := arg.(string)
+			if !ok {
+				continue
+			}
+			if path, exists := downstream[id]; exists && task.CriticalPath > path {
+				downstream[id] = task.CriticalPath
+			}
+		}
+	}
+	return longest
+}
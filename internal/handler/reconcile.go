@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/pliliya111/go_final_sprint/internal/database"
+)
+
+// ReconcileSummary — что исправила сверка состояния при запуске оркестратора.
+type ReconcileSummary struct {
+	Restarted int   // выражения, задачи которых заново поставлены в очередь
+	Waiting   int   // выражения, ожидающие места в очереди задач
+	Completed int   // выражения без операций, завершённые своим значением
+	Failed    int   // выражения, которые уже невозможно вычислить
+	Finalized int64 // выражения, все задачи которых были решены
+	Resolved  int64 // задачи, в которые подставлены результаты их зависимостей
+	Released  int   // освобождённые аренды осиротевших задач
+}
+
+func (s *ReconcileSummary) String() string {
+	return fmt.Sprintf("%d expressions restarted, %d waiting for admission, %d completed, %d failed, %d finalized, "+
+		"%d task dependencies resolved, %d orphaned leases released",
+		s.Restarted, s.Waiting, s.Completed, s.Failed, s.Finalized, s.Resolved, s.Released)
+}
+
+// Reconcile исправляет состояние, оставшееся после аварийной остановки
+// оркестратора: подставляет потерянные результаты зависимостей, завершает
+// выражения с решёнными задачами, заново ставит в очередь задачи выражений,
+// застрявших между сохранением и постановкой задач, и освобождает аренды
+// осиротевших задач. Вызывается при запуске до приёма запросов.
+func Reconcile(ctx context.Context) (*ReconcileSummary, error) {
+	summary := &ReconcileSummary{}
+
+	var err error
+	if summary.Resolved, summary.Finalized, err = taskQueue.Recover(ctx); err != nil {
+		return summary, err
+	}
+
+	stalled, err := store.GetStalledExpressions(ctx)
+	if err != nil {
+		return summary, err
+	}
+
+	// Выражения идут в порядке создания, поэтому выражение, на которое
+	// ссылаются, перезапускается раньше ссылающихся на него
+	for _, expr := range stalled {
+		if err := taskQueue.Remove(ctx, expr.ID); err != nil {
+			return summary, err
+		}
+
+		tokens := parseExpression(expr.Expression)
+		var refErr *referenceError
+		refs, refsWaiting, err := resolveReferences(ctx, expr.UserId, tokens)
+		if errors.As(err, &refErr) {
+			log.Printf("Expression %s failed during reconciliation: %v", expr.ID, refErr)
+			if err := store.FailExpression(ctx, expr.ID); err != nil {
+				return summary, err
+			}
+			summary.Failed++
+			continue
+		}
+		if err != nil {
+			return summary, err
+		}
+
+		// В выражении без операций нет задач, его результат — само число
+		if len(tokens) == 1 {
+			if value, err := strconv.ParseFloat(tokens[0], 64); err == nil {
+				if err := store.CompleteExpression(ctx, expr.ID, value); err != nil {
+					return summary, err
+				}
+				summary.Completed++
+				continue
+			}
+		}
+		// Выражение из одной ссылки на невычисленное выражение разбивается
+		// на задачу, ждущую её результата; остальное без операций не вычислить
+		if len(tokens)%2 == 0 {
+			log.Printf("Expression %s failed during reconciliation: expression has no operations", expr.ID)
+			if err := store.FailExpression(ctx, expr.ID); err != nil {
+				return summary, err
+			}
+			summary.Failed++
+			continue
+		}
+
+		// Выражение проходит те же проверки, что и при отправке. Оно уже было
+		// принято, поэтому при переполненной очереди оно ждёт допуска в любом
+		// режиме ADMISSION_MODE, а не отклоняется
+		var quotaErr *quotaError
+		_, err = checkQuota(ctx, int64(expr.UserId), expr.Expression)
+		if errors.As(err, &quotaErr) || errors.Is(err, database.ErrUserNotFound) {
+			log.Printf("Expression %s failed during reconciliation: %v", expr.ID, err)
+			if err := store.FailExpression(ctx, expr.ID); err != nil {
+				return summary, err
+			}
+			summary.Failed++
+			continue
+		}
+		if err != nil {
+			return summary, err
+		}
+
+		admit, _, err := checkAdmission(ctx, len(tokens)/2, true)
+		if err != nil {
+			return summary, err
+		}
+		if !admit || refsWaiting {
+			expr.Status = "waiting_admission"
+			if err := store.UpdateExpression(ctx, expr); err != nil {
+				return summary, err
+			}
+			if err := store.LinkExpressionRefs(ctx, expr.ID, refs); err != nil {
+				return summary, err
+			}
+			summary.Waiting++
+			continue
+		}
+
+		if err := startExpression(ctx, expr, tokens, refs); err != nil {
+			return summary, fmt.Errorf("expression %s: %w", expr.ID, err)
+		}
+		summary.Restarted++
+	}
+
+	// Освобождаем аренды агентов, которых нет в реестре или которые помечены мёртвыми
+	alive, err := store.GetAliveAgentIDs(ctx)
+	if err != nil {
+		return summary, err
+	}
+	isAlive := make(map[string]bool, len(alive))
+	for _, id := range alive {
+		isAlive[id] = true
+	}
+	summary.Released, err = taskQueue.ReleaseAgentLeases(ctx, func(agentID string) bool {
+		return !isAlive[agentID]
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/pliliya111/go_final_sprint/internal/database"
+)
+
+// Ссылка на результат другого выражения пользователя: expr("<id>").
+var expressionRefRegex = regexp.MustCompile(`^expr\("([^"]+)"\)$`)
+
+// referenceError — ссылка на выражение, результат которого нельзя использовать.
+type referenceError struct {
+	message string
+}
+
+func (e *referenceError) Error() string {
+	return e.message
+}
+
+// resolveReferences заменяет в токенах выражения ссылки expr("id"): на результат
+// уже вычисленного выражения или на ID задачи, которая даст его результат.
+// Во втором случае задачи нового выражения ждут, пока очередь задач
+// подставит результат. Возвращает ID ещё не вычисленных выражений и признак
+// того, что у какого-то из них ещё нет задач (оно ждёт допуска в очередь):
+// тогда новое выражение тоже должно ждать допуска.
+func resolveReferences(ctx context.Context, userID int, tokens []string) ([]string, bool, error) {
+	var pending []string
+	waiting := false
+	for i, token := range tokens {
+		match := expressionRefRegex.FindStringSubmatch(token)
+		if match == nil {
+			continue
+		}
+
+		ref, err := store.GetExpressionByID(ctx, match[1])
+		if errors.Is(err, database.ErrExpressionNotFound) || (err == nil && ref.UserId != userID) {
+			return nil, false, &referenceError{message: fmt.Sprintf("referenced expression %s not found", match[1])}
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch {
+		case ref.Status == "waiting_admission" || (ref.Status == "pending" && ref.Result == nil):
+			// Задач ещё нет, ссылка разрешится, когда выражение допустят
+			pending = append(pending, ref.ID)
+			waiting = true
+		case ref.Result == nil:
+			return nil, false, &referenceError{message: fmt.Sprintf("referenced expression %s has no result", ref.ID)}
+		case ref.Status == "completed":
+			value, err := strconv.ParseFloat(fmt.Sprint(ref.Result), 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid result of expression %s: %w", ref.ID, err)
+			}
+			// Без экспоненты, иначе задача не будет выдана агентам
+			tokens[i] = strconv.FormatFloat(value, 'f', -1, 64)
+		case ref.Status == "pending" || ref.Status == "in_progress":
+			// Пока выражение не вычислено, в result хранится ID его последней задачи
+			tokens[i] = fmt.Sprint(ref.Result)
+			pending = append(pending, ref.ID)
+		default:
+			return nil, false, &referenceError{message: fmt.Sprintf("referenced expression %s is %s", ref.ID, ref.Status)}
+		}
+	}
+	return pending, waiting, nil
+}
@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/schedule"
+)
+
+// Минимальный интервал между запусками выражения по расписанию.
+const minScheduleInterval = time.Second
+
+// nextScheduleRun возвращает время следующего после after запуска
+// в unix ms или 0, если запусков больше не будет. Расписание cron
+// задаётся в UTC.
+func nextScheduleRun(s *model.Schedule, after time.Time) int64 {
+	if s.Cron == "" {
+		return after.Add(time.Duration(s.IntervalMs) * time.Millisecond).UnixMilli()
+	}
+
+	cron, err := schedule.ParseCron(s.Cron)
+	if err != nil {
+		return 0
+	}
+	next := cron.Next(after.UTC())
+	if next.IsZero() {
+		return 0
+	}
+	return next.UnixMilli()
+}
+
+// Через сколько повторить запуск расписания, который не удался из-за ошибки.
+const scheduleRetryDelay = 10 * time.Second
+
+// RunDueSchedules создаёт выражения для расписаний, время запуска которых
+// наступило, и возвращает число созданных выражений. Ошибка запуска одного
+// расписания не мешает запуску остальных.
+func RunDueSchedules(ctx context.Context) (int, error) {
+	due, err := store.GetDueSchedules(ctx, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, s := range due {
+		ok, err := runSchedule(ctx, s)
+		if err != nil {
+			log.Printf("Failed to run schedule %s: %v", s.ID, err)
+			continue
+		}
+		if ok {
+			created++
+		}
+	}
+	return created, nil
+}
+
+// runSchedule создаёт очередное выражение расписания и назначает
+// следующий запуск. Если пользователь исчерпал лимиты, запуск пропускается.
+func runSchedule(ctx context.Context, s *model.Schedule) (bool, error) {
+	now := time.Now()
+
+	// Интервальные расписания отсчитывают интервал от запланированного запуска,
+	// а пропустившие запуски (например, пока оркестратор был остановлен)
+	// запускаются один раз, а не за каждый пропущенный интервал
+	next := nextScheduleRun(s, now)
+	if s.Cron == "" {
+		if planned := nextScheduleRun(s, time.UnixMilli(s.NextRunAt)); planned > now.UnixMilli() {
+			next = planned
+		}
+	}
+
+	var deadline int64
+	if s.TimeoutMs > 0 {
+		deadline = now.Add(time.Duration(s.TimeoutMs) * time.Millisecond).UnixMilli()
+	}
+
+	expr := &model.Expression{
+		ID:         uuid.New().String(),
+		Expression: s.Expression,
+		Status:     "pending",
+		UserId:     s.UserId,
+		Priority:   s.Priority,
+		CreatedAt:  now.UnixMilli(),
+		Deadline:   deadline,
+		Replicas:   s.Replicas,
+		ScheduleID: s.ID,
+	}
+	var refErr *referenceError
+	var admissionErr *admissionError
+	var quotaErr *quotaError
+	err := submitExpression(ctx, expr)
+	if errors.As(err, &refErr) || errors.As(err, &admissionErr) || errors.As(err, &quotaErr) ||
+		errors.Is(err, database.ErrUserNotFound) {
+		log.Printf("Skipping run of schedule %s: %v", s.ID, err)
+		return false, store.SetScheduleRun(ctx, s.ID, s.LastRunAt, next)
+	}
+	if err != nil {
+		// Откладываем запуск, чтобы не повторять его на каждом тике
+		retry := now.Add(scheduleRetryDelay).UnixMilli()
+		if next == 0 || next > retry {
+			next = retry
+		}
+		if setErr := store.SetScheduleRun(ctx, s.ID, s.LastRunAt, next); setErr != nil {
+			log.Printf("Failed to postpone schedule %s: %v", s.ID, setErr)
+		}
+		return false, err
+	}
+
+	return true, store.SetScheduleRun(ctx, s.ID, now.UnixMilli(), next)
+}
+
+func AddSchedule(c *gin.Context) {
+	var request struct {
+		Expression string `json:"expression"`
+		Cron       string `json:"cron"`
+		IntervalMs int64  `json:"interval_ms"`
+		Priority   int    `json:"priority"`
+		Replicas   int    `json:"replicas"`
+		TimeoutMs  int64  `json:"timeout_ms"`
+	}
+	userId, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user id not found"})
+		return
+	}
+
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid data"})
+		return
+	}
+
+	if !validExpressionRegex.MatchString(request.Expression) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Expression is not valid"})
+		return
+	}
+
+	if (request.Cron == "") == (request.IntervalMs == 0) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "exactly one of cron and interval_ms must be specified"})
+		return
+	}
+	if request.Cron != "" {
+		if _, err := schedule.ParseCron(request.Cron); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.IntervalMs != 0 && request.IntervalMs < minScheduleInterval.Milliseconds() {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("interval_ms must be at least %d", minScheduleInterval.Milliseconds())})
+		return
+	}
+
+	if request.TimeoutMs < 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "timeout_ms must be positive"})
+		return
+	}
+
+	if request.Replicas == 0 {
+		request.Replicas = 1
+	}
+	if request.Replicas < 1 || request.Replicas > maxReplicas {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("replicas must be from 1 to %d", maxReplicas)})
+		return
+	}
+
+	now := time.Now()
+	s := &model.Schedule{
+		ID:         uuid.New().String(),
+		UserId:     userId.(int),
+		Expression: request.Expression,
+		Cron:       request.Cron,
+		IntervalMs: request.IntervalMs,
+		Priority:   request.Priority,
+		Replicas:   request.Replicas,
+		TimeoutMs:  request.TimeoutMs,
+		Status:     "active",
+		CreatedAt:  now.UnixMilli(),
+	}
+	s.NextRunAt = nextScheduleRun(s, now)
+	if s.NextRunAt == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "cron schedule never fires"})
+		return
+	}
+
+	if err := store.InsertSchedule(c.Request.Context(), s); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save schedule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": s.ID, "next_run_at": s.NextRunAt})
+}
+
+func GetSchedules(c *gin.Context) {
+	userId, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user id not found"})
+		return
+	}
+
+	schedules, err := store.GetSchedules(c.Request.Context(), userId.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch schedules"})
+		return
+	}
+	if schedules == nil {
+		schedules = []*model.Schedule{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+// userSchedule возвращает расписание из пути запроса, если оно принадлежит
+// текущему пользователю, иначе сам отвечает ошибкой.
+func userSchedule(c *gin.Context) (*model.Schedule, bool) {
+	userId, exists := c.Get("userId")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user id not found"})
+		return nil, false
+	}
+
+	s, err := store.GetSchedule(c.Request.Context(), c.Param("id"), userId.(int))
+	if err != nil {
+		if errors.Is(err, database.ErrScheduleNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch schedule"})
+		}
+		return nil, false
+	}
+	return s, true
+}
+
+func GetSchedule(c *gin.Context) {
+	s, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	runs, err := store.GetScheduleRuns(c.Request.Context(), s.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch schedule"})
+		return
+	}
+
+	runsList := make([]gin.H, 0, len(runs))
+	for _, run := range runs {
+		runsList = append(runsList, gin.H{
+			"id":         run.ID,
+			"status":     run.Status,
+			"result":     run.Result,
+			"created_at": run.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedule": s, "runs": runsList})
+}
+
+func PauseSchedule(c *gin.Context) {
+	s, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	if err := store.UpdateScheduleStatus(c.Request.Context(), s.ID, "paused", 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to pause schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": s.ID, "status": "paused"})
+}
+
+func ResumeSchedule(c *gin.Context) {
+	s, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	// Запуски, пропущенные за время паузы, не выполняются
+	next := nextScheduleRun(s, time.Now())
+	if err := store.UpdateScheduleStatus(c.Request.Context(), s.ID, "active", next); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resume schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": s.ID, "status": "active", "next_run_at": next})
+}
+
+func DeleteSchedule(c *gin.Context) {
+	s, ok := userSchedule(c)
+	if !ok {
+		return
+	}
+
+	if err := store.DeleteSchedule(c.Request.Context(), s.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": s.ID, "status": "deleted"})
+}
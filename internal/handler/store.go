@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Store хранит выражения, пользователей, агентов, расписания и длительности
+// операций. Задачи и их аренды хранит очередь задач (queue.TaskQueue),
+// поэтому обработчики не обращаются к базе данных напрямую.
+type Store interface {
+	// Выражения и их ссылки
+	GetExpressions(ctx context.Context) ([]*model.Expression, error)
+	GetExpressionByID(ctx context.Context, id string) (*model.Expression, error)
+	InsertExpressionWithinQuota(ctx context.Context, expr *model.Expression, tasks int, quota database.Quota) (*model.UserUsage, error)
+	UpdateExpression(ctx context.Context, expr *model.Expression) error
+	CancelExpression(ctx context.Context, id string, userID int) error
+	CompleteExpression(ctx context.Context, id string, result float64) error
+	FailExpression(ctx context.Context, id string) error
+	LinkExpressionRefs(ctx context.Context, expressionID string, refs []string) error
+	GetWaitingExpressions(ctx context.Context, limit int) ([]*model.Expression, error)
+	CountWaitingExpressions(ctx context.Context) (int, error)
+	GetStalledExpressions(ctx context.Context) ([]*model.Expression, error)
+
+	// Пользователи, их веса и лимиты
+	InsertUser(ctx context.Context, user *model.User) (int64, error)
+	LoginUser(ctx context.Context, name, password string) (*model.User, error)
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+	SetUserWeight(ctx context.Context, userID int64, weight float64) error
+	GetUserLimits(ctx context.Context, userID int64) (*model.UserLimits, error)
+	SetUserLimits(ctx context.Context, userID int64, limits *model.UserLimits) error
+	GetUserUsage(ctx context.Context, userID int64) (*model.UserUsage, error)
+
+	// Реестр агентов
+	RegisterAgent(ctx context.Context, agent *model.Agent) error
+	AgentHeartbeat(ctx context.Context, agentID string) error
+	GetAgents(ctx context.Context) ([]*model.Agent, error)
+	GetAgentOperations(ctx context.Context, agentID string) ([]string, error)
+	GetUnsupportedOperations(ctx context.Context, operations []string) ([]string, error)
+	CountAliveAgents(ctx context.Context) (int, error)
+	CountAliveWorkers(ctx context.Context) (int, error)
+	GetAliveAgentIDs(ctx context.Context) ([]string, error)
+	MarkDeadAgents(ctx context.Context, deadAfter time.Duration) ([]string, error)
+
+	// Расписания
+	InsertSchedule(ctx context.Context, schedule *model.Schedule) error
+	GetSchedule(ctx context.Context, id string, userID int) (*model.Schedule, error)
+	GetSchedules(ctx context.Context, userID int) ([]*model.Schedule, error)
+	GetScheduleRuns(ctx context.Context, scheduleID string) ([]*model.Expression, error)
+	GetDueSchedules(ctx context.Context, now int64) ([]*model.Schedule, error)
+	SetScheduleRun(ctx context.Context, id string, lastRunAt, nextRunAt int64) error
+	UpdateScheduleStatus(ctx context.Context, id string, status string, nextRunAt int64) error
+	DeleteSchedule(ctx context.Context, id string) error
+
+	// Длительности операций
+	GetOperationTimings(ctx context.Context) (map[string]int, error)
+	SetOperationTimings(ctx context.Context, timings map[string]int) error
+}
+
+// sqlStore хранит состояние оркестратора в базе данных SQLite.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore возвращает Store поверх базы данных оркестратора.
+func NewSQLStore(db *sql.DB) Store {
+	return &sqlStore{db: db}
+}
+
+func (s *sqlStore) GetExpressions(ctx context.Context) ([]*model.Expression, error) {
+	return database.GetExpressions(ctx, s.db)
+}
+
+func (s *sqlStore) GetExpressionByID(ctx context.Context, id string) (*model.Expression, error) {
+	return database.GetExpressionByID(ctx, s.db, id)
+}
+
+func (s *sqlStore) InsertExpressionWithinQuota(ctx context.Context, expr *model.Expression, tasks int, quota database.Quota) (*model.UserUsage, error) {
+	return database.InsertExpressionWithinQuota(ctx, s.db, expr, tasks, quota)
+}
+
+func (s *sqlStore) UpdateExpression(ctx context.Context, expr *model.Expression) error {
+	return database.UpdateExpression(ctx, s.db, expr)
+}
+
+func (s *sqlStore) CancelExpression(ctx context.Context, id string, userID int) error {
+	return database.CancelExpression(ctx, s.db, id, userID)
+}
+
+func (s *sqlStore) CompleteExpression(ctx context.Context, id string, result float64) error {
+	return database.CompleteExpression(ctx, s.db, id, result)
+}
+
+func (s *sqlStore) FailExpression(ctx context.Context, id string) error {
+	return database.FailExpression(ctx, s.db, id)
+}
+
+func (s *sqlStore) LinkExpressionRefs(ctx context.Context, expressionID string, refs []string) error {
+	return database.LinkExpressionRefs(ctx, s.db, expressionID, refs)
+}
+
+func (s *sqlStore) GetWaitingExpressions(ctx context.Context, limit int) ([]*model.Expression, error) {
+	return database.GetWaitingExpressions(ctx, s.db, limit)
+}
+
+func (s *sqlStore) CountWaitingExpressions(ctx context.Context) (int, error) {
+	return database.CountWaitingExpressions(ctx, s.db)
+}
+
+func (s *sqlStore) GetStalledExpressions(ctx context.Context) ([]*model.Expression, error) {
+	return database.GetStalledExpressions(ctx, s.db)
+}
+
+func (s *sqlStore) InsertUser(ctx context.Context, user *model.User) (int64, error) {
+	return database.InsertUser(ctx, s.db, user)
+}
+
+func (s *sqlStore) LoginUser(ctx context.Context, name, password string) (*model.User, error) {
+	return database.LoginUser(ctx, s.db, name, password)
+}
+
+func (s *sqlStore) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	return database.IsAdmin(ctx, s.db, userID)
+}
+
+func (s *sqlStore) SetUserWeight(ctx context.Context, userID int64, weight float64) error {
+	return database.SetUserWeight(ctx, s.db, userID, weight)
+}
+
+func (s *sqlStore) GetUserLimits(ctx context.Context, userID int64) (*model.UserLimits, error) {
+	return database.GetUserLimits(ctx, s.db, userID)
+}
+
+func (s *sqlStore) SetUserLimits(ctx context.Context, userID int64, limits *model.UserLimits) error {
+	return database.SetUserLimits(ctx, s.db, userID, limits)
+}
+
+func (s *sqlStore) GetUserUsage(ctx context.Context, userID int64) (*model.UserUsage, error) {
+	return database.GetUserUsage(ctx, s.db, userID)
+}
+
+func (s *sqlStore) RegisterAgent(ctx context.Context, agent *model.Agent) error {
+	return database.RegisterAgent(ctx, s.db, agent)
+}
+
+func (s *sqlStore) AgentHeartbeat(ctx context.Context, agentID string) error {
+	return database.AgentHeartbeat(ctx, s.db, agentID)
+}
+
+func (s *sqlStore) GetAgents(ctx context.Context) ([]*model.Agent, error) {
+	return database.GetAgents(ctx, s.db)
+}
+
+func (s *sqlStore) GetAgentOperations(ctx context.Context, agentID string) ([]string, error) {
+	return database.GetAgentOperations(ctx, s.db, agentID)
+}
+
+func (s *sqlStore) GetUnsupportedOperations(ctx context.Context, operations []string) ([]string, error) {
+	return database.GetUnsupportedOperations(ctx, s.db, operations)
+}
+
+func (s *sqlStore) CountAliveAgents(ctx context.Context) (int, error) {
+	return database.CountAliveAgents(ctx, s.db)
+}
+
+func (s *sqlStore) CountAliveWorkers(ctx context.Context) (int, error) {
+	return database.CountAliveWorkers(ctx, s.db)
+}
+
+func (s *sqlStore) GetAliveAgentIDs(ctx context.Context) ([]string, error) {
+	return database.GetAliveAgentIDs(ctx, s.db)
+}
+
+func (s *sqlStore) MarkDeadAgents(ctx context.Context, deadAfter time.Duration) ([]string, error) {
+	return database.MarkDeadAgents(ctx, s.db, deadAfter)
+}
+
+func (s *sqlStore) InsertSchedule(ctx context.Context, schedule *model.Schedule) error {
+	return database.InsertSchedule(ctx, s.db, schedule)
+}
+
+func (s *sqlStore) GetSchedule(ctx context.Context, id string, userID int) (*model.Schedule, error) {
+	return database.GetSchedule(ctx, s.db, id, userID)
+}
+
+func (s *sqlStore) GetSchedules(ctx context.Context, userID int) ([]*model.Schedule, error) {
+	return database.GetSchedules(ctx, s.db, userID)
+}
+
+func (s *sqlStore) GetScheduleRuns(ctx context.Context, scheduleID string) ([]*model.Expression, error) {
+	return database.GetScheduleRuns(ctx, s.db, scheduleID)
+}
+
+func (s *sqlStore) GetDueSchedules(ctx context.Context, now int64) ([]*model.Schedule, error) {
+	return database.GetDueSchedules(ctx, s.db, now)
+}
+
+func (s *sqlStore) SetScheduleRun(ctx context.Context, id string, lastRunAt, nextRunAt int64) error {
+	return database.SetScheduleRun(ctx, s.db, id, lastRunAt, nextRunAt)
+}
+
+func (s *sqlStore) UpdateScheduleStatus(ctx context.Context, id string, status string, nextRunAt int64) error {
+	return database.UpdateScheduleStatus(ctx, s.db, id, status, nextRunAt)
+}
+
+func (s *sqlStore) DeleteSchedule(ctx context.Context, id string) error {
+	return database.DeleteSchedule(ctx, s.db, id)
+}
+
+func (s *sqlStore) GetOperationTimings(ctx context.Context) (map[string]int, error) {
+	return database.GetOperationTimings(ctx, s.db)
+}
+
+func (s *sqlStore) SetOperationTimings(ctx context.Context, timings map[string]int) error {
+	return database.SetOperationTimings(ctx, s.db, timings)
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Длительности операций в миллисекундах, которые оркестратор отправляет
+// агентам вместе с задачами. Значения по умолчанию берутся из переменных
+// окружения и переопределяются сохранёнными в базе.
+var (
+	timingsMu        sync.RWMutex
+	operationTimings = map[string]int{
+		"+": getEnvInt("TIME_ADDITION_MS", 1000),
+		"-": getEnvInt("TIME_SUBTRACTION_MS", 1000),
+		"*": getEnvInt("TIME_MULTIPLICATIONS_MS", 1000),
+		"/": getEnvInt("TIME_DIVISIONS_MS", 1000),
+	}
+)
+
+func getOperationTime(operation string) int {
+	timingsMu.RLock()
+	defer timingsMu.RUnlock()
+	return operationTimings[operation]
+}
+
+func currentOperationTimings() map[string]int {
+	timingsMu.RLock()
+	defer timingsMu.RUnlock()
+
+	timings := make(map[string]int, len(operationTimings))
+	for op, ms := range operationTimings {
+		timings[op] = ms
+	}
+	return timings
+}
+
+// LoadOperationTimings загружает сохранённые в базе длительности операций.
+func LoadOperationTimings(ctx context.Context) error {
+	timings, err := store.GetOperationTimings(ctx)
+	if err != nil {
+		return err
+	}
+
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	for op, ms := range timings {
+		operationTimings[op] = ms
+	}
+	return nil
+}
+
+func GetOperationTimings(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"timings": currentOperationTimings()})
+}
+
+func SetOperationTimings(c *gin.Context) {
+	var request map[string]int
+
+	if err := c.ShouldBindJSON(&request); err != nil || len(request) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid data"})
+		return
+	}
+
+	for op, ms := range request {
+		if !isSupportedOperation(op) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("unknown operation: %s", op)})
+			return
+		}
+		if ms < 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("duration for operation %s must not be negative", op)})
+			return
+		}
+	}
+
+	if err := store.SetOperationTimings(c.Request.Context(), request); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save timings"})
+		return
+	}
+
+	timingsMu.Lock()
+	for op, ms := range request {
+		operationTimings[op] = ms
+	}
+	timingsMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"timings": currentOperationTimings()})
+}
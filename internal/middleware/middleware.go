@@ -1,8 +1,11 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -30,7 +33,7 @@ func GenerateToken(userName string, userId int) (string, error) {
 	return tokenString, nil
 }
 
-func ExtractUserIdFromToken(requestToken string) (int, error) {
+func parseToken(requestToken string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(requestToken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
@@ -39,13 +42,22 @@ func ExtractUserIdFromToken(requestToken string) (int, error) {
 	})
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 
 	if !ok || !token.Valid {
-		return 0, fmt.Errorf("Invalid Token")
+		return nil, fmt.Errorf("Invalid Token")
+	}
+
+	return claims, nil
+}
+
+func ExtractUserIdFromToken(requestToken string) (int, error) {
+	claims, err := parseToken(requestToken)
+	if err != nil {
+		return 0, err
 	}
 
 	if id, ok := claims["id"].(float64); ok {
@@ -55,6 +67,43 @@ func ExtractUserIdFromToken(requestToken string) (int, error) {
 	return 0, fmt.Errorf("id claim is not a valid number")
 }
 
+func ExtractUserNameFromToken(requestToken string) (string, error) {
+	claims, err := parseToken(requestToken)
+	if err != nil {
+		return "", err
+	}
+
+	if name, ok := claims["name"].(string); ok {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("name claim is not a valid string")
+}
+
+// AdminNames возвращает имена пользователей из переменной окружения
+// ADMIN_USERS (имена через запятую). При запуске оркестратор отмечает
+// администраторами уже зарегистрированных пользователей с этими именами.
+func AdminNames() []string {
+	var names []string
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// IsAdminName проверяет, перечислен ли userName в ADMIN_USERS. Такие имена
+// нельзя зарегистрировать, чтобы не получить права администратора.
+func IsAdminName(userName string) bool {
+	for _, name := range AdminNames() {
+		if name == userName {
+			return true
+		}
+	}
+	return false
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -78,7 +127,35 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		userName, err := ExtractUserNameFromToken(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
 		c.Set("userId", userId)
+		c.Set("userName", userName)
+		c.Next()
+	}
+}
+
+// AdminMiddleware должен подключаться после AuthMiddleware. isAdmin
+// проверяет отметку администратора у пользователя из токена.
+func AdminMiddleware(isAdmin func(ctx context.Context, userID int) (bool, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, err := isAdmin(c.Request.Context(), c.GetInt("userId"))
+		if err != nil {
+			log.Printf("Error checking admin access: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check admin access"})
+			c.Abort()
+			return
+		}
+		if !admin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -1,23 +1,103 @@
 package model
 
 type Task struct {
-	ID           string      `json:"id"`
-	Arg1         interface{} `json:"arg1"`
-	Arg2         interface{} `json:"arg2"`
-	Operation    string      `json:"operation"`
-	Result       interface{} `json:"result"`
-	ExpressionId string      `json:"expression_id"`
+	ID            string      `json:"id"`
+	Arg1          interface{} `json:"arg1"`
+	Arg2          interface{} `json:"arg2"`
+	Operation     string      `json:"operation"`
+	OperationTime int         `json:"operation_time"` // ms, задаётся оркестратором
+	Result        interface{} `json:"result"`
+	ExpressionId  string      `json:"expression_id"`
+	Deadline      int64       `json:"deadline,omitempty"` // unix ms, 0 — без ограничения
+	LeaseToken    string      `json:"lease_token,omitempty"`
+	// ms, самый долгий путь от задачи до результата выражения с учётом
+	// времени операций; задачи с большим значением выдаются раньше
+	CriticalPath int `json:"-"`
+}
+
+// Lease — аренда, под которой агенту выдаётся одна или несколько задач.
+type Lease struct {
+	Token     string  `json:"token"`
+	ExpiresAt int64   `json:"expires_at"` // unix ms
+	Tasks     []*Task `json:"tasks"`
+}
+
+type TaskResult struct {
+	ID         string  `json:"id"`
+	Result     float64 `json:"result"`
+	LeaseToken string  `json:"lease_token"`
+	AgentID    string  `json:"agent_id,omitempty"`
 }
 
 type Expression struct {
 	ID         string      `json:"id"`
 	Expression string      `json:"expression"`
-	Status     string      `json:"status"` // pending, in_progress, completed
+	Status     string      `json:"status"` // pending, in_progress, completed, cancelled, timed_out, failed
 	Result     interface{} `json:"result"`
 	UserId     int
+	Priority   int    `json:"priority"`
+	CreatedAt  int64  `json:"created_at"` // unix ms
+	Deadline   int64  `json:"deadline"`   // unix ms, 0 — без ограничения
+	Replicas   int    `json:"replicas"`   // сколько агентов независимо вычисляют каждую задачу
+	Disputes   int    `json:"disputes"`   // сколько раз реплики расходились в результатах
+	ScheduleID string `json:"schedule_id,omitempty"`
+	// ms, нижняя граница времени вычисления при неограниченном числе агентов
+	CriticalPath int   `json:"critical_path_ms"`
+	StartedAt    int64 `json:"started_at,omitempty"`   // unix ms постановки задач в очередь
+	CompletedAt  int64 `json:"completed_at,omitempty"` // unix ms
+}
+
+// Schedule — выражение, которое пересчитывается по расписанию cron
+// или через равные интервалы.
+type Schedule struct {
+	ID         string `json:"id"`
+	UserId     int    `json:"-"`
+	Expression string `json:"expression"`
+	Cron       string `json:"cron,omitempty"`
+	IntervalMs int64  `json:"interval_ms,omitempty"`
+	Priority   int    `json:"priority"`
+	Replicas   int    `json:"replicas"`
+	TimeoutMs  int64  `json:"timeout_ms,omitempty"`
+	Status     string `json:"status"`      // active, paused
+	CreatedAt  int64  `json:"created_at"`  // unix ms
+	NextRunAt  int64  `json:"next_run_at"` // unix ms, 0 — запусков больше не будет
+	LastRunAt  int64  `json:"last_run_at"` // unix ms, 0 — ещё не запускалось
 }
 type User struct {
 	ID       int64
 	Name     string
 	Password string
+	Weight   float64
+}
+
+// UserLimits — персональные лимиты пользователя.
+// nil — действует лимит по умолчанию, 0 — без ограничения.
+type UserLimits struct {
+	ExpressionsPerMinute *int `json:"expressions_per_minute"`
+	MaxPendingTasks      *int `json:"max_pending_tasks"`
+	MaxExpressionLength  *int `json:"max_expression_length"`
+}
+
+// UserUsage — текущее потребление пользователем лимитов.
+type UserUsage struct {
+	ExpressionsLastMinute int   `json:"expressions_last_minute"`
+	OldestInWindow        int64 `json:"-"` // unix ms самого раннего выражения за последнюю минуту
+	PendingTasks          int   `json:"pending_tasks"`
+}
+
+type Agent struct {
+	ID              string             `json:"id"`
+	Hostname        string             `json:"hostname"`
+	Workers         int                `json:"workers"`
+	Version         string             `json:"version"`
+	Operations      []string           `json:"operations,omitempty"`  // пустой список — все операции
+	Throughput      map[string]float64 `json:"throughput,omitempty"`  // операций в секунду
+	BenchScore      float64            `json:"bench_score,omitempty"` // операций в секунду без имитации длительности, по замеру агента
+	RegisteredAt    int64              `json:"registered_at"`         // unix ms
+	LastSeen        int64              `json:"last_seen"`             // unix ms
+	TasksCompleted  int                `json:"tasks_completed"`
+	ResultsDisputed int                `json:"results_disputed"` // результаты, отвергнутые кворумом реплик
+	Reputation      float64            `json:"reputation"`       // доля принятых результатов, от 0 до 1
+	CurrentLeases   int                `json:"current_leases"`
+	Status          string             `json:"status"` // alive, dead
 }
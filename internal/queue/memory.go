@@ -0,0 +1,863 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Окно, за которое считается число выданных пользователю задач
+// при справедливом распределении между пользователями.
+const fairShareWindow = time.Minute
+
+// После стольких спорных раундов подряд задача реплицированного выражения
+// завершается неудачей, а не выдаётся снова.
+const maxTaskDisputes = 3
+
+// Сколько очередь в памяти хранит задачи завершённых выражений, чтобы
+// подтверждать повторно присланные результаты.
+const finishedRetention = 10 * time.Minute
+
+// Как часто очередь в памяти проверяет сроки выражений и удаляет старые задачи.
+const sweepInterval = time.Second
+
+// Store — хранилище выражений, которому очередь в памяти сообщает
+// о завершении выражений и о принятых и отвергнутых результатах агентов.
+type Store interface {
+	UserWeight(ctx context.Context, userID int) (float64, error)
+	CompleteExpression(ctx context.Context, id string, result float64) error
+	FailExpression(ctx context.Context, id string) error
+	RecordAgentResults(ctx context.Context, agreed, disputed []string) error
+}
+
+// MemoryQueue — очередь задач в памяти процесса для тестов и оркестратора
+// из одного узла. Правила выдачи и приёма результатов те же, что у SQLiteQueue,
+// но задачи теряются при перезапуске. Вес пользователя запоминается
+// при постановке выражения в очередь.
+type MemoryQueue struct {
+	mu    sync.Mutex
+	store Store
+
+	expressions map[string]*memExpression
+	tasks       map[string]*memTask
+	// Аренды по токену: одна аренда может покрывать несколько задач
+	leases map[string][]*memLease
+	// Задачи, ожидающие результата задачи с данным ID
+	dependents map[string][]*memTask
+	// Время выдачи задач пользователям за окно справедливости
+	served map[int][]int64
+
+	seq       int64
+	lastSweep int64
+}
+
+type memExpression struct {
+	id         string
+	userID     int
+	weight     float64
+	priority   int
+	createdAt  int64
+	deadline   int64
+	replicas   int
+	finalTask  string
+	pending    int
+	status     string // in_progress, completed, failed
+	finishedAt int64
+	tasks      []*memTask
+}
+
+type memTask struct {
+	id         string
+	arg1, arg2 string
+	operation  string
+	critical   int
+	expr       *memExpression
+	seq        int64
+	hasResult  bool
+	result     float64
+	failed     bool
+	disputes   int
+	leases     []*memLease
+}
+
+type memLease struct {
+	token     string
+	task      *memTask
+	agentID   string
+	expiresAt int64
+	status    string // active, submitted, completed, released, disputed, rejected
+	hasResult bool
+	result    float64
+}
+
+// memEvents — изменения, о которых нужно сообщить хранилищу после
+// освобождения блокировки очереди.
+type memEvents struct {
+	completed []string
+	results   map[string]float64
+	failed    []string
+	agreed    []string
+	disputed  []string
+}
+
+// NewMemoryQueue создаёт очередь в памяти. store может быть nil,
+// тогда очередь никому не сообщает о завершении выражений.
+func NewMemoryQueue(store Store) *MemoryQueue {
+	return &MemoryQueue{
+		store:       store,
+		expressions: make(map[string]*memExpression),
+		tasks:       make(map[string]*memTask),
+		leases:      make(map[string][]*memLease),
+		dependents:  make(map[string][]*memTask),
+		served:      make(map[int][]int64),
+	}
+}
+
+func (q *MemoryQueue) Enqueue(ctx context.Context, expr *model.Expression, tasks []*model.Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	weight := 1.0
+	if q.store != nil {
+		var err error
+		if weight, err = q.store.UserWeight(ctx, expr.UserId); err != nil {
+			return err
+		}
+	}
+
+	events := &memEvents{}
+
+	q.mu.Lock()
+	if _, exists := q.expressions[expr.ID]; exists {
+		q.mu.Unlock()
+		return fmt.Errorf("expression %s is already queued", expr.ID)
+	}
+
+	e := &memExpression{
+		id:        expr.ID,
+		userID:    expr.UserId,
+		weight:    weight,
+		priority:  expr.Priority,
+		createdAt: expr.CreatedAt,
+		deadline:  expr.Deadline,
+		replicas:  expr.Replicas,
+		finalTask: fmt.Sprint(expr.Result),
+		status:    "in_progress",
+	}
+	if e.replicas < 1 {
+		e.replicas = 1
+	}
+	if e.weight <= 0 {
+		e.weight = 1
+	}
+
+	for _, task := range tasks {
+		q.seq++
+		t := &memTask{
+			id:        task.ID,
+			arg1:      fmt.Sprint(task.Arg1),
+			arg2:      fmt.Sprint(task.Arg2),
+			operation: task.Operation,
+			critical:  task.CriticalPath,
+			expr:      e,
+			seq:       q.seq,
+		}
+		e.tasks = append(e.tasks, t)
+		q.tasks[t.id] = t
+	}
+	e.pending = len(e.tasks)
+	q.expressions[e.id] = e
+
+	// Аргумент — ID задачи этого или другого выражения: если она уже решена,
+	// подставляем результат, иначе ждём его
+	dead := false
+	for _, t := range e.tasks {
+		for _, arg := range []*string{&t.arg1, &t.arg2} {
+			if isNumber(*arg) {
+				continue
+			}
+			dep, ok := q.tasks[*arg]
+			switch {
+			case !ok:
+				// Задачи выражения, завершившегося раньше finishedRetention,
+				// забыты: их результата задача не дождётся
+				log.Printf("Expression %s failed: task %s is unknown to the queue", e.id, *arg)
+				dead = true
+			case dep.hasResult:
+				*arg = formatResult(dep.result)
+			case dep.expr.status == "failed":
+				dead = true
+			default:
+				q.dependents[dep.id] = append(q.dependents[dep.id], t)
+			}
+		}
+	}
+	if dead {
+		events.failed = append(events.failed, e.id)
+		q.kill(e, time.Now().UnixMilli(), events)
+	}
+	q.mu.Unlock()
+
+	return q.flush(ctx, events)
+}
+
+func (q *MemoryQueue) Claim(ctx context.Context, req ClaimRequest) (*model.Lease, error) {
+	events := &memEvents{}
+
+	q.mu.Lock()
+	lease := q.claim(req, time.Now(), events)
+	q.mu.Unlock()
+
+	// Задачи уже выданы, поэтому ошибка сообщения хранилищу не отменяет аренду
+	if err := q.flush(ctx, events); err != nil {
+		log.Printf("Failed to report expired expressions: %v", err)
+	}
+	return lease, nil
+}
+
+func (q *MemoryQueue) claim(req ClaimRequest, now time.Time, events *memEvents) *model.Lease {
+	nowMS := now.UnixMilli()
+
+	q.sweep(nowMS, events)
+
+	windowStart := now.Add(-fairShareWindow).UnixMilli()
+	served := make(map[int]int, len(q.served))
+	for userID, times := range q.served {
+		i := sort.Search(len(times), func(i int) bool { return times[i] >= windowStart })
+		if i == len(times) {
+			delete(q.served, userID)
+			continue
+		}
+		q.served[userID] = times[i:]
+		served[userID] = len(times) - i
+	}
+
+	var allowed map[string]bool
+	if req.Operations != nil {
+		allowed = make(map[string]bool, len(req.Operations))
+		for _, op := range req.Operations {
+			allowed[op] = true
+		}
+	}
+
+	var candidates []*memTask
+	for _, t := range q.tasks {
+		e := t.expr
+		if t.hasResult || t.failed || e.status != "in_progress" {
+			continue
+		}
+		if !isNumber(t.arg1) || !isNumber(t.arg2) {
+			continue
+		}
+		if allowed != nil && !allowed[t.operation] {
+			continue
+		}
+		if t.liveLeases(nowMS, "") >= e.replicas {
+			continue
+		}
+		// Реплики выдаются только известным агентам, иначе один агент
+		// мог бы прислать все реплики
+		if req.AgentID == "" && e.replicas > 1 {
+			continue
+		}
+		if req.AgentID != "" && t.leasedBy(req.AgentID, nowMS) {
+			continue
+		}
+		candidates = append(candidates, t)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Сначала обслуживаем пользователя, получившего меньше всего задач
+	// за последнее окно с учётом его веса, затем выражения с большим
+	// приоритетом, затем, при упорядочивании по критическому пути, задачи
+	// на самом долгом пути до результата выражения, затем более старые выражения.
+	// Приоритет сравнивается только при равной доле: высокий приоритет
+	// не позволяет пользователю обогнать тех, кто получил меньше задач.
+	criticalFirst := req.Ordering == OrderCriticalPath
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		shareA := float64(served[a.expr.userID]) / a.expr.weight
+		shareB := float64(served[b.expr.userID]) / b.expr.weight
+		if shareA != shareB {
+			return shareA < shareB
+		}
+		if a.expr.priority != b.expr.priority {
+			return a.expr.priority > b.expr.priority
+		}
+		if criticalFirst && a.critical != b.critical {
+			return a.critical > b.critical
+		}
+		if a.expr.createdAt != b.expr.createdAt {
+			return a.expr.createdAt < b.expr.createdAt
+		}
+		return a.seq < b.seq
+	})
+	if len(candidates) > req.Max {
+		candidates = candidates[:req.Max]
+	}
+
+	lease := &model.Lease{
+		Token:     uuid.New().String(),
+		ExpiresAt: now.Add(req.LeaseDuration).UnixMilli(),
+	}
+	for _, t := range candidates {
+		l := &memLease{
+			token:     lease.Token,
+			task:      t,
+			agentID:   req.AgentID,
+			expiresAt: lease.ExpiresAt,
+			status:    "active",
+		}
+		t.leases = append(t.leases, l)
+		q.leases[lease.Token] = append(q.leases[lease.Token], l)
+		q.served[t.expr.userID] = append(q.served[t.expr.userID], nowMS)
+
+		lease.Tasks = append(lease.Tasks, &model.Task{
+			ID:           t.id,
+			Arg1:         t.arg1,
+			Arg2:         t.arg2,
+			Operation:    t.operation,
+			ExpressionId: t.expr.id,
+			Deadline:     t.expr.deadline,
+			LeaseToken:   lease.Token,
+		})
+	}
+
+	return lease
+}
+
+func (q *MemoryQueue) Complete(ctx context.Context, results []model.TaskResult) ([]error, error) {
+	now := time.Now().UnixMilli()
+	events := &memEvents{results: make(map[string]float64)}
+	rejections := make([]error, len(results))
+
+	q.mu.Lock()
+	for i, r := range results {
+		rejections[i] = q.complete(r, now, events)
+	}
+	q.mu.Unlock()
+
+	if err := q.flush(ctx, events); err != nil {
+		return nil, err
+	}
+	return rejections, nil
+}
+
+func (q *MemoryQueue) complete(r model.TaskResult, now int64, events *memEvents) error {
+	t, ok := q.tasks[r.ID]
+	if !ok {
+		return ErrTaskNotFound
+	}
+
+	// Результаты нерешённых задач отменённого, просроченного или неудавшегося
+	// выражения просто игнорируем
+	e := t.expr
+	if !t.hasResult && (e.status != "in_progress" || (e.deadline > 0 && e.deadline <= now)) {
+		return nil
+	}
+
+	// Результат принимается только от держателя аренды этой задачи,
+	// в том числе повторный
+	var lease *memLease
+	for _, l := range t.leases {
+		if l.token == r.LeaseToken {
+			lease = l
+			break
+		}
+	}
+	if lease == nil {
+		return ErrLeaseMismatch
+	}
+
+	// Повторная отправка того же результата подтверждается без изменений,
+	// другой результат для уже решённой задачи отклоняется
+	if t.hasResult {
+		if t.result == r.Result {
+			return nil
+		}
+		// Агент опоздавшей реплики, разошедшейся с принятым результатом,
+		// теряет репутацию так же, как если бы его результат отверг кворум
+		if !lease.hasResult {
+			lease.status = "rejected"
+			lease.hasResult = true
+			lease.result = r.Result
+			if lease.agentID != "" {
+				events.disputed = append(events.disputed, lease.agentID)
+			}
+		}
+		return ErrResultConflict
+	}
+
+	if lease.hasResult {
+		if lease.result != r.Result {
+			return ErrResultConflict
+		}
+		return nil
+	}
+
+	// Если аренда истекла или освобождена и задача уже выдана другим агентам,
+	// результат принадлежит новым арендам
+	if lease.status != "active" || lease.expiresAt <= now {
+		if t.liveLeases(now, lease.token) >= e.replicas {
+			return ErrLeaseMismatch
+		}
+	}
+
+	lease.status = "submitted"
+	lease.hasResult = true
+	lease.result = r.Result
+
+	// Голоса одного агента по разным арендам считаются одним голосом
+	voters := make(map[string]bool)
+	agreeing := make(map[string]bool)
+	for _, l := range t.leases {
+		if l.status != "submitted" {
+			continue
+		}
+		voters[l.voter()] = true
+		if l.result == r.Result {
+			agreeing[l.voter()] = true
+		}
+	}
+
+	if len(agreeing) < quorum(e.replicas) {
+		if len(voters) >= e.replicas {
+			t.disputes++
+			for _, l := range t.leases {
+				if l.status == "submitted" {
+					l.status = "disputed"
+				}
+			}
+			if t.disputes >= maxTaskDisputes {
+				log.Printf("Task %s is disputed %d times: replicas never agreed on the result", t.id, t.disputes)
+				q.failTask(t, now, events)
+				return nil
+			}
+			log.Printf("Task %s is disputed: replicas did not agree on the result, re-running", t.id)
+		}
+		return nil
+	}
+
+	// Кворум набран - сохраняем результат задачи
+	t.hasResult = true
+	t.result = r.Result
+
+	agreed := make(map[string]bool)
+	disputed := make(map[string]bool)
+	for _, l := range t.leases {
+		if l.agentID != "" && (l.status == "submitted" || l.status == "disputed") {
+			if l.result == r.Result {
+				agreed[l.agentID] = true
+			} else {
+				disputed[l.agentID] = true
+			}
+		}
+
+		switch {
+		case l.status != "active" && l.status != "submitted" && l.status != "disputed":
+		case l.hasResult && l.result == r.Result:
+			l.status = "completed"
+		case l.hasResult:
+			l.status = "rejected"
+		default:
+			l.status = "released"
+		}
+	}
+	for id := range agreed {
+		events.agreed = append(events.agreed, id)
+	}
+	for id := range disputed {
+		events.disputed = append(events.disputed, id)
+	}
+
+	// Обновляем зависимости в других задачах, в том числе в выражениях,
+	// ссылающихся на это выражение
+	value := formatResult(r.Result)
+	for _, dep := range q.dependents[t.id] {
+		if dep.arg1 == t.id {
+			dep.arg1 = value
+		}
+		if dep.arg2 == t.id {
+			dep.arg2 = value
+		}
+	}
+	delete(q.dependents, t.id)
+
+	e.pending--
+	if e.pending == 0 {
+		e.status = "completed"
+		e.finishedAt = now
+		if final, ok := q.tasks[e.finalTask]; ok {
+			events.completed = append(events.completed, e.id)
+			events.results[e.id] = final.result
+		}
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Fail(ctx context.Context, taskID, leaseToken string) error {
+	now := time.Now().UnixMilli()
+	events := &memEvents{}
+
+	q.mu.Lock()
+	t, ok := q.tasks[taskID]
+	if !ok {
+		q.mu.Unlock()
+		return ErrTaskNotFound
+	}
+	if t.hasResult {
+		q.mu.Unlock()
+		return ErrResultConflict
+	}
+
+	held := false
+	for _, l := range t.leases {
+		if l.token == leaseToken && l.status == "active" {
+			held = true
+		}
+	}
+	if !held {
+		q.mu.Unlock()
+		return ErrLeaseMismatch
+	}
+
+	q.failTask(t, now, events)
+	q.mu.Unlock()
+
+	return q.flush(ctx, events)
+}
+
+func (q *MemoryQueue) Extend(ctx context.Context, leaseToken string, d time.Duration) (int64, error) {
+	now := time.Now()
+	nowMS := now.UnixMilli()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var expiresAt int64
+	for _, l := range q.leases[leaseToken] {
+		if l.status != "active" || l.expiresAt <= nowMS {
+			continue
+		}
+		if until := now.Add(d).UnixMilli(); until > l.expiresAt {
+			l.expiresAt = until
+		}
+		expiresAt = l.expiresAt
+	}
+	if expiresAt == 0 {
+		return 0, ErrLeaseNotFound
+	}
+	return expiresAt, nil
+}
+
+func (q *MemoryQueue) Release(ctx context.Context, leaseToken string, taskIDs []string) (int, error) {
+	nowMS := time.Now().UnixMilli()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wanted := make(map[string]bool, len(taskIDs))
+	for _, id := range taskIDs {
+		wanted[id] = true
+	}
+
+	released := 0
+	for _, l := range q.leases[leaseToken] {
+		if l.status != "active" || l.expiresAt <= nowMS {
+			continue
+		}
+		if len(wanted) > 0 && !wanted[l.task.id] {
+			continue
+		}
+		l.status = "released"
+		released++
+	}
+	if released == 0 {
+		return 0, ErrLeaseNotFound
+	}
+	return released, nil
+}
+
+func (q *MemoryQueue) ReleaseAgentLeases(ctx context.Context, orphaned func(agentID string) bool) (int, error) {
+	nowMS := time.Now().UnixMilli()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	released := 0
+	for _, leases := range q.leases {
+		for _, l := range leases {
+			if l.status != "active" || l.expiresAt <= nowMS || l.agentID == "" || !orphaned(l.agentID) {
+				continue
+			}
+			l.status = "released"
+			released++
+		}
+	}
+	return released, nil
+}
+
+func (q *MemoryQueue) Cancel(ctx context.Context, expressionID string) error {
+	events := &memEvents{}
+
+	// Выражение могло не дойти до очереди, например, ожидая допуска
+	q.mu.Lock()
+	if e, ok := q.expressions[expressionID]; ok && e.status == "in_progress" {
+		q.kill(e, time.Now().UnixMilli(), events)
+	}
+	q.mu.Unlock()
+
+	return q.flush(ctx, events)
+}
+
+func (q *MemoryQueue) Remove(ctx context.Context, expressionID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e, ok := q.expressions[expressionID]; ok {
+		q.forget(e)
+	}
+	return nil
+}
+
+// Recover ничего не исправляет: очередь в памяти не переживает
+// перезапуск оркестратора, и её состояние не бывает записано частично.
+func (q *MemoryQueue) Recover(ctx context.Context) (int64, int64, error) {
+	return 0, 0, nil
+}
+
+func (q *MemoryQueue) Depth(ctx context.Context) (int, error) {
+	events := &memEvents{}
+
+	q.mu.Lock()
+	q.sweep(time.Now().UnixMilli(), events)
+	depth := 0
+	for _, e := range q.expressions {
+		if e.status == "in_progress" {
+			depth += e.pending
+		}
+	}
+	q.mu.Unlock()
+
+	if err := q.flush(ctx, events); err != nil {
+		return 0, err
+	}
+	return depth, nil
+}
+
+func (q *MemoryQueue) Operations(ctx context.Context, expressionID string) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.expressions[expressionID]
+	if !ok {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	var operations []string
+	for _, t := range e.tasks {
+		if t.hasResult || seen[t.operation] {
+			continue
+		}
+		seen[t.operation] = true
+		operations = append(operations, t.operation)
+	}
+	sort.Strings(operations)
+	return operations, nil
+}
+
+// Disputes учитывает только выражения, задачи которых очередь ещё помнит
+// (см. finishedRetention).
+func (q *MemoryQueue) Disputes(ctx context.Context, expressionID string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.expressions[expressionID]
+	if !ok {
+		return 0, nil
+	}
+
+	disputes := 0
+	for _, t := range e.tasks {
+		disputes += t.disputes
+	}
+	return disputes, nil
+}
+
+// failTask завершает неудачей задачу и её выражение и освобождает аренды задачи.
+func (q *MemoryQueue) failTask(t *memTask, now int64, events *memEvents) {
+	t.failed = true
+	for _, l := range t.leases {
+		if l.status == "active" || l.status == "submitted" {
+			l.status = "released"
+		}
+	}
+	if t.expr.status == "in_progress" {
+		log.Printf("Expression %s failed: task %s cannot be computed", t.expr.id, t.id)
+		events.failed = append(events.failed, t.expr.id)
+		q.kill(t.expr, now, events)
+	}
+}
+
+// kill снимает с очереди выражение, которое уже не получит результат,
+// и выражения, ждущие результатов его задач. Неудачу ждущих выражений
+// kill сообщает хранилищу сам, а о самом выражении e сообщает вызывающий:
+// отменённое или просроченное выражение не считается неудавшимся.
+func (q *MemoryQueue) kill(e *memExpression, now int64, events *memEvents) {
+	e.status = "failed"
+	e.finishedAt = now
+
+	for _, t := range e.tasks {
+		for _, l := range t.leases {
+			if l.status == "active" {
+				l.status = "released"
+			}
+		}
+		for _, dep := range q.dependents[t.id] {
+			if dep.expr.status == "in_progress" {
+				log.Printf("Expression %s failed: referenced expression %s failed", dep.expr.id, e.id)
+				q.kill(dep.expr, now, events)
+				events.failed = append(events.failed, dep.expr.id)
+			}
+		}
+	}
+}
+
+// sweep снимает с очереди просроченные выражения и забывает задачи
+// выражений, завершившихся раньше finishedRetention.
+func (q *MemoryQueue) sweep(now int64, events *memEvents) {
+	if now-q.lastSweep < sweepInterval.Milliseconds() {
+		return
+	}
+	q.lastSweep = now
+
+	for _, e := range q.expressions {
+		if e.status == "in_progress" && e.deadline > 0 && e.deadline <= now {
+			q.kill(e, now, events)
+		}
+	}
+
+	for _, e := range q.expressions {
+		if e.status == "in_progress" || now-e.finishedAt < finishedRetention.Milliseconds() {
+			continue
+		}
+		q.forget(e)
+	}
+}
+
+// forget удаляет из очереди выражение вместе с его задачами и арендами.
+func (q *MemoryQueue) forget(e *memExpression) {
+	for _, t := range e.tasks {
+		delete(q.tasks, t.id)
+		delete(q.dependents, t.id)
+		for _, l := range t.leases {
+			q.forgetLease(l)
+		}
+	}
+	delete(q.expressions, e.id)
+}
+
+func (q *MemoryQueue) forgetLease(lease *memLease) {
+	leases := q.leases[lease.token][:0]
+	for _, l := range q.leases[lease.token] {
+		if l != lease {
+			leases = append(leases, l)
+		}
+	}
+	if len(leases) == 0 {
+		delete(q.leases, lease.token)
+		return
+	}
+	q.leases[lease.token] = leases
+}
+
+// flush сообщает хранилищу о завершённых выражениях и результатах агентов.
+func (q *MemoryQueue) flush(ctx context.Context, events *memEvents) error {
+	if q.store == nil {
+		return nil
+	}
+
+	if len(events.agreed) > 0 || len(events.disputed) > 0 {
+		if err := q.store.RecordAgentResults(ctx, events.agreed, events.disputed); err != nil {
+			return err
+		}
+	}
+	for _, id := range events.completed {
+		if err := q.store.CompleteExpression(ctx, id, events.results[id]); err != nil {
+			return err
+		}
+	}
+	for _, id := range events.failed {
+		if err := q.store.FailExpression(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveLeases возвращает число аренд задачи, кроме аренды except, которые
+// ещё действуют или уже прислали результат.
+func (t *memTask) liveLeases(now int64, except string) int {
+	count := 0
+	for _, l := range t.leases {
+		if l.token != except && l.live(now) {
+			count++
+		}
+	}
+	return count
+}
+
+func (t *memTask) leasedBy(agentID string, now int64) bool {
+	for _, l := range t.leases {
+		if l.agentID == agentID && l.live(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *memLease) live(now int64) bool {
+	return l.status == "submitted" || (l.status == "active" && l.expiresAt > now)
+}
+
+// voter возвращает того, чей это голос: агента или, если агент неизвестен, аренду.
+func (l *memLease) voter() string {
+	if l.agentID != "" {
+		return l.agentID
+	}
+	return l.token
+}
+
+// quorum возвращает число совпадающих результатов, при котором результат
+// задачи с заданным числом реплик принимается.
+func quorum(replicas int) int {
+	return replicas/2 + 1
+}
+
+// isNumber сообщает, что аргумент задачи — число, а не ID задачи, от которой
+// она зависит. Проверка та же, что у SQLiteQueue (NOT GLOB '*[a-zA-Z]*'),
+// чтобы обе очереди выдавали одни и те же задачи: "Inf", "NaN" и "1e5"
+// числами не считаются, а результаты записываются без экспоненты.
+func isNumber(arg string) bool {
+	return arg != "" && !strings.ContainsFunc(arg, func(r rune) bool {
+		return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+	})
+}
+
+func formatResult(result float64) string {
+	return strconv.FormatFloat(result, 'f', -1, 64)
+}
@@ -0,0 +1,400 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/model"
+	"github.com/pliliya111/go_final_sprint/internal/queue"
+)
+
+// fakeStore запоминает, что очередь сообщила о выражениях и агентах.
+type fakeStore struct {
+	completed map[string]float64
+	failed    []string
+	agreed    []string
+	disputed  []string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{completed: make(map[string]float64)}
+}
+
+func (s *fakeStore) UserWeight(ctx context.Context, userID int) (float64, error) {
+	return 1, nil
+}
+
+func (s *fakeStore) CompleteExpression(ctx context.Context, id string, result float64) error {
+	s.completed[id] = result
+	return nil
+}
+
+func (s *fakeStore) FailExpression(ctx context.Context, id string) error {
+	s.failed = append(s.failed, id)
+	return nil
+}
+
+func (s *fakeStore) RecordAgentResults(ctx context.Context, agreed, disputed []string) error {
+	s.agreed = append(s.agreed, agreed...)
+	s.disputed = append(s.disputed, disputed...)
+	return nil
+}
+
+// enqueue ставит в очередь выражение (2 * 3) + 4 из двух задач.
+func enqueue(t *testing.T, q queue.TaskQueue, id string, replicas int) {
+	t.Helper()
+	tasks := []*model.Task{
+		{ID: id + "-mul", Arg1: "2", Arg2: "3", Operation: "*", ExpressionId: id},
+		{ID: id + "-add", Arg1: id + "-mul", Arg2: "4", Operation: "+", ExpressionId: id},
+	}
+	expr := &model.Expression{ID: id, Result: id + "-add", Replicas: replicas, CreatedAt: time.Now().UnixMilli()}
+	if err := q.Enqueue(context.Background(), expr, tasks); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+}
+
+func claim(t *testing.T, q queue.TaskQueue, agentID string, max int) *model.Lease {
+	t.Helper()
+	lease, err := q.Claim(context.Background(), queue.ClaimRequest{AgentID: agentID, Max: max, LeaseDuration: time.Minute})
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	return lease
+}
+
+func complete(t *testing.T, q queue.TaskQueue, r model.TaskResult) error {
+	t.Helper()
+	rejections, err := q.Complete(context.Background(), []model.TaskResult{r})
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	return rejections[0]
+}
+
+func TestMemoryQueueDependencies(t *testing.T) {
+	store := newFakeStore()
+	q := queue.NewMemoryQueue(store)
+	enqueue(t, q, "e1", 1)
+
+	if depth, _ := q.Depth(context.Background()); depth != 2 {
+		t.Fatalf("expected depth 2, got %d", depth)
+	}
+
+	// Сложение ждёт результата умножения
+	lease := claim(t, q, "a", 10)
+	if lease == nil || len(lease.Tasks) != 1 || lease.Tasks[0].ID != "e1-mul" {
+		t.Fatalf("expected only the multiplication task, got %+v", lease)
+	}
+	if claim(t, q, "b", 10) != nil {
+		t.Fatal("expected no ready tasks while the lease is active")
+	}
+
+	mul := model.TaskResult{ID: "e1-mul", Result: 6, LeaseToken: lease.Token, AgentID: "a"}
+	if err := complete(t, q, model.TaskResult{ID: "unknown", Result: 6, LeaseToken: lease.Token}); !errors.Is(err, queue.ErrTaskNotFound) {
+		t.Errorf("expected ErrTaskNotFound, got %v", err)
+	}
+	if err := complete(t, q, model.TaskResult{ID: "e1-mul", Result: 6, LeaseToken: "wrong"}); !errors.Is(err, queue.ErrLeaseMismatch) {
+		t.Errorf("expected ErrLeaseMismatch, got %v", err)
+	}
+	if err := complete(t, q, mul); err != nil {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+	// Повтор того же результата подтверждается, другой результат отклоняется
+	if err := complete(t, q, mul); err != nil {
+		t.Errorf("expected repeated result to be accepted, got %v", err)
+	}
+	if err := complete(t, q, model.TaskResult{ID: "e1-mul", Result: 7, LeaseToken: lease.Token}); !errors.Is(err, queue.ErrResultConflict) {
+		t.Errorf("expected ErrResultConflict, got %v", err)
+	}
+	if err := complete(t, q, model.TaskResult{ID: "e1-mul", Result: 6, LeaseToken: "wrong"}); !errors.Is(err, queue.ErrLeaseMismatch) {
+		t.Errorf("expected repeated result without the lease to be rejected, got %v", err)
+	}
+
+	lease = claim(t, q, "b", 10)
+	if lease == nil || lease.Tasks[0].ID != "e1-add" || lease.Tasks[0].Arg1 != "6" {
+		t.Fatalf("expected the addition task with substituted argument, got %+v", lease)
+	}
+	if err := complete(t, q, model.TaskResult{ID: "e1-add", Result: 10, LeaseToken: lease.Token, AgentID: "b"}); err != nil {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+
+	if result, ok := store.completed["e1"]; !ok || result != 10 {
+		t.Errorf("expected expression to complete with 10, got %v (%v)", result, ok)
+	}
+	if depth, _ := q.Depth(context.Background()); depth != 0 {
+		t.Errorf("expected empty queue, got %d", depth)
+	}
+}
+
+func TestMemoryQueueReplicas(t *testing.T) {
+	store := newFakeStore()
+	q := queue.NewMemoryQueue(store)
+	enqueue(t, q, "e2", 3)
+
+	// Задача выдаётся разным агентам, но не дважды одному
+	leases := map[string]*model.Lease{}
+	for _, agent := range []string{"a", "b", "c"} {
+		leases[agent] = claim(t, q, agent, 1)
+		if leases[agent] == nil {
+			t.Fatalf("expected a replica for agent %s", agent)
+		}
+	}
+	if claim(t, q, "a", 1) != nil || claim(t, q, "d", 1) != nil {
+		t.Fatal("expected no more replicas")
+	}
+
+	submit := func(agent string, result float64) {
+		err := complete(t, q, model.TaskResult{ID: "e2-mul", Result: result, LeaseToken: leases[agent].Token, AgentID: agent})
+		if err != nil {
+			t.Fatalf("unexpected rejection: %v", err)
+		}
+	}
+	submit("a", 6)
+	submit("b", 7)
+	if claim(t, q, "d", 1) != nil {
+		t.Fatal("expected no task before quorum")
+	}
+	submit("c", 6)
+
+	if len(store.agreed) != 2 || len(store.disputed) != 1 || store.disputed[0] != "b" {
+		t.Errorf("expected agents a, c agreed and b disputed, got %v and %v", store.agreed, store.disputed)
+	}
+
+	lease := claim(t, q, "a", 1)
+	if lease == nil || lease.Tasks[0].Arg1 != "6" {
+		t.Fatalf("expected the addition task after quorum, got %+v", lease)
+	}
+}
+
+func TestMemoryQueueDisputes(t *testing.T) {
+	store := newFakeStore()
+	q := queue.NewMemoryQueue(store)
+	enqueue(t, q, "e8", 2)
+
+	// Реплики не выдаются агенту без ID
+	if claim(t, q, "", 1) != nil {
+		t.Fatal("expected no replica for an anonymous agent")
+	}
+
+	// Реплики ни разу не сошлись - после нескольких раундов выражение завершается неудачей
+	for round := 0; len(store.failed) == 0; round++ {
+		if round == 10 {
+			t.Fatal("expected the disputed task to fail")
+		}
+		a, b := claim(t, q, "a", 1), claim(t, q, "b", 1)
+		if a == nil || b == nil {
+			t.Fatalf("round %d: expected replicas for agents a and b", round)
+		}
+		for _, r := range []model.TaskResult{
+			{ID: "e8-mul", Result: 6, LeaseToken: a.Token, AgentID: "a"},
+			{ID: "e8-mul", Result: 7, LeaseToken: b.Token, AgentID: "b"},
+		} {
+			if err := complete(t, q, r); err != nil {
+				t.Fatalf("round %d: unexpected rejection: %v", round, err)
+			}
+		}
+	}
+	if store.failed[0] != "e8" {
+		t.Errorf("expected e8 to fail, got %v", store.failed)
+	}
+	if claim(t, q, "c", 1) != nil {
+		t.Error("expected no task of the failed expression")
+	}
+
+	// Опоздавшая реплика, разошедшаяся с принятым результатом, теряет репутацию
+	enqueue(t, q, "e9", 3)
+	leases := map[string]*model.Lease{}
+	for _, agent := range []string{"a", "b", "c"} {
+		leases[agent] = claim(t, q, agent, 1)
+	}
+	for _, agent := range []string{"a", "b"} {
+		if err := complete(t, q, model.TaskResult{ID: "e9-mul", Result: 6, LeaseToken: leases[agent].Token, AgentID: agent}); err != nil {
+			t.Fatalf("unexpected rejection: %v", err)
+		}
+	}
+	store.disputed = nil
+	err := complete(t, q, model.TaskResult{ID: "e9-mul", Result: 7, LeaseToken: leases["c"].Token, AgentID: "c"})
+	if !errors.Is(err, queue.ErrResultConflict) {
+		t.Errorf("expected ErrResultConflict, got %v", err)
+	}
+	if len(store.disputed) != 1 || store.disputed[0] != "c" {
+		t.Errorf("expected agent c to be disputed, got %v", store.disputed)
+	}
+}
+
+func TestMemoryQueueFailAndCancel(t *testing.T) {
+	store := newFakeStore()
+	q := queue.NewMemoryQueue(store)
+	enqueue(t, q, "e3", 1)
+
+	// Выражение, ссылающееся на результат e3
+	err := q.Enqueue(context.Background(),
+		&model.Expression{ID: "e4", Result: "e4-sub"},
+		[]*model.Task{{ID: "e4-sub", Arg1: "e3-add", Arg2: "1", Operation: "-", ExpressionId: "e4"}})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	lease := claim(t, q, "a", 10)
+	if err := q.Fail(context.Background(), "e3-mul", "wrong"); !errors.Is(err, queue.ErrLeaseMismatch) {
+		t.Errorf("expected ErrLeaseMismatch, got %v", err)
+	}
+	if err := q.Fail(context.Background(), "e3-mul", lease.Token); err != nil {
+		t.Fatalf("fail: %v", err)
+	}
+
+	// О неудаче ссылающегося выражения очередь сообщает сама
+	if len(store.failed) != 2 || store.failed[0] != "e3" || store.failed[1] != "e4" {
+		t.Errorf("expected e3 and e4 to fail, got %v", store.failed)
+	}
+	if depth, _ := q.Depth(context.Background()); depth != 0 {
+		t.Errorf("expected dependent expression to leave the queue, got depth %d", depth)
+	}
+
+	enqueue(t, q, "e5", 1)
+	lease = claim(t, q, "a", 10)
+	expiresAt, err := q.Extend(context.Background(), lease.Token, time.Hour)
+	if err != nil || expiresAt <= lease.ExpiresAt {
+		t.Errorf("expected lease to be extended, got %d (%v)", expiresAt, err)
+	}
+
+	if err := q.Cancel(context.Background(), "e5"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if _, err := q.Extend(context.Background(), lease.Token, time.Hour); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Errorf("expected released lease, got %v", err)
+	}
+	// Результат отменённого выражения игнорируется
+	if err := complete(t, q, model.TaskResult{ID: "e5-mul", Result: 6, LeaseToken: lease.Token}); err != nil {
+		t.Errorf("expected result to be ignored, got %v", err)
+	}
+	if _, ok := store.completed["e5"]; ok {
+		t.Error("expected cancelled expression not to complete")
+	}
+
+	// Ссылка на задачу, которой очередь не знает, не оставляет выражение висеть
+	store.failed = nil
+	err = q.Enqueue(context.Background(),
+		&model.Expression{ID: "e10", Result: "e10-add"},
+		[]*model.Task{{ID: "e10-add", Arg1: "forgotten", Arg2: "1", Operation: "+", ExpressionId: "e10"}})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if len(store.failed) != 1 || store.failed[0] != "e10" {
+		t.Errorf("expected e10 to fail, got %v", store.failed)
+	}
+	if claim(t, q, "a", 10) != nil {
+		t.Error("expected no task of the failed expression")
+	}
+
+	// Как и в SQLiteQueue, аргумент с буквами — не число, и задача не выдаётся
+	store.failed = nil
+	err = q.Enqueue(context.Background(),
+		&model.Expression{ID: "e11", Result: "e11-add"},
+		[]*model.Task{{ID: "e11-add", Arg1: "Inf", Arg2: "1e5", Operation: "+", ExpressionId: "e11"}})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if len(store.failed) != 1 || store.failed[0] != "e11" {
+		t.Errorf("expected e11 to fail, got %v", store.failed)
+	}
+	if claim(t, q, "a", 10) != nil {
+		t.Error("expected no task with a non-numeric argument")
+	}
+}
+
+func TestMemoryQueueCriticalPath(t *testing.T) {
+	q := queue.NewMemoryQueue(nil)
+	tasks := []*model.Task{
+		{ID: "short", Arg1: "5", Arg2: "6", Operation: "*", ExpressionId: "e6", CriticalPath: 2000},
+		{ID: "long", Arg1: "1", Arg2: "2", Operation: "+", ExpressionId: "e6", CriticalPath: 4000},
+	}
+	err := q.Enqueue(context.Background(), &model.Expression{ID: "e6", Result: "long"}, tasks)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	claimFirst := func(ordering string) string {
+		lease, err := q.Claim(context.Background(), queue.ClaimRequest{Ordering: ordering, Max: 1, LeaseDuration: time.Millisecond})
+		if err != nil || lease == nil {
+			t.Fatalf("claim: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		return lease.Tasks[0].ID
+	}
+
+	if id := claimFirst(queue.OrderFIFO); id != "short" {
+		t.Errorf("expected FIFO ordering to start with the first task, got %s", id)
+	}
+	if id := claimFirst(queue.OrderCriticalPath); id != "long" {
+		t.Errorf("expected the task on the critical path first, got %s", id)
+	}
+}
+
+func TestMemoryQueueRelease(t *testing.T) {
+	q := queue.NewMemoryQueue(newFakeStore())
+	enqueue(t, q, "e7", 1)
+
+	lease := claim(t, q, "a", 10)
+	if _, err := q.Release(context.Background(), lease.Token, []string{"other"}); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Errorf("expected ErrLeaseNotFound for a task outside the lease, got %v", err)
+	}
+	released, err := q.Release(context.Background(), lease.Token, nil)
+	if err != nil || released != 1 {
+		t.Fatalf("expected one released task, got %d (%v)", released, err)
+	}
+
+	// Освобождённая задача сразу выдаётся снова
+	lease = claim(t, q, "a", 10)
+	if lease == nil || lease.Tasks[0].ID != "e7-mul" {
+		t.Fatalf("expected the released task again, got %+v", lease)
+	}
+}
+
+func TestMemoryQueueReleaseAgentLeases(t *testing.T) {
+	q := queue.NewMemoryQueue(newFakeStore())
+	enqueue(t, q, "e12", 1)
+	enqueue(t, q, "e13", 1)
+	enqueue(t, q, "e14", 1)
+
+	claim(t, q, "dead", 1)
+	claim(t, q, "alive", 1)
+	claim(t, q, "", 1)
+	if claim(t, q, "other", 10) != nil {
+		t.Fatal("expected every ready task to be leased")
+	}
+
+	dead := func(agentID string) bool { return agentID != "alive" }
+	released, err := q.ReleaseAgentLeases(context.Background(), dead)
+	if err != nil || released != 1 {
+		t.Fatalf("expected one released lease, got %d (%v)", released, err)
+	}
+
+	// Аренда агента без ID не освобождается: жив ли он, неизвестно
+	lease := claim(t, q, "other", 10)
+	if lease == nil || len(lease.Tasks) != 1 || lease.Tasks[0].ID != "e12-mul" {
+		t.Errorf("expected the task of the dead agent again, got %+v", lease)
+	}
+}
+
+func TestMemoryQueueRemove(t *testing.T) {
+	q := queue.NewMemoryQueue(newFakeStore())
+	enqueue(t, q, "e15", 1)
+	claim(t, q, "a", 10)
+
+	if err := q.Remove(context.Background(), "e15"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if depth, _ := q.Depth(context.Background()); depth != 0 {
+		t.Errorf("expected an empty queue, got depth %d", depth)
+	}
+
+	// Выражение можно заново поставить в очередь
+	enqueue(t, q, "e15", 1)
+	lease := claim(t, q, "a", 10)
+	if lease == nil || lease.Tasks[0].ID != "e15-mul" {
+		t.Errorf("expected the task of the enqueued expression, got %+v", lease)
+	}
+}
@@ -0,0 +1,90 @@
+// Package queue описывает очередь задач оркестратора: постановку задач
+// выражений в очередь, выдачу их агентам под аренду и приём результатов.
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// Ошибки отклонения результата. Это те же значения, что возвращает
+// пакет database, поэтому их можно сравнивать через errors.Is
+// независимо от реализации очереди.
+var (
+	ErrTaskNotFound   = database.ErrTaskNotFound
+	ErrLeaseMismatch  = database.ErrLeaseMismatch
+	ErrResultConflict = database.ErrResultConflict
+	ErrLeaseNotFound  = database.ErrLeaseNotFound
+)
+
+// IsResultRejection сообщает, что результат отклонён из-за неизвестной задачи,
+// чужой аренды или конфликта с уже сохранённым результатом.
+func IsResultRejection(err error) bool {
+	return database.IsResultRejection(err)
+}
+
+// Порядок выдачи готовых задач одного пользователя с одинаковым приоритетом.
+const (
+	// Сначала задачи более старых выражений.
+	OrderFIFO = "fifo"
+	// Сначала задачи на самом долгом пути до результата своего выражения.
+	OrderCriticalPath = "critical_path"
+)
+
+// ClaimRequest — запрос агента на задачи.
+type ClaimRequest struct {
+	AgentID string
+	// Операции, которые выполняет агент; nil — любые.
+	Operations    []string
+	Ordering      string
+	Max           int
+	LeaseDuration time.Duration
+}
+
+// TaskQueue — очередь задач. Задача выдаётся агенту, когда все её аргументы
+// вычислены; результат принимается только от держателя аренды и, для выражений
+// с несколькими репликами, только после кворума совпадающих результатов.
+type TaskQueue interface {
+	// Enqueue ставит в очередь задачи выражения. expr.Result должен
+	// содержать ID задачи, результат которой — результат всего выражения.
+	Enqueue(ctx context.Context, expr *model.Expression, tasks []*model.Task) error
+	// Claim выдаёт до req.Max готовых задач под одну аренду.
+	// Если готовых задач нет, возвращается nil.
+	Claim(ctx context.Context, req ClaimRequest) (*model.Lease, error)
+	// Complete принимает результаты задач. Для каждого результата возвращается
+	// ошибка отклонения или nil; вторая ошибка означает, что не принято ничего.
+	Complete(ctx context.Context, results []model.TaskResult) ([]error, error)
+	// Fail сообщает, что задачу невозможно вычислить; выражение задачи
+	// и ссылающиеся на него выражения завершаются неудачей.
+	Fail(ctx context.Context, taskID, leaseToken string) error
+	// Extend продлевает аренду не меньше чем на d и возвращает её новый срок (unix ms).
+	Extend(ctx context.Context, leaseToken string, d time.Duration) (int64, error)
+	// Release возвращает в очередь задачи taskIDs действующей аренды (все её
+	// задачи, если taskIDs пуст), чтобы их сразу получили другие агенты.
+	// Возвращает число освобождённых задач.
+	Release(ctx context.Context, leaseToken string, taskIDs []string) (int, error)
+	// ReleaseAgentLeases возвращает в очередь задачи действующих аренд агентов,
+	// для которых orphaned возвращает true, например мёртвых. Аренды без ID
+	// агента не освобождаются. Возвращает число освобождённых аренд.
+	ReleaseAgentLeases(ctx context.Context, orphaned func(agentID string) bool) (int, error)
+	// Cancel снимает с очереди задачи отменённого выражения и освобождает их аренды.
+	Cancel(ctx context.Context, expressionID string) error
+	// Remove удаляет из очереди задачи выражения вместе с их арендами,
+	// чтобы заново разбить выражение на задачи.
+	Remove(ctx context.Context, expressionID string) error
+	// Recover исправляет состояние очереди после аварийной остановки
+	// оркестратора: подставляет потерянные результаты задач в зависимые
+	// задачи и завершает выражения, все задачи которых решены. Возвращает
+	// число исправленных задач и завершённых выражений.
+	Recover(ctx context.Context) (resolved, finalized int64, err error)
+	// Depth возвращает число нерешённых задач вычисляемых выражений.
+	Depth(ctx context.Context) (int, error)
+	// Operations возвращает операции нерешённых задач выражения.
+	Operations(ctx context.Context, expressionID string) ([]string, error)
+	// Disputes возвращает, сколько раз реплики задач выражения
+	// расходились в результатах.
+	Disputes(ctx context.Context, expressionID string) (int, error)
+}
@@ -0,0 +1,109 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/database"
+	"github.com/pliliya111/go_final_sprint/internal/model"
+)
+
+// SQLiteQueue хранит задачи и аренды в таблицах tasks и task_leases.
+// Результат задачи, подстановка его в зависимые задачи и завершение
+// выражения сохраняются в одной транзакции, поэтому очередь переживает
+// перезапуск оркестратора и может обслуживаться несколькими его копиями.
+type SQLiteQueue struct {
+	db *sql.DB
+}
+
+func NewSQLiteQueue(db *sql.DB) *SQLiteQueue {
+	return &SQLiteQueue{db: db}
+}
+
+func (q *SQLiteQueue) Enqueue(ctx context.Context, expr *model.Expression, tasks []*model.Task) error {
+	return database.InsertTasks(ctx, q.db, tasks)
+}
+
+func (q *SQLiteQueue) Claim(ctx context.Context, req ClaimRequest) (*model.Lease, error) {
+	return database.ClaimTasks(ctx, q.db, req.AgentID, req.Operations, req.Ordering, req.Max, req.LeaseDuration)
+}
+
+func (q *SQLiteQueue) Complete(ctx context.Context, results []model.TaskResult) ([]error, error) {
+	return database.UpdateTaskResults(ctx, q.db, results)
+}
+
+func (q *SQLiteQueue) Fail(ctx context.Context, taskID, leaseToken string) error {
+	return database.FailTask(ctx, q.db, taskID, leaseToken)
+}
+
+func (q *SQLiteQueue) Extend(ctx context.Context, leaseToken string, d time.Duration) (int64, error) {
+	return database.ExtendLease(ctx, q.db, leaseToken, d)
+}
+
+func (q *SQLiteQueue) Release(ctx context.Context, leaseToken string, taskIDs []string) (int, error) {
+	return database.ReleaseLease(ctx, q.db, leaseToken, taskIDs)
+}
+
+func (q *SQLiteQueue) ReleaseAgentLeases(ctx context.Context, orphaned func(agentID string) bool) (int, error) {
+	return database.ReleaseAgentLeases(ctx, q.db, orphaned)
+}
+
+func (q *SQLiteQueue) Cancel(ctx context.Context, expressionID string) error {
+	return database.ReleaseExpressionLeases(ctx, q.db, expressionID)
+}
+
+func (q *SQLiteQueue) Remove(ctx context.Context, expressionID string) error {
+	return database.DeleteExpressionTasks(ctx, q.db, expressionID)
+}
+
+func (q *SQLiteQueue) Recover(ctx context.Context) (int64, int64, error) {
+	resolved, err := database.ResolveSolvedDependencies(ctx, q.db)
+	if err != nil {
+		return 0, 0, err
+	}
+	finalized, err := database.FinalizeSolvedExpressions(ctx, q.db)
+	if err != nil {
+		return resolved, 0, err
+	}
+	return resolved, finalized, nil
+}
+
+func (q *SQLiteQueue) Depth(ctx context.Context) (int, error) {
+	return database.CountQueuedTasks(ctx, q.db)
+}
+
+func (q *SQLiteQueue) Operations(ctx context.Context, expressionID string) ([]string, error) {
+	return database.GetTaskOperations(ctx, q.db, expressionID)
+}
+
+func (q *SQLiteQueue) Disputes(ctx context.Context, expressionID string) (int, error) {
+	return database.CountExpressionDisputes(ctx, q.db, expressionID)
+}
+
+// sqlStore сохраняет в базу данных то, что очередь в памяти сообщает
+// о выражениях и агентах.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore возвращает Store поверх базы данных оркестратора.
+func NewSQLStore(db *sql.DB) Store {
+	return &sqlStore{db: db}
+}
+
+func (s *sqlStore) UserWeight(ctx context.Context, userID int) (float64, error) {
+	return database.GetUserWeight(ctx, s.db, userID)
+}
+
+func (s *sqlStore) CompleteExpression(ctx context.Context, id string, result float64) error {
+	return database.CompleteExpression(ctx, s.db, id, result)
+}
+
+func (s *sqlStore) FailExpression(ctx context.Context, id string) error {
+	return database.FailExpression(ctx, s.db, id)
+}
+
+func (s *sqlStore) RecordAgentResults(ctx context.Context, agreed, disputed []string) error {
+	return database.RecordAgentResults(ctx, s.db, agreed, disputed)
+}
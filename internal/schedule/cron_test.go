@@ -0,0 +1,91 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pliliya111/go_final_sprint/internal/schedule"
+)
+
+func TestCronNext(t *testing.T) {
+	// Пятница, 3 января 2025 года
+	from := time.Date(2025, 1, 3, 10, 17, 30, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		spec     string
+		expected time.Time
+	}{
+		{
+			name:     "Every minute",
+			spec:     "* * * * *",
+			expected: time.Date(2025, 1, 3, 10, 18, 0, 0, time.UTC),
+		},
+		{
+			name:     "Step",
+			spec:     "*/15 * * * *",
+			expected: time.Date(2025, 1, 3, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			name:     "Daily",
+			spec:     "@daily",
+			expected: time.Date(2025, 1, 4, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "List and range",
+			spec:     "0 9,18 * * 1-5",
+			expected: time.Date(2025, 1, 3, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Sunday as 7",
+			spec:     "30 6 * * 7",
+			expected: time.Date(2025, 1, 5, 6, 30, 0, 0, time.UTC),
+		},
+		{
+			name:     "Day of month or day of week",
+			spec:     "0 0 10 * 1",
+			expected: time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Next year",
+			spec:     "0 0 1 1 *",
+			expected: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "Never",
+			spec:     "0 0 30 2 *",
+			expected: time.Time{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cron, err := schedule.ParseCron(tt.spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if next := cron.Next(from); !next.Equal(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, next)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+
+	for _, spec := range specs {
+		if _, err := schedule.ParseCron(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}